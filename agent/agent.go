@@ -9,6 +9,7 @@ import (
 	"os/signal"
 	"syscall"
 	"sync"
+	"sort"
 
 	"taylor/lib/tcp"
 	"taylor/lib/structs"
@@ -23,20 +24,71 @@ type Client struct {
 	conn		*tcp.Conn
 	jobsRunningMtx  *sync.Mutex
 	jobsRunning	map[string]*structs.Job
+	// jobs that got cancelled before their runner picked them up
+	jobsCancelled	map[string]bool
 	gpuInfo		[]structs.GpuInfo
+	resources	structs.ResourceInfo
+	// summed up resource requirements of jobsRunning
+	resourcesInUse	structs.ResourceRequirement
+	// gpu index -> id of the job it is pinned to
+	gpusReserved	map[int]string
+	// sorted keys of gpusReserved. updated together with it so that we can report them without the lock
+	gpusReservedList []int
 	drivers		map[string]*structs.Driver
 	newJobCh	chan *structs.Job
 	msgOutCh	chan interface{}
+	// guards conn while messages are written to it
+	connMtx		*sync.Mutex
+	connected	bool
+	// results of jobs that finished while we were disconnected. delivered after the next handshake
+	pendingDone	[]tcp.MsgJobDone
 }
 
 func (c *Client) HasCapacity() bool {
 	return (c.config.Scheduler.MaxParallelJobs - uint(len(c.jobsRunning))) > 0
 }
 
+// total resources minus the reserved ones and the ones of running jobs
+func (c *Client) resourceInfo() structs.ResourceInfo {
+	info := c.resources
+	info.CpuAllocatable = info.CpuTotal
+	info.MemoryAllocatableMB = info.MemoryTotalMB
+	info.Allocate(c.config.Reserved.Add(c.resourcesInUse))
+	return info
+}
+
+// must be called with jobsRunningMtx locked
+func (c *Client) updateGpusReservedList() {
+	gpus := make([]int, 0, len(c.gpusReserved))
+	for k := range c.gpusReserved {
+		gpus = append(gpus, k)
+	}
+	sort.Ints(gpus)
+	c.gpusReservedList = gpus
+}
+
 func (c *Client) updateGpuInfo(gpuInfo []structs.GpuInfo) {
 	c.gpuInfo = gpuInfo
 }
 
+// jobs the server has to keep scheduled on us: the running ones and the ones whose result
+// hasn't been delivered yet
+func (c *Client) reportedJobs() []string {
+	c.jobsRunningMtx.Lock()
+	jobs := make([]string, 0, len(c.jobsRunning))
+	for jobId := range c.jobsRunning {
+		jobs = append(jobs, jobId)
+	}
+	c.jobsRunningMtx.Unlock()
+
+	c.connMtx.Lock()
+	for _, done := range c.pendingDone {
+		jobs = append(jobs, done.Job.Id)
+	}
+	c.connMtx.Unlock()
+	return jobs
+}
+
 func (c *Client) handshake() error {
 
 	// create handshake message
@@ -44,6 +96,7 @@ func (c *Client) handshake() error {
 		 MsgBase: c.GetMsgBase(tcp.MSG_HANDSHAKE_INITIAL),
 		 MsgAgentInfo: c.GetMsgAgentInfo(),
 		 NodeType: "agent",
+		 Jobs: c.reportedJobs(),
 	})
 
 	fmt.Println("Wait for handshake response")
@@ -85,13 +138,18 @@ func (c *Client) sendJobOfferResponse(job *structs.Job, refuseReason string) {
 
 func (c *Client) acceptJobOffer(job *structs.Job) {
 	c.jobsRunningMtx.Lock()
-	defer c.jobsRunningMtx.Unlock()
 	fmt.Println("Have capacity")
 
 	job.Status = structs.JOB_STATUS_SCHEDULED
 	job.AgentName = c.config.Name
 
 	c.jobsRunning[job.Id] = job
+	c.resourcesInUse = c.resourcesInUse.Add(job.Resources)
+	for _, k := range job.GpuIndices {
+		c.gpusReserved[k] = job.Id
+	}
+	c.updateGpusReservedList()
+	c.jobsRunningMtx.Unlock()
 
 	c.sendJobOfferResponse(job, "")
 }
@@ -101,6 +159,30 @@ func (c *Client) rejectJobOffer(job *structs.Job, reason string) {
 }
 
 func (c *Client) canAcceptJob(job *structs.Job) (bool, string) {
+	c.jobsRunningMtx.Lock()
+	_, running := c.jobsRunning[job.Id]
+	resources := c.resourceInfo()
+	gpuReason := ""
+	for _, k := range job.GpuIndices {
+		if k < 0 || k >= len(c.gpuInfo) {
+			gpuReason = fmt.Sprintf("Node has no GPU %d", k)
+		} else if owner, reserved := c.gpusReserved[k]; reserved {
+			gpuReason = fmt.Sprintf("GPU %d already reserved for job %s", k, owner)
+		}
+	}
+	c.jobsRunningMtx.Unlock()
+	if running {
+		return false, "Job already running at node"
+	}
+
+	if gpuReason != "" {
+		return false, gpuReason
+	}
+
+	if resources.Fulfills(job.Resources) == false {
+		return false, "Node doesn't have enough cpu or memory left"
+	}
+
 	if c.HasCapacity() == false {
 		return false, "Node has no capacity left"
 	}
@@ -111,6 +193,14 @@ func (c *Client) canAcceptJob(job *structs.Job) (bool, string) {
 		return false, "Node doesn't have required capabilities"
 	}
 
+	selector, err := util.ParseSelector(job.Selector)
+	if err != nil {
+		return false, err.Error()
+	}
+	if selector.Matches(c.config.Labels) == false {
+		return false, "Node doesn't match selector"
+	}
+
 	return true, ""
 }
 
@@ -121,22 +211,16 @@ func (c *Client) connect(clusterAddr string) error {
 	}
 
 	c.conn = tcp.NewConn(tcpConn)
+	// the server asks for our info regularly. if it doesn't, reading fails and we reconnect
+	timeout := c.config.Heartbeat.TimeoutMs * time.Millisecond
+	c.conn.SetTimeouts(timeout, timeout)
 
 	if err = c.handshake(); err != nil {
+		c.conn.Close()
 		return err
 	}
-
-	// msgOutCh
-	go func() {
-		for {
-			pl := <-c.msgOutCh
-			err := c.conn.WriteMessage(pl)
-			if err != nil {
-				fmt.Fprintf(os.Stderr, "Error writing %v\n", err)
-				// break
-			}
-		}
-	}()
+	c.deliverPendingDone()
+	defer c.disconnected()
 
 	for {
 		message, cmd, err := c.conn.ReadMessage()
@@ -146,6 +230,10 @@ func (c *Client) connect(clusterAddr string) error {
 		}
 
 		switch (cmd) {
+		case tcp.MSG_SERVER_SHUTDOWN:
+			// our jobs keep running, their results are delivered after we reconnected
+			fmt.Println("Server is shutting down")
+			return nil
 		case tcp.MSG_AGENT_INFO_REQUEST:
 			c.msgOutCh <- tcp.MsgAgentInfoResponse{
 				MsgBase: c.GetMsgBase(tcp.MSG_AGENT_INFO_RESPONSE),
@@ -172,6 +260,9 @@ func (c *Client) connect(clusterAddr string) error {
 			} else {
 				fmt.Println("Job cancelled")
 			}
+			if req.GraceMs > 0 {
+				c.killJobAfter(&req.Job, time.Duration(req.GraceMs) * time.Millisecond)
+			}
 		default:
 			fmt.Println("Unknown command received")
 		}
@@ -179,6 +270,73 @@ func (c *Client) connect(clusterAddr string) error {
 	return nil
 }
 
+// results that couldn't be delivered go first, then everything else (see startWriter)
+func (c *Client) deliverPendingDone() {
+	c.connMtx.Lock()
+	defer c.connMtx.Unlock()
+
+	for len(c.pendingDone) > 0 {
+		if err := c.conn.WriteMessage(c.pendingDone[0]); err != nil {
+			fmt.Fprintf(os.Stderr, "Error writing %v\n", err)
+			return
+		}
+		fmt.Printf("Delivered result of job %s\n", c.pendingDone[0].Job.Id)
+		c.pendingDone = c.pendingDone[1:]
+	}
+	c.connected = true
+}
+
+func (c *Client) disconnected() {
+	c.connMtx.Lock()
+	defer c.connMtx.Unlock()
+
+	c.connected = false
+	c.conn.Close()
+}
+
+// writes the messages of msgOutCh to the current connection. results of jobs are kept
+// while we are disconnected, everything else is dropped
+func (c *Client) startWriter() {
+	go func() {
+		for {
+			pl := <-c.msgOutCh
+
+			c.connMtx.Lock()
+			var err error
+			if c.connected {
+				err = c.conn.WriteMessage(pl)
+				if err != nil {
+					fmt.Fprintf(os.Stderr, "Error writing %v\n", err)
+				}
+			}
+			if done, ok := pl.(tcp.MsgJobDone); ok && (c.connected == false || err != nil) {
+				fmt.Printf("Keep result of job %s until we are connected again\n", done.Job.Id)
+				c.pendingDone = append(c.pendingDone, done)
+			}
+			c.connMtx.Unlock()
+		}
+	}()
+}
+
+// lets the server know we are alive even if its requests don't get through
+func (c *Client) startHeartbeat() {
+	go func() {
+		for {
+			time.Sleep(c.config.Heartbeat.IntervalMs * time.Millisecond)
+
+			c.connMtx.Lock()
+			connected := c.connected
+			c.connMtx.Unlock()
+			if connected {
+				c.msgOutCh <- tcp.MsgAgentInfoResponse{
+					MsgBase: c.GetMsgBase(tcp.MSG_AGENT_INFO_RESPONSE),
+					MsgAgentInfo: c.GetMsgAgentInfo(),
+				}
+			}
+		}
+	}()
+}
+
 func (c *Client) close() {
 	if c.conn != nil {
 		fmt.Println("Close", c.conn)
@@ -197,6 +355,12 @@ func (c *Client) onJobUpdate(job *structs.Job, progress float32, message string)
 }
 
 func (c *Client) cancelJob(job *structs.Job) (err error) {
+	c.jobsRunningMtx.Lock()
+	if _, running := c.jobsRunning[job.Id]; running {
+		c.jobsCancelled[job.Id] = true
+	}
+	c.jobsRunningMtx.Unlock()
+
 	driver, in := c.drivers[job.Driver]
 	if in == false {
 		return errors.New(fmt.Sprintf("driver %s not registered", job.Driver))
@@ -212,6 +376,28 @@ func (c *Client) cancelJob(job *structs.Job) (err error) {
 	return err
 }
 
+// kills the job if it is still running after grace
+func (c *Client) killJobAfter(job *structs.Job, grace time.Duration) {
+	driver, in := c.drivers[job.Driver]
+	if in == false || driver.Kill == nil {
+		return
+	}
+
+	time.AfterFunc(grace, func () {
+		c.jobsRunningMtx.Lock()
+		_, running := c.jobsRunning[job.Id]
+		c.jobsRunningMtx.Unlock()
+		if running == false {
+			return
+		}
+
+		fmt.Printf("Job %s didn't stop in time\n", job.Id)
+		if err := driver.Kill(job, driver); err != nil {
+			fmt.Fprintf(os.Stderr, "Error killing job %s: %v\n", job.Id, err)
+		}
+	})
+}
+
 func (c *Client) execJob(job *structs.Job) (interrupted bool, err error) {
 
 	driver, in := c.drivers[job.Driver]
@@ -238,25 +424,47 @@ func (c *Client) GetMsgBase(cmd tcp.MsgCmd) tcp.MsgBase {
 }
 
 
+// takes jobsRunningMtx. callers must not hold it
 func (c *Client) GetMsgAgentInfo() tcp.MsgAgentInfo {
+	c.jobsRunningMtx.Lock()
+	defer c.jobsRunningMtx.Unlock()
+
 	return tcp.MsgAgentInfo{
 		Capacity: c.config.Scheduler.MaxParallelJobs,
 		JobsRunning: uint(len(c.jobsRunning)),
 		Capabilities: c.config.Capabilities,
+		Labels: c.config.Labels,
 		GpuInfo: c.gpuInfo,
+		Resources: c.resourceInfo(),
+		GpusReserved: c.gpusReservedList,
 	}
 }
 
-func (c *Client) handleJobDone(job *structs.Job, interrupted bool, success bool, jobErrorMessage string) {
+func (c *Client) handleJobDone(job *structs.Job, interrupted bool, jobErr error) {
 	c.jobsRunningMtx.Lock()
-	defer c.jobsRunningMtx.Unlock()
 
+	if _, in := c.jobsRunning[job.Id]; in {
+		c.resourcesInUse = c.resourcesInUse.Sub(job.Resources)
+		for _, k := range job.GpuIndices {
+			if c.gpusReserved[k] == job.Id {
+				delete(c.gpusReserved, k)
+			}
+		}
+		c.updateGpusReservedList()
+	}
 	delete(c.jobsRunning, job.Id)
+	delete(c.jobsCancelled, job.Id)
+	c.jobsRunningMtx.Unlock()
 
+	success := jobErr == nil
+	jobErrorMessage := ""
 	if success == true {
 		job.Status = structs.JOB_STATUS_SUCCESS
 	} else {
-		if interrupted == true {
+		jobErrorMessage = jobErr.Error()
+		if errors.Is(jobErr, structs.ErrJobTimeout) {
+			job.Status = structs.JOB_STATUS_TIMEOUT
+		} else if interrupted == true {
 			job.Status = structs.JOB_STATUS_CANCEL
 		} else {
 			job.Status = structs.JOB_STATUS_ERROR
@@ -279,14 +487,21 @@ func (c *Client) startJobRunner() {
 			job := <-c.newJobCh
 			go func(job *structs.Job) {
 				fmt.Println("Received job data...")
+
+				c.jobsRunningMtx.Lock()
+				cancelled := c.jobsCancelled[job.Id]
+				c.jobsRunningMtx.Unlock()
+				if cancelled == true {
+					c.handleJobDone(job, true, errors.New("Job cancelled before it started"))
+					return
+				}
+
 				interrupted, err := c.execJob(job)
 				if err != nil {
 					fmt.Fprintf(os.Stderr, "Error executing job %s (%s)- %v\n", job.Id, job.Identifier, err)
-					c.handleJobDone(job, interrupted, false, err.Error())
-					return
 				}
 
-				c.handleJobDone(job, false, true, "")
+				c.handleJobDone(job, interrupted, err)
 			}(job)
 		}
 	}()
@@ -329,14 +544,26 @@ func Run(args []string, devMode bool) int {
 		config:		config,
 		jobsRunningMtx: &sync.Mutex{},
 		jobsRunning:	make(map[string]*structs.Job),
+		jobsCancelled:	make(map[string]bool),
+		gpusReserved:	make(map[int]string),
+		gpusReservedList: make([]int, 0),
 		drivers:	driverMap,
 		newJobCh:	make(chan *structs.Job, config.Scheduler.MaxParallelJobs),
 		msgOutCh:	make(chan interface{}, 5),
+		connMtx:	&sync.Mutex{},
+		pendingDone:	make([]tcp.MsgJobDone, 0),
 	}
 
 	defer client.close()
 
-	intC := make(chan os.Signal)
+	resources, err := readResources()
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error reading cpu and memory: %v\n", err)
+	}
+	client.resources = resources
+	fmt.Printf("Resources: %+v\n", client.resourceInfo())
+
+	intC := make(chan os.Signal, 1)
 	signal.Notify(intC, os.Interrupt, syscall.SIGTERM)
 	go func() {
 		<-intC
@@ -348,11 +575,16 @@ func Run(args []string, devMode bool) int {
 		startPollGPUDataLoop(config.NvidiaCfg, client.updateGpuInfo)
 	}
 	client.startJobRunner()
+	client.startWriter()
+	client.startHeartbeat()
 
 	for {
-		err := client.connect(config.ClusterAddr)
-		if err != nil {
-			fmt.Fprintf(os.Stderr, "Agent Connect err: %+v\n", err)
+		// after losing the connection, the next server might have taken over
+		for _, addr := range config.ServerAddrs() {
+			err := client.connect(addr)
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "Agent Connect err (%s): %+v\n", addr, err)
+			}
 		}
 		time.Sleep(5 * time.Second)
 		fmt.Println("Try again to connect to cluster...")
@@ -0,0 +1,113 @@
+package agent
+
+import (
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	"taylor/lib/structs"
+	"taylor/lib/tcp"
+)
+
+func newTestClient() *Client {
+	return &Client{
+		config:		Config{Name: "agent"},
+		jobsRunningMtx: &sync.Mutex{},
+		jobsRunning:	make(map[string]*structs.Job),
+		jobsCancelled:	make(map[string]bool),
+		gpusReserved:	make(map[int]string),
+		gpusReservedList: make([]int, 0),
+		msgOutCh:	make(chan interface{}, 5),
+		connMtx:	&sync.Mutex{},
+		pendingDone:	make([]tcp.MsgJobDone, 0),
+	}
+}
+
+func doneMessage(c *Client, jobId string) tcp.MsgJobDone {
+	return tcp.MsgJobDone{
+		MsgBase: c.GetMsgBase(tcp.MSG_JOB_DONE),
+		Success: true,
+		Job: structs.Job{Id: jobId, Status: structs.JOB_STATUS_SUCCESS},
+	}
+}
+
+func readMessage(t *testing.T, conn *tcp.Conn) interface{} {
+	message, _, err := conn.ReadMessage()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return message
+}
+
+func TestPendingDoneDeliveredAfterHandshake(t *testing.T) {
+	c := newTestClient()
+	c.startWriter()
+
+	// results are kept while we are disconnected, everything else is dropped
+	c.msgOutCh <- tcp.MsgAgentInfoResponse{MsgBase: c.GetMsgBase(tcp.MSG_AGENT_INFO_RESPONSE)}
+	c.msgOutCh <- doneMessage(c, "first")
+	c.msgOutCh <- doneMessage(c, "second")
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		c.connMtx.Lock()
+		pending := len(c.pendingDone)
+		c.connMtx.Unlock()
+		if pending == 2 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("Results of finished jobs must be kept while disconnected, have", pending)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	agentEnd, serverEnd := net.Pipe()
+	defer serverEnd.Close()
+	c.conn = tcp.NewConn(agentEnd)
+	server := tcp.NewConn(serverEnd)
+
+	handshakeErr := make(chan error, 1)
+	go func() {
+		err := c.handshake()
+		if err == nil {
+			c.deliverPendingDone()
+		}
+		handshakeErr <- err
+	}()
+
+	// the server has to keep the jobs of the undelivered results scheduled
+	initial, ok := readMessage(t, server).(tcp.MsgHandshakeInitial)
+	if ok == false || len(initial.Jobs) != 2 || initial.Jobs[0] != "first" || initial.Jobs[1] != "second" {
+		t.Fatal("Handshake must report the jobs of pending results, got", initial.Jobs)
+	}
+	err := server.WriteMessage(tcp.MsgHandshakeResponse{
+		MsgBase: tcp.MsgBase{Command: tcp.MSG_HANDSHAKE_RESPONSE, NodeName: "server"},
+		Accepted: true,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// pending results go first and in order
+	for _, jobId := range []string{"first", "second"} {
+		done, ok := readMessage(t, server).(tcp.MsgJobDone)
+		if ok == false || done.Job.Id != jobId {
+			t.Fatal("Expected result of job", jobId, "got", done.Job.Id)
+		}
+	}
+	if err := <-handshakeErr; err != nil {
+		t.Fatal(err)
+	}
+
+	// connected now, results go out right away
+	c.msgOutCh <- doneMessage(c, "third")
+	if done, ok := readMessage(t, server).(tcp.MsgJobDone); ok == false || done.Job.Id != "third" {
+		t.Fatal("Expected result of job third, got", done.Job.Id)
+	}
+	c.connMtx.Lock()
+	defer c.connMtx.Unlock()
+	if len(c.pendingDone) != 0 {
+		t.Fatal("Delivered results must not be kept")
+	}
+}
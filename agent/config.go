@@ -6,7 +6,10 @@ import (
 	"encoding/json"
 	"io/ioutil"
 	"errors"
+	"strings"
 	"time"
+
+	"taylor/lib/structs"
 )
 
 type SchedulerConfig struct {
@@ -18,12 +21,36 @@ type NvidiaConfig struct {
 	PollTimeMs    time.Duration	`json:"poll_ms"`
 }
 
+type HeartbeatConfig struct {
+	// time between two agent infos that are sent to the server without being asked for
+	IntervalMs	time.Duration	`json:"interval_ms"`
+	// the connection is dropped (and reestablished) if the server hasn't sent anything for this long
+	TimeoutMs	time.Duration	`json:"timeout_ms"`
+}
+
 type Config struct {
+	// tcp address of the server. comma separated if the servers run as a cluster,
+	// only the leader accepts agents
 	ClusterAddr	string		`json:"cluster"`
 	Name		string		`json:"name"`
 	Capabilities	[]string	`json:"capabilities"`
+	// key/value labels jobs can select on (see selector of a job)
+	Labels		map[string]string	`json:"labels"`
 	Scheduler	SchedulerConfig	`json:"scheduler"`
 	NvidiaCfg	NvidiaConfig	`json:"nvidia"`
+	// cpu and memory that are kept for the system and not given to jobs
+	Reserved	structs.ResourceRequirement	`json:"reserved"`
+	Heartbeat	HeartbeatConfig	`json:"heartbeat"`
+}
+
+func (config Config) ServerAddrs() []string {
+	addrs := make([]string, 0)
+	for _, addr := range strings.Split(config.ClusterAddr, ",") {
+		if addr = strings.TrimSpace(addr); addr != "" {
+			addrs = append(addrs, addr)
+		}
+	}
+	return addrs
 }
 
 func defaultName() (string, error) {
@@ -40,6 +67,7 @@ func DevModeConfig() Config {
 		ClusterAddr: "127.0.0.1:8401",
 		Name: name,
 		Capabilities: []string{},
+		Labels: make(map[string]string),
 		Scheduler: SchedulerConfig{
 			MaxParallelJobs: 25,
 		},
@@ -47,6 +75,10 @@ func DevModeConfig() Config {
 			NvidiaSmiPath: "nvidia-smi.exe",
 			PollTimeMs: 1000,
 		},
+		Heartbeat: HeartbeatConfig{
+			IntervalMs: 1000,
+			TimeoutMs: 10000,
+		},
 	}
 	return config
 }
@@ -81,6 +113,18 @@ func ReadConfig(path string) (Config, error) {
 	if config.Capabilities == nil {
 		config.Capabilities = make([]string, 0)
 	}
+	if config.Labels == nil {
+		config.Labels = make(map[string]string)
+	}
+	if config.Heartbeat.IntervalMs == 0 {
+		config.Heartbeat.IntervalMs = 1000
+	}
+	if config.Heartbeat.TimeoutMs == 0 {
+		config.Heartbeat.TimeoutMs = 10000
+	}
+	if config.Heartbeat.TimeoutMs <= config.Heartbeat.IntervalMs {
+		return config, errors.New("heartbeat.timeout_ms must be larger than heartbeat.interval_ms")
+	}
 
 	fmt.Printf("%+v\n", config)
 
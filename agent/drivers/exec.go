@@ -8,20 +8,28 @@ import (
 	"os/exec"
 	"errors"
 	"strings"
+	"strconv"
 	"sync"
+	"time"
 
 	"taylor/lib/structs"
 	"taylor/lib/util"
 )
 
+// time a process gets to shut down after it has been interrupted due to a timeout
+const TIMEOUT_KILL_GRACE = 10 * time.Second
+
 type ProcessWrapper struct {
 	process		*os.Process
 	interrupted	bool
+	timedOut	bool
 }
 
 type DriverContext struct {
 	pidMapMtx	*sync.Mutex
 	jobPidMap	map[string] *ProcessWrapper
+	// see TIMEOUT_KILL_GRACE
+	killGrace	time.Duration
 }
 
 func (c *DriverContext) HasProcess(jobId string) bool {
@@ -65,6 +73,34 @@ func (c *DriverContext) AddProcess(jobId string, process *os.Process) error {
 	return nil
 }
 
+// interrupts the process of a job that exceeded its timeout. if it doesn't stop within
+// killGrace, it gets killed
+func (c *DriverContext) TimeoutProcess(jobId string) {
+	c.pidMapMtx.Lock()
+	defer c.pidMapMtx.Unlock()
+
+	processWrapper, in := c.jobPidMap[jobId]
+	if in == false {
+		return
+	}
+	processWrapper.timedOut = true
+
+	fmt.Printf("Job %s timed out. Send interrupt\n", jobId)
+	if err := processWrapper.process.Signal(os.Interrupt); err != nil {
+		fmt.Fprintf(os.Stderr, "%v\n", err)
+	}
+
+	time.AfterFunc(c.killGrace, func () {
+		c.pidMapMtx.Lock()
+		defer c.pidMapMtx.Unlock()
+
+		if p, in := c.jobPidMap[jobId]; in && p == processWrapper {
+			fmt.Printf("Job %s didn't stop after timeout. Kill it\n", jobId)
+			p.process.Kill()
+		}
+	})
+}
+
 func cancel(job *structs.Job, driver *structs.Driver) error {
 	context, _ := driver.Ctx.(*DriverContext)
 
@@ -89,6 +125,22 @@ func cancel(job *structs.Job, driver *structs.Driver) error {
 	return nil
 }
 
+func kill(job *structs.Job, driver *structs.Driver) error {
+	context, _ := driver.Ctx.(*DriverContext)
+
+	context.pidMapMtx.Lock()
+	defer context.pidMapMtx.Unlock()
+
+	processWrapper, in := context.jobPidMap[job.Id]
+	if in == false {
+		return errors.New(fmt.Sprintf("Job with id not executing: %s", job.Id))
+	}
+
+	fmt.Printf("Kill job %s\n", job.Id)
+	processWrapper.interrupted = true
+	return processWrapper.process.Kill()
+}
+
 func run(job *structs.Job, driver *structs.Driver, onJobUpdate func (job *structs.Job, progress float32, message string)) (bool, error) {
 	context, _ := driver.Ctx.(*DriverContext)
 
@@ -133,6 +185,44 @@ func run(job *structs.Job, driver *structs.Driver, onJobUpdate func (job *struct
 		cmd.Env = append(cmd.Env, envVars...)
 	}
 
+	// pin the process to the gpus the scheduler chose for it
+	if len(job.GpuIndices) > 0 {
+		if cmd.Env == nil {
+			// nil means the process gets our environment. we must not lose it by adding variables
+			cmd.Env = os.Environ()
+		}
+		devices := make([]string, len(job.GpuIndices))
+		for i, k := range job.GpuIndices {
+			devices[i] = strconv.Itoa(k)
+		}
+		visible := strings.Join(devices, ",")
+		// the indices are the ones of nvidia-smi, which sorts by pci bus. cuda would put the fastest gpu first
+		cmd.Env = append(cmd.Env, "CUDA_DEVICE_ORDER=PCI_BUS_ID", "CUDA_VISIBLE_DEVICES=" + visible, "NVIDIA_VISIBLE_DEVICES=" + visible)
+	}
+
+	// members of a gang need to know who they are and where the others run
+	if job.IsGangMember() {
+		if cmd.Env == nil {
+			cmd.Env = os.Environ()
+		}
+		cmd.Env = append(cmd.Env,
+			"TAYLOR_GANG_ID=" + job.GangId,
+			"TAYLOR_GANG_RANK=" + strconv.Itoa(job.GangRank),
+			"TAYLOR_GANG_SIZE=" + strconv.Itoa(job.GangSize),
+			"TAYLOR_GANG_PEERS=" + strings.Join(job.GangPeers, ","),
+		)
+	}
+
+	if job.IsArrayChild() {
+		if cmd.Env == nil {
+			cmd.Env = os.Environ()
+		}
+		cmd.Env = append(cmd.Env,
+			"TAYLOR_ARRAY_ID=" + job.ArrayId,
+			"TAYLOR_ARRAY_INDEX=" + strconv.Itoa(job.ArrayIndex),
+		)
+	}
+
 	shellDir, err := util.GetString(driverConfig, "dir", "")
 	if err != nil {
 		return false, err
@@ -160,6 +250,14 @@ func run(job *structs.Job, driver *structs.Driver, onJobUpdate func (job *struct
 	context.AddProcess(job.Id, cmd.Process)
 	defer context.RemoveProcess(job.Id)
 
+	// enforce maximal runtime
+	if job.Timeout > 0 {
+		timer := time.AfterFunc(time.Duration(job.Timeout) * time.Second, func () {
+			context.TimeoutProcess(job.Id)
+		})
+		defer timer.Stop()
+	}
+
 	// read stderr in background and stdout in this thread
 	waitStderr := make(chan int, 0)
 	go func () {
@@ -177,6 +275,12 @@ func run(job *structs.Job, driver *structs.Driver, onJobUpdate func (job *struct
 
 	// wait for process
 	err = cmd.Wait()
+
+	// process might have exited cleanly on the interrupt, but it still ran too long
+	if processWrapper, in := context.GetProcess(job.Id); in && processWrapper.timedOut {
+		return false, structs.ErrJobTimeout
+	}
+
 	if err != nil {
 		fmt.Printf("cmd.Wait err %s\n", err.Error())
 		processWrapper, in := context.GetProcess(job.Id)
@@ -211,12 +315,14 @@ func NewExecDriver() *structs.Driver {
 	ctx := &DriverContext{
 		pidMapMtx:	&sync.Mutex{},
 		jobPidMap:	make(map[string]*ProcessWrapper),
+		killGrace:	TIMEOUT_KILL_GRACE,
 	}
 
 	return &structs.Driver{
 		Name:		"exec",
 		Run:		run,
 		Cancel:		cancel,
+		Kill:		kill,
 		Ctx:		ctx,
 	}
 }
@@ -0,0 +1,80 @@
+package drivers
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"taylor/lib/structs"
+)
+
+func shellJob(id string, script string, timeout int64) *structs.Job {
+	return &structs.Job{
+		Id:		id,
+		Driver:		"exec",
+		DriverConfig:	map[string]interface{}{"cmd": "sh", "args": []interface{}{"-c", script}},
+		Timeout:	timeout,
+	}
+}
+
+type runResult struct {
+	interrupted	bool
+	err		error
+	elapsed		time.Duration
+}
+
+func runJob(driver *structs.Driver, job *structs.Job) runResult {
+	start := time.Now()
+	interrupted, err := driver.Run(job, driver, func (job *structs.Job, progress float32, message string) {})
+	return runResult{interrupted, err, time.Since(start)}
+}
+
+func TestRunFinishesBeforeTimeout(t *testing.T) {
+	driver := NewExecDriver()
+	res := runJob(driver, shellJob("quick", "exit 0", 5))
+	if res.err != nil || res.interrupted {
+		t.Fatal("Job must succeed, got", res.err, res.interrupted)
+	}
+	res = runJob(driver, shellJob("failing", "exit 3", 5))
+	if res.err == nil || errors.Is(res.err, structs.ErrJobTimeout) {
+		t.Fatal("Job must fail with its exit code, got", res.err)
+	}
+	if driver.Ctx.(*DriverContext).HasProcess("quick") {
+		t.Fatal("Finished job must not keep its process")
+	}
+}
+
+func TestRunTimesOut(t *testing.T) {
+	driver := NewExecDriver()
+	// exec, so that the shell doesn't keep the pipes open after the interrupt
+	res := runJob(driver, shellJob("sleeping", "exec sleep 30", 1))
+	if errors.Is(res.err, structs.ErrJobTimeout) == false {
+		t.Fatal("Expected timeout, got", res.err)
+	}
+	if res.elapsed < time.Second || res.elapsed > 5 * time.Second {
+		t.Fatal("Job must be interrupted after its timeout, ran", res.elapsed)
+	}
+
+	// exiting cleanly on the interrupt still counts as timeout
+	res = runJob(driver, shellJob("trapping", "trap 'kill $!; exit 0' INT; sleep 30 >/dev/null 2>&1 & wait", 1))
+	if errors.Is(res.err, structs.ErrJobTimeout) == false {
+		t.Fatal("Expected timeout, got", res.err)
+	}
+}
+
+func TestTimeoutProcessKillsAfterGrace(t *testing.T) {
+	driver := NewExecDriver()
+	context := driver.Ctx.(*DriverContext)
+	context.killGrace = 500 * time.Millisecond
+
+	res := runJob(driver, shellJob("ignoring", "trap '' INT; exec sleep 30", 1))
+	if errors.Is(res.err, structs.ErrJobTimeout) == false {
+		t.Fatal("Expected timeout, got", res.err)
+	}
+	if res.elapsed < 1500 * time.Millisecond || res.elapsed > 10 * time.Second {
+		t.Fatal("Job ignoring the interrupt must be killed after the grace, ran", res.elapsed)
+	}
+
+	// unknown jobs are ignored
+	context.TimeoutProcess("unknown")
+}
@@ -0,0 +1,73 @@
+package agent
+
+import (
+	"os"
+	"bufio"
+	"strings"
+	"strconv"
+	"errors"
+
+	"taylor/lib/structs"
+)
+
+// number of cpus (processor entries in /proc/cpuinfo)
+func readCpuCores() (float64, error) {
+	file, err := os.Open("/proc/cpuinfo")
+	if err != nil {
+		return 0, err
+	}
+	defer file.Close()
+
+	cores := 0
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		if strings.HasPrefix(scanner.Text(), "processor") {
+			cores++
+		}
+	}
+	if cores == 0 {
+		return 0, errors.New("no processor found in /proc/cpuinfo")
+	}
+	return float64(cores), scanner.Err()
+}
+
+// MemTotal of /proc/meminfo in MB
+func readMemoryTotalMB() (int, error) {
+	file, err := os.Open("/proc/meminfo")
+	if err != nil {
+		return 0, err
+	}
+	defer file.Close()
+
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		// MemTotal:       16314812 kB
+		fields := strings.Fields(scanner.Text())
+		if len(fields) < 2 || fields[0] != "MemTotal:" {
+			continue
+		}
+		kb, err := strconv.Atoi(fields[1])
+		if err != nil {
+			return 0, err
+		}
+		return kb / 1024, nil
+	}
+	return 0, errors.New("no MemTotal found in /proc/meminfo")
+}
+
+func readResources() (structs.ResourceInfo, error) {
+	var info structs.ResourceInfo
+
+	cpu, err := readCpuCores()
+	if err != nil {
+		return info, err
+	}
+	mem, err := readMemoryTotalMB()
+	if err != nil {
+		return info, err
+	}
+
+	info.CpuTotal = cpu
+	info.MemoryTotalMB = mem
+	return info, nil
+}
@@ -0,0 +1,18 @@
+//go:build !linux
+// +build !linux
+
+package agent
+
+import (
+	"runtime"
+
+	"taylor/lib/structs"
+)
+
+// we only know how to read the memory on linux. agents that report no memory
+// don't get jobs with memory requirements
+func readResources() (structs.ResourceInfo, error) {
+	return structs.ResourceInfo{
+		CpuTotal: float64(runtime.NumCPU()),
+	}, nil
+}
@@ -1,10 +1,19 @@
 package structs
 
+import (
+	"errors"
+)
+
+// returned by Driver.Run when the job has been stopped because it exceeded its timeout
+var ErrJobTimeout = errors.New("Job exceeded its timeout")
+
 type Driver struct {
 	Name		string			`json:"name"`
 
 	// not exported via json
 	Run		func (job *Job, driver *Driver, onJobUpdate func (job *Job, progress float32, message string)) (bool, error)
 	Cancel		func (job *Job, driver *Driver) error
+	// stops the job immediately. used when a cancelled job doesn't stop in time
+	Kill		func (job *Job, driver *Driver) error
 	Ctx		interface{}	
 }
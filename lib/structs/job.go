@@ -5,6 +5,21 @@ import (
 	"time"
 )
 
+// kinds of failures after which a job can be retried
+const (
+	// agent that executed the job disconnected
+	RETRY_ON_NODE_LOST	= "node_lost"
+
+	// job finished with an error (e.g. non-zero exit code)
+	RETRY_ON_EXIT_ERROR	= "exit_error"
+
+	// agent rejected the job offer
+	RETRY_ON_REJECTED	= "rejected"
+
+	// job exceeded its maximal runtime
+	RETRY_ON_TIMEOUT	= "timeout"
+)
+
 type JobStatus int
 
 const (
@@ -28,6 +43,9 @@ const (
 
 	// job has been deleted
 	JOB_STATUS_DELETE
+
+	// job exceeded its maximal runtime
+	JOB_STATUS_TIMEOUT
 )
 
 type UpdateHandler struct {
@@ -41,6 +59,58 @@ type GpuRequirement struct {
 	MemoryAvailable int			`json:"memory_available"`
 }
 
+// where a job may (or should) run besides its restrict tags
+type Affinity struct {
+	// job may only run on one of these nodes. empty means any node
+	Nodes		[]string		`json:"nodes"`
+	// job must not run on these nodes
+	AvoidNodes	[]string		`json:"avoid_nodes"`
+	// job must not run on a node where a job with one of these identifiers runs
+	AntiAffinity	[]string		`json:"anti_affinity"`
+	// nodes with more of these capability tags are preferred. doesn't rule out any node
+	Prefer		[]string		`json:"prefer"`
+}
+
+type RetryPolicy struct {
+	// total number of attempts (including the first one). 0 means no retries
+	MaxAttempts	int			`json:"max_attempts"`
+	BackoffMs	int64			`json:"backoff_ms"`
+	BackoffFactor	float64			`json:"backoff_factor"`
+	MaxBackoffMs	int64			`json:"max_backoff_ms"`
+	RetryOn		[]string		`json:"retry_on"`
+}
+
+type JobAttempt struct {
+	Attempt		int			`json:"attempt"`
+	AgentName	string			`json:"agent_name"`
+	StartedAt	int64			`json:"started_at"`
+	EndedAt		int64			`json:"ended_at"`
+	Status		JobStatus		`json:"status"`
+	Reason		string			`json:"reason"`
+	GpuIndices	[]int			`json:"gpu_indices"`
+}
+
+func (p RetryPolicy) RetriesOn(failure string) bool {
+	for _, kind := range p.RetryOn {
+		if kind == failure {
+			return true
+		}
+	}
+	return false
+}
+
+// time to wait before the given attempt (starting with 1 for the first retry)
+func (p RetryPolicy) Backoff(attempt int) time.Duration {
+	backoff := float64(p.BackoffMs)
+	for i := 1; i < attempt && (p.MaxBackoffMs == 0 || backoff < float64(p.MaxBackoffMs)); i++ {
+		backoff *= p.BackoffFactor
+	}
+	if p.MaxBackoffMs > 0 && backoff > float64(p.MaxBackoffMs) {
+		backoff = float64(p.MaxBackoffMs)
+	}
+	return time.Duration(backoff) * time.Millisecond
+}
+
 type Job struct {
 	Id		string			`json:"id"`
 	Identifier	string			`json:"identifier"`
@@ -55,6 +125,46 @@ type Job struct {
 	Priority	uint			`json:"priority"`
 	Progress	float32			`json:"progress"`
 	UserData	map[string]interface{}  `json:"user_data"`
+	DependsOn	[]string		`json:"depends_on"`
+	Retry		RetryPolicy		`json:"retry"`
+	Attempts	[]JobAttempt		`json:"attempts"`
+	RetryAt		int64			`json:"retry_at"`
+	// maximal runtime in seconds. 0 means no limit
+	Timeout		int64			`json:"timeout"`
+	// schedule that created the job
+	ScheduleId	string			`json:"schedule_id"`
+	// job must not be scheduled before (in ms). 0 means immediately
+	RunAt		int64			`json:"run_at"`
+	// placement strategy for this job. empty means the one of the server config
+	Placement	string			`json:"placement"`
+	Resources	ResourceRequirement	`json:"resources"`
+	// gpus of the agent the job is pinned to (one per gpu requirement)
+	GpuIndices	[]int			`json:"gpu_indices"`
+	// job may be stopped and requeued to make room for jobs with higher priority
+	Preemptible	bool			`json:"preemptible"`
+	// team or user the job belongs to. used for fair-share scheduling
+	Tenant		string			`json:"tenant"`
+	// jobs with the same key share a concurrency limit (1 unless configured otherwise)
+	ConcurrencyKey	string			`json:"concurrency_key"`
+	// members of a gang are started together on distinct agents (or not at all). empty if not part of one
+	GangId		string			`json:"gang_id"`
+	GangRank	int			`json:"gang_rank"`
+	GangSize	int			`json:"gang_size"`
+	// addresses of the agents of all gang members (by rank). only set in offers
+	GangPeers	[]string		`json:"gang_peers,omitempty"`
+	Affinity	Affinity		`json:"affinity"`
+	// expression on the labels of the node (e.g. "zone in (a, b), cuda >= 11")
+	Selector	string			`json:"selector"`
+	// job array the job is a child of. empty if not part of one
+	ArrayId		string			`json:"array_id"`
+	// position in the array, counted over all repetitions and combinations of the matrix
+	ArrayIndex	int			`json:"array_index"`
+	// values of the parameter matrix this child has been created with
+	ArrayParams	map[string]string	`json:"array_params"`
+	// why a waiting job isn't scheduled yet. not persisted, filled in by the api
+	BlockedReason	string			`json:"blocked_reason,omitempty"`
+	// priority after aging (see scheduler.aging). not persisted
+	EffectivePriority uint			`json:"effective_priority"`
 }
 
 func (job *Job) CanCancel() bool {
@@ -65,6 +175,57 @@ func (job *Job) CanDelete() bool {
 	return job.Status != JOB_STATUS_SCHEDULED && job.Status != JOB_STATUS_DELETE
 }
 
+// attempts that count against the retry policy. preempted attempts don't
+func (job *Job) RetryAttempts() int {
+	n := 0
+	for _, attempt := range job.Attempts {
+		if attempt.Status != JOB_STATUS_INTERRUPT {
+			n++
+		}
+	}
+	return n
+}
+
+// job has a retry policy for failure and attempts left
+func (job *Job) ShouldRetry(failure string) bool {
+	return job.RetryAttempts() < job.Retry.MaxAttempts && job.Retry.RetriesOn(failure)
+}
+
+// job is allowed to be scheduled at the given time (in ms)
+func (job *Job) IsDue(nowMs int64) bool {
+	return job.RunAt <= nowMs && job.RetryAt <= nowMs
+}
+
+// time (in ms) at which the job entered the queue. delays and backoffs don't count as waiting
+func (job *Job) QueuedSince() int64 {
+	since := job.Timestamp
+	if job.RunAt > since {
+		since = job.RunAt
+	}
+	if job.RetryAt > since {
+		since = job.RetryAt
+	}
+	return since
+}
+
+// job waits for its run_at or retry backoff
+func (job *Job) IsDelayed(nowMs int64) bool {
+	return job.Status == JOB_STATUS_WAITING && job.IsDue(nowMs) == false
+}
+
+func (job *Job) IsGangMember() bool {
+	return job.GangId != ""
+}
+
+func (job *Job) IsArrayChild() bool {
+	return job.ArrayId != ""
+}
+
+// job won't change its status anymore (except for being deleted)
+func (job *Job) IsFinished() bool {
+	return job.Status != JOB_STATUS_WAITING && job.Status != JOB_STATUS_SCHEDULED
+}
+
 func NewJob(
 	id string,
 	driver string,
@@ -74,13 +235,16 @@ func NewJob(
 	priority uint,
 	gpuReq []GpuRequirement,
 	ud	map[string]interface{},
+	dependsOn []string,
+	retry	RetryPolicy,
+	timeout int64,
 ) *Job {
 	// to-do: validate updatehandlers
 	return &Job{
 		Id:		uuid.New().String(),
 		Identifier:	id,
 		Status:		JOB_STATUS_WAITING,
-		Timestamp:	time.Now().UnixNano() / 1000000,
+		Timestamp:	NowMs(),
 		AgentName:	"",
 		Driver:		driver,
 		DriverConfig:	driverConfig,
@@ -90,5 +254,32 @@ func NewJob(
 		Progress:	0.0,
 		Priority:	priority,
 		UserData:	ud,
+		DependsOn:	dependsOn,
+		Retry:		retry,
+		Attempts:	make([]JobAttempt, 0),
+		RetryAt:	0,
+		Timeout:	timeout,
+		GpuIndices:	make([]int, 0),
+		ArrayParams:	make(map[string]string),
 	}
 }
+
+// creates a new waiting job with the same definition (e.g. when job is used as template)
+func (job *Job) NewInstance() *Job {
+	instance := *job
+	instance.Id = uuid.New().String()
+	instance.Status = JOB_STATUS_WAITING
+	instance.Timestamp = NowMs()
+	instance.AgentName = ""
+	instance.Progress = 0.0
+	instance.Attempts = make([]JobAttempt, 0)
+	instance.RetryAt = 0
+	// a fixed start time doesn't make sense for a new instance
+	instance.RunAt = 0
+	instance.GpuIndices = make([]int, 0)
+	return &instance
+}
+
+func NowMs() int64 {
+	return time.Now().UnixNano() / 1000000
+}
@@ -0,0 +1,85 @@
+package structs
+
+import (
+	"testing"
+	"time"
+)
+
+func TestBackoff(t *testing.T) {
+	policy := RetryPolicy{BackoffMs: 1000, BackoffFactor: 2, MaxBackoffMs: 5000}
+	for attempt, expected := range map[int]time.Duration{
+		1:	1 * time.Second,
+		2:	2 * time.Second,
+		3:	4 * time.Second,
+		4:	5 * time.Second,
+		100:	5 * time.Second,
+	} {
+		if backoff := policy.Backoff(attempt); backoff != expected {
+			t.Fatal("Backoff of attempt", attempt, "is", backoff, "expected", expected)
+		}
+	}
+
+	// the cap applies to the first backoff as well
+	policy = RetryPolicy{BackoffMs: 8000, BackoffFactor: 2, MaxBackoffMs: 5000}
+	if backoff := policy.Backoff(1); backoff != 5 * time.Second {
+		t.Fatal("Backoff must be capped, is", backoff)
+	}
+	// without a cap it keeps growing
+	policy = RetryPolicy{BackoffMs: 1000, BackoffFactor: 1.5}
+	if backoff := policy.Backoff(3); backoff != 2250 * time.Millisecond {
+		t.Fatal("Backoff without cap is", backoff)
+	}
+}
+
+func TestShouldRetry(t *testing.T) {
+	job := &Job{Retry: RetryPolicy{MaxAttempts: 3, RetryOn: []string{RETRY_ON_EXIT_ERROR}}}
+	if job.ShouldRetry(RETRY_ON_EXIT_ERROR) == false {
+		t.Fatal("Job without attempts must be retried")
+	}
+	if job.ShouldRetry(RETRY_ON_NODE_LOST) {
+		t.Fatal("Job must only be retried on the failures of its policy")
+	}
+
+	// preempted and evicted attempts don't count
+	job.Attempts = []JobAttempt{
+		JobAttempt{Status: JOB_STATUS_ERROR},
+		JobAttempt{Status: JOB_STATUS_INTERRUPT},
+		JobAttempt{Status: JOB_STATUS_INTERRUPT},
+		JobAttempt{Status: JOB_STATUS_ERROR},
+	}
+	if n := job.RetryAttempts(); n != 2 {
+		t.Fatal("Expected 2 retry attempts, got", n)
+	}
+	if job.ShouldRetry(RETRY_ON_EXIT_ERROR) == false {
+		t.Fatal("Job with attempts left must be retried")
+	}
+	job.Attempts = append(job.Attempts, JobAttempt{Status: JOB_STATUS_TIMEOUT})
+	if job.ShouldRetry(RETRY_ON_EXIT_ERROR) {
+		t.Fatal("Job without attempts left must not be retried")
+	}
+}
+
+func TestIsDue(t *testing.T) {
+	job := &Job{Status: JOB_STATUS_WAITING, RunAt: 1000}
+	if job.IsDue(999) || job.IsDelayed(999) == false {
+		t.Fatal("Job must wait for its run_at")
+	}
+	if job.IsDue(1000) == false || job.IsDelayed(1000) {
+		t.Fatal("Job must be due at its run_at")
+	}
+
+	// a backoff after the run_at holds it back again
+	job.RetryAt = 2000
+	if job.IsDue(1500) || job.IsDelayed(1500) == false {
+		t.Fatal("Job must wait for its backoff")
+	}
+	if job.IsDue(2000) == false {
+		t.Fatal("Job must be due after its backoff")
+	}
+
+	// only waiting jobs can be delayed
+	job.Status = JOB_STATUS_SCHEDULED
+	if job.IsDelayed(1500) {
+		t.Fatal("Scheduled job must not be delayed")
+	}
+}
@@ -0,0 +1,45 @@
+package structs
+
+// cpu and memory of an agent. allocatable is what is left for new jobs
+type ResourceInfo struct {
+	CpuTotal		float64	`json:"cpu_total"`
+	CpuAllocatable		float64	`json:"cpu_allocatable"`
+	MemoryTotalMB		int	`json:"memory_total_mb"`
+	MemoryAllocatableMB	int	`json:"memory_allocatable_mb"`
+}
+
+// cpu cores and memory a job needs. 0 means the job doesn't care
+type ResourceRequirement struct {
+	Cpu		float64	`json:"cpu"`
+	MemoryMB	int	`json:"memory_mb"`
+}
+
+func (r ResourceRequirement) Add(other ResourceRequirement) ResourceRequirement {
+	return ResourceRequirement{
+		Cpu:		r.Cpu + other.Cpu,
+		MemoryMB:	r.MemoryMB + other.MemoryMB,
+	}
+}
+
+func (r ResourceRequirement) Sub(other ResourceRequirement) ResourceRequirement {
+	return ResourceRequirement{
+		Cpu:		r.Cpu - other.Cpu,
+		MemoryMB:	r.MemoryMB - other.MemoryMB,
+	}
+}
+
+func (info ResourceInfo) Fulfills(req ResourceRequirement) bool {
+	return info.CpuAllocatable >= req.Cpu && info.MemoryAllocatableMB >= req.MemoryMB
+}
+
+// gives req back to the allocatable resources
+func (info *ResourceInfo) Release(req ResourceRequirement) {
+	info.CpuAllocatable += req.Cpu
+	info.MemoryAllocatableMB += req.MemoryMB
+}
+
+// takes req away from the allocatable resources
+func (info *ResourceInfo) Allocate(req ResourceRequirement) {
+	info.CpuAllocatable -= req.Cpu
+	info.MemoryAllocatableMB -= req.MemoryMB
+}
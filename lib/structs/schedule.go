@@ -0,0 +1,30 @@
+package structs
+
+// what happens when a schedule fires while the job of its last run is still waiting or running
+const (
+	// don't create a new job
+	OVERLAP_SKIP	= "skip"
+
+	// create the new job after the last one finished
+	OVERLAP_QUEUE	= "queue"
+
+	// cancel the last job and create a new one
+	OVERLAP_CANCEL	= "cancel"
+)
+
+type Schedule struct {
+	Id		string		`json:"id"`
+	Name		string		`json:"name"`
+	Cron		string		`json:"cron"`
+	Timezone	string		`json:"timezone"`
+	OverlapPolicy	string		`json:"overlap_policy"`
+	Enabled		bool		`json:"enabled"`
+	// template for the jobs that are created
+	Job		Job		`json:"job"`
+	Timestamp	int64		`json:"timestamp"`
+	NextRunAt	int64		`json:"next_run_at"`
+	LastRunAt	int64		`json:"last_run_at"`
+	LastJobId	string		`json:"last_job_id"`
+	// runs that wait for the last job to finish (only overlap policy queue)
+	Queued		int		`json:"queued"`
+}
@@ -25,6 +25,8 @@ const (
 
 	MSG_AGENT_INFO_REQUEST
 	MSG_AGENT_INFO_RESPONSE
+
+	MSG_SERVER_SHUTDOWN
 )
 
 type MsgBase struct {
@@ -36,13 +38,19 @@ type MsgAgentInfo struct {
 	JobsRunning	uint		  `json:"jobs_running"`
 	Capacity	uint		  `json:"capacity"`
 	Capabilities	[]string	  `json:"capabilities"`
+	Labels		map[string]string `json:"labels"`
 	GpuInfo		[]structs.GpuInfo `json:"gpu_info"`
+	Resources	structs.ResourceInfo `json:"resources"`
+	// indices of gpus that are pinned to running jobs
+	GpusReserved	[]int		  `json:"gpus_reserved"`
 }
 
 type MsgHandshakeInitial struct {
 	MsgBase
 	MsgAgentInfo
 	NodeType	string		  `json:"node_type"`
+	// ids of the jobs the agent still runs or has results for that it couldn't deliver yet
+	Jobs		[]string	  `json:"jobs"`
 }
 
 type MsgHandshakeResponse struct {
@@ -60,6 +68,11 @@ type MsgAgentInfoResponse struct {
 	MsgAgentInfo
 }
 
+// the server goes away. agents keep their jobs and reconnect
+type MsgServerShutdown struct {
+	MsgBase
+}
+
 type MsgNewJobOffer struct {
 	MsgBase
 	Job		structs.Job	`json:"job"`
@@ -92,6 +105,8 @@ type MsgJobUpdate struct {
 type MsgJobCancelRequest struct {
 	MsgBase
 	Job		structs.Job	`json:"job"`
+	// time the job gets to stop before it is killed. 0 means it won't be killed
+	GraceMs		int64		`json:"grace_ms"`
 }
 
 func Encode(message interface{}) (string, error) {
@@ -150,6 +165,10 @@ func Decode(message string) (interface{}, MsgCmd, error) {
 		var r MsgAgentInfoResponse
 		err = json.Unmarshal(hsJson, &r)
 		return r, r.Command, err
+	case MSG_SERVER_SHUTDOWN:
+		var r MsgServerShutdown
+		err = json.Unmarshal(hsJson, &r)
+		return r, r.Command, err
 	default:
 		return nil, 0, errors.New(fmt.Sprintf("Invalid command received: %d", base.Command))
 	}
@@ -3,12 +3,25 @@ package tcp
 import (
 	"bufio"
 	"net"
+	"sync"
+	"time"
 )
 
 type Conn struct {
 	reader	*bufio.Reader
 	writer	*bufio.Writer
 	conn	net.Conn
+	// messages of different goroutines must not interleave
+	writeMtx	*sync.Mutex
+	// reads fail if the other side hasn't sent anything for this long. 0 means no timeout
+	readTimeout	time.Duration
+	// writes fail if they block for this long (e.g. on a half-open connection). 0 means no timeout
+	writeTimeout	time.Duration
+}
+
+func (t *Conn) SetTimeouts(read time.Duration, write time.Duration) {
+	t.readTimeout = read
+	t.writeTimeout = write
 }
 
 func (t *Conn) Close() {
@@ -24,6 +37,12 @@ func (t *Conn) String () string {
 }
 
 func (t *Conn) writeString(message string) error {
+	t.writeMtx.Lock()
+	defer t.writeMtx.Unlock()
+
+	if t.writeTimeout > 0 {
+		t.conn.SetWriteDeadline(time.Now().Add(t.writeTimeout))
+	}
 	_, err := t.writer.WriteString(message)
 	if err != nil {
 		return err
@@ -32,6 +51,9 @@ func (t *Conn) writeString(message string) error {
 }
 
 func (t *Conn) readString(delim byte) (string, error) {
+	if t.readTimeout > 0 {
+		t.conn.SetReadDeadline(time.Now().Add(t.readTimeout))
+	}
 	return t.reader.ReadString(delim)
 }
 
@@ -61,6 +83,7 @@ func NewConn(c net.Conn) *Conn {
 		reader:	bufio.NewReader(c),
 		writer:	bufio.NewWriter(c),
 		conn:	c,
+		writeMtx:	&sync.Mutex{},
 	}
 }
 
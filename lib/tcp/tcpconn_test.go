@@ -0,0 +1,61 @@
+package tcp
+
+import (
+	"net"
+	"testing"
+	"time"
+)
+
+func agentInfoResponse() MsgAgentInfoResponse {
+	return MsgAgentInfoResponse{
+		MsgBase: MsgBase{Command: MSG_AGENT_INFO_RESPONSE, NodeName: "agent"},
+		MsgAgentInfo: MsgAgentInfo{Capacity: 1},
+	}
+}
+
+func TestReadTimeout(t *testing.T) {
+	local, remote := net.Pipe()
+	defer local.Close()
+	defer remote.Close()
+
+	timeout := 200 * time.Millisecond
+	conn := NewConn(local)
+	conn.SetTimeouts(timeout, timeout)
+	peer := NewConn(remote)
+
+	// a peer that keeps sending its agent info keeps the connection alive for longer than the timeout
+	go func() {
+		for i := 0; i < 8; i++ {
+			time.Sleep(timeout / 4)
+			if err := peer.WriteMessage(agentInfoResponse()); err != nil {
+				return
+			}
+		}
+	}()
+	start := time.Now()
+	for i := 0; i < 8; i++ {
+		_, cmd, err := conn.ReadMessage()
+		if err != nil {
+			t.Fatal("Read failed while the peer sends:", err)
+		}
+		if cmd != MSG_AGENT_INFO_RESPONSE {
+			t.Fatal("Unexpected command", cmd)
+		}
+	}
+	if time.Since(start) < timeout {
+		t.Fatal("Peer must have been sending for longer than the timeout")
+	}
+
+	// a silent peer makes reading fail once the timeout passed
+	start = time.Now()
+	_, _, err := conn.ReadMessage()
+	if err == nil {
+		t.Fatal("Read must fail when the peer is silent")
+	}
+	if netErr, ok := err.(net.Error); ok == false || netErr.Timeout() == false {
+		t.Fatal("Expected timeout, got", err)
+	}
+	if elapsed := time.Since(start); elapsed < timeout || elapsed > 10 * timeout {
+		t.Fatal("Read failed after", elapsed, "timeout is", timeout)
+	}
+}
@@ -0,0 +1,158 @@
+package util
+
+import (
+	"errors"
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// selectors are comma separated requirements on the labels of a node. all of them must hold:
+//
+//	zone = a, zone != b, zone in (a, b), zone notin (c), gpu exists, cuda >= 11, cores < 64
+//
+// != and notin also match nodes without the label. numeric comparisons need both the label
+// and the value to be numbers
+type Selector []selectorRequirement
+
+type selectorRequirement struct {
+	key	string
+	op	string
+	values	[]string
+	number	float64
+}
+
+const selectorKey = `([A-Za-z0-9_./-]+)`
+
+var (
+	selectorCompare = regexp.MustCompile(`^` + selectorKey + `\s*(==|!=|>=|<=|=|>|<)\s*([^\s,()]+)$`)
+	selectorSet = regexp.MustCompile(`^` + selectorKey + `\s+(in|notin)\s*\(([^()]*)\)$`)
+	selectorExists = regexp.MustCompile(`^` + selectorKey + `\s+exists$`)
+)
+
+// splits at commas that are not in parentheses
+func splitRequirements(expr string) ([]string, error) {
+	parts := make([]string, 0)
+	depth := 0
+	start := 0
+	for idx, r := range expr {
+		switch (r) {
+		case '(':
+			depth++
+		case ')':
+			depth--
+			if depth < 0 {
+				return nil, errors.New("Invalid selector. Unbalanced parentheses")
+			}
+		case ',':
+			if depth == 0 {
+				parts = append(parts, expr[start:idx])
+				start = idx + 1
+			}
+		}
+	}
+	if depth != 0 {
+		return nil, errors.New("Invalid selector. Unbalanced parentheses")
+	}
+	return append(parts, expr[start:]), nil
+}
+
+func parseRequirement(part string) (selectorRequirement, error) {
+	if m := selectorCompare.FindStringSubmatch(part); m != nil {
+		req := selectorRequirement{key: m[1], op: m[2], values: []string{m[3]}}
+		if req.op == "==" {
+			req.op = "="
+		}
+		switch (req.op) {
+		case ">", ">=", "<", "<=":
+			number, err := strconv.ParseFloat(m[3], 64)
+			if err != nil {
+				return req, errors.New(fmt.Sprintf("Invalid selector. %s needs a number in '%s'", req.op, part))
+			}
+			req.number = number
+		}
+		return req, nil
+	}
+	if m := selectorSet.FindStringSubmatch(part); m != nil {
+		values := make([]string, 0)
+		for _, value := range strings.Split(m[3], ",") {
+			if value = strings.TrimSpace(value); value != "" {
+				values = append(values, value)
+			}
+		}
+		if len(values) == 0 {
+			return selectorRequirement{}, errors.New(fmt.Sprintf("Invalid selector. Empty set in '%s'", part))
+		}
+		return selectorRequirement{key: m[1], op: m[2], values: values}, nil
+	}
+	if m := selectorExists.FindStringSubmatch(part); m != nil {
+		return selectorRequirement{key: m[1], op: "exists"}, nil
+	}
+	return selectorRequirement{}, errors.New(fmt.Sprintf("Invalid selector. Can't parse '%s'", part))
+}
+
+// an empty expression selects every node
+func ParseSelector(expr string) (Selector, error) {
+	selector := make(Selector, 0)
+	if strings.TrimSpace(expr) == "" {
+		return selector, nil
+	}
+
+	parts, err := splitRequirements(expr)
+	if err != nil {
+		return nil, err
+	}
+	for _, part := range parts {
+		req, err := parseRequirement(strings.TrimSpace(part))
+		if err != nil {
+			return nil, err
+		}
+		selector = append(selector, req)
+	}
+	return selector, nil
+}
+
+func (req selectorRequirement) matches(labels map[string]string) bool {
+	label, in := labels[req.key]
+	switch (req.op) {
+	case "exists":
+		return in
+	case "=":
+		return in && label == req.values[0]
+	case "!=":
+		return in == false || label != req.values[0]
+	case "in":
+		return in && ContainsString(req.values, label)
+	case "notin":
+		return in == false || ContainsString(req.values, label) == false
+	}
+
+	if in == false {
+		return false
+	}
+	number, err := strconv.ParseFloat(label, 64)
+	if err != nil {
+		return false
+	}
+	switch (req.op) {
+	case ">":
+		return number > req.number
+	case ">=":
+		return number >= req.number
+	case "<":
+		return number < req.number
+	case "<=":
+		return number <= req.number
+	}
+	return false
+}
+
+func (selector Selector) Matches(labels map[string]string) bool {
+	for _, req := range selector {
+		if req.matches(labels) == false {
+			return false
+		}
+	}
+	return true
+}
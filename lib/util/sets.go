@@ -18,3 +18,12 @@ func IsSubsetString(set1 []string, set2 []string) bool {
 	// Attention: inverse
 	return !nope
 }
+
+func ContainsString(set []string, s string) bool {
+	for _, element := range set {
+		if element == s {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,96 @@
+package server
+
+import (
+	"taylor/lib/structs"
+	"taylor/lib/util"
+)
+
+// node is one the job may run on by name (pinned or avoided nodes)
+func nodeAllowed(node *Node, job *structs.Job) bool {
+	if len(job.Affinity.Nodes) > 0 && util.ContainsString(job.Affinity.Nodes, node.Name) == false {
+		return false
+	}
+	return util.ContainsString(job.Affinity.AvoidNodes, node.Name) == false
+}
+
+// a job the job doesn't want to share the node with runs on it
+func antiAffinityConflict(node *Node, job *structs.Job) bool {
+	for _, identifier := range job.Affinity.AntiAffinity {
+		if util.ContainsString(node.Identifiers, identifier) {
+			return true
+		}
+	}
+	return false
+}
+
+// hard constraints of the affinity
+func fulfillsAffinity(node *Node, job *structs.Job) bool {
+	return nodeAllowed(node, job) && antiAffinityConflict(node, job) == false
+}
+
+func nodesFulfillingAffinity(job *structs.Job, nodes []*Node) []*Node {
+	res := make([]*Node, 0, len(nodes))
+	for _, node := range nodes {
+		if fulfillsAffinity(node, job) {
+			res = append(res, node)
+		}
+	}
+	return res
+}
+
+// soft constraints. keeps the nodes with the most preferred tags. if no node has any, all of them
+func preferredNodes(job *structs.Job, nodes []*Node) []*Node {
+	if len(job.Affinity.Prefer) == 0 {
+		return nodes
+	}
+	matches := func (node *Node) int {
+		n := 0
+		for _, tag := range job.Affinity.Prefer {
+			if util.ContainsString(node.Capabilities, tag) {
+				n++
+			}
+		}
+		return n
+	}
+
+	best := 0
+	for _, node := range nodes {
+		if m := matches(node); m > best {
+			best = m
+		}
+	}
+	if best == 0 {
+		return nodes
+	}
+
+	res := make([]*Node, 0, len(nodes))
+	for _, node := range nodes {
+		if matches(node) == best {
+			res = append(res, node)
+		}
+	}
+	return res
+}
+
+// tells the nodes which jobs run on them so that anti-affinity can be checked. nodes get modified
+func addRunningIdentifiers(nodes []*Node, running []*structs.Job) {
+	byName := make(map[string]*Node, len(nodes))
+	for _, node := range nodes {
+		byName[node.Name] = node
+	}
+	for _, job := range running {
+		if node, in := byName[job.AgentName]; in {
+			node.Identifiers = append(node.Identifiers, job.Identifier)
+		}
+	}
+}
+
+// forgets one job with identifier on node
+func removeIdentifier(node *Node, identifier string) {
+	for idx, other := range node.Identifiers {
+		if other == identifier {
+			node.Identifiers = append(node.Identifiers[:idx], node.Identifiers[idx+1:]...)
+			return
+		}
+	}
+}
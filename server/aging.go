@@ -0,0 +1,48 @@
+package server
+
+import (
+	"sort"
+
+	"taylor/lib/structs"
+)
+
+// priority of a waiting job at nowMs. it grows by step for every interval the job waits
+func effectivePriority(job *structs.Job, nowMs int64, cfg AgingConfig) uint {
+	if cfg.Enabled == false || cfg.IntervalMs <= 0 || job.Status != structs.JOB_STATUS_WAITING {
+		return job.Priority
+	}
+	waited := nowMs - job.QueuedSince()
+	if waited <= 0 {
+		return job.Priority
+	}
+	// config durations are in ms
+	boost := uint(waited / int64(cfg.IntervalMs)) * cfg.Step
+	if cfg.MaxBoost > 0 && boost > cfg.MaxBoost {
+		boost = cfg.MaxBoost
+	}
+	return job.Priority + boost
+}
+
+func applyAging(jobs []*structs.Job, nowMs int64, cfg AgingConfig) {
+	for _, job := range jobs {
+		job.EffectivePriority = effectivePriority(job, nowMs, cfg)
+	}
+}
+
+// the priority the scheduler orders by. jobs that didn't go through aging have their static one
+func priorityOf(job *structs.Job) uint {
+	if job.EffectivePriority > job.Priority {
+		return job.EffectivePriority
+	}
+	return job.Priority
+}
+
+// highest priority first. of those, the one that waits longest
+func sortJobsByPriority(jobs []*structs.Job) {
+	sort.SliceStable(jobs[:], func (i int, j int) bool {
+		if priorityOf(jobs[i]) != priorityOf(jobs[j]) {
+			return priorityOf(jobs[i]) > priorityOf(jobs[j])
+		}
+		return jobs[i].QueuedSince() < jobs[j].QueuedSince()
+	})
+}
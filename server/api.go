@@ -6,10 +6,14 @@ import (
 	"strconv"
 	"os"
 	"errors"
+	"time"
+	"sort"
 
 	"taylor/server/database"
 	"taylor/lib/structs"
+	"taylor/lib/util"
 	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
 )
 
 type ErrorResponse struct {
@@ -31,12 +35,35 @@ type JobDefinition struct {
 	Priority	int			  `json:"priority"`
 	GpuReq		[]structs.GpuRequirement  `json:"gpu_requirement"`
 	UserData	map[string]interface{}    `json:"user_data"`
+	DependsOn	[]string		  `json:"depends_on"`
+	Retry		*structs.RetryPolicy	  `json:"retry"`
+	Timeout		int64			  `json:"timeout"`
+	// RFC3339 timestamp before which the job isn't scheduled
+	RunAt		string			  `json:"run_at"`
+	// in seconds from now, instead of run_at. 0 means the job can run right away
+	Delay		int64			  `json:"delay"`
+	// overrides the placement strategy of the server
+	Placement	string			  `json:"placement"`
+	Resources	structs.ResourceRequirement `json:"resources"`
+	Preemptible	bool			  `json:"preemptible"`
+	Tenant		string			  `json:"tenant"`
+	// jobs with the same key are limited in how many run at once (see scheduler.quotas)
+	ConcurrencyKey	string			  `json:"concurrency_key"`
+	// number of members that have to run together on distinct agents. 0 means no gang
+	GangSize	int			  `json:"gang_size"`
+	Affinity	structs.Affinity	  `json:"affinity"`
+	// expression on the labels of the agents
+	Selector	string			  `json:"selector"`
 }
 
 type ApiDependencies struct {
-	Store	  *database.Store
+	Store	  database.JobStore
 	TcpServer *TcpServer
+	Scheduler *Scheduler
 	DiskLog	  *DiskLog
+	Trigger	  *Trigger
+	// nil if the server doesn't run in a cluster
+	Ha	  *HaNode
 }
 
 func sendError(c *gin.Context, code int, err error) {
@@ -45,16 +72,10 @@ func sendError(c *gin.Context, code int, err error) {
 	})
 }
 
-func postJob(deps ApiDependencies, c *gin.Context) {
-	var jobDef JobDefinition
-	if err := c.ShouldBindJSON(&jobDef); err != nil {
-		sendError(c, http.StatusBadRequest, errors.New("Couldn't parse Job Definition"))
-		return
-	}
-
+// validates a job definition and creates a new job from it. returns the http status code on error
+func jobFromDefinition(deps ApiDependencies, jobDef JobDefinition) (*structs.Job, int, error) {
 	if jobDef.Identifier == "" || jobDef.Driver == "" || len(jobDef.DriverConfig) == 0 {
-		sendError(c, http.StatusBadRequest, errors.New("Invalid Job Definition. Identifier, Driver and DirverConfig must not be empty"))
-		return
+		return nil, http.StatusBadRequest, errors.New("Invalid Job Definition. Identifier, Driver and DirverConfig must not be empty")
 	}
 
 	if jobDef.Restrict == nil {
@@ -80,6 +101,52 @@ func postJob(deps ApiDependencies, c *gin.Context) {
 		jobDef.GpuReq = make([]structs.GpuRequirement, 0)
 	}
 
+	dependsOn, code, err := validateDependencies(deps, jobDef.DependsOn)
+	if err != nil {
+		return nil, code, err
+	}
+
+	retry, err := validateRetryPolicy(jobDef.Retry)
+	if err != nil {
+		return nil, http.StatusBadRequest, err
+	}
+
+	if jobDef.Timeout < 0 {
+		return nil, http.StatusBadRequest, errors.New("Invalid Job Definition. Timeout must not be negative")
+	}
+
+	runAt, err := validateRunAt(jobDef.RunAt, jobDef.Delay)
+	if err != nil {
+		return nil, http.StatusBadRequest, err
+	}
+
+	if jobDef.Resources.Cpu < 0 || jobDef.Resources.MemoryMB < 0 {
+		return nil, http.StatusBadRequest, errors.New("Invalid Job Definition. Resources must not be negative")
+	}
+
+	if jobDef.GangSize < 0 {
+		return nil, http.StatusBadRequest, errors.New("Invalid Job Definition. Gang size must not be negative")
+	}
+	// a single member can't be retried or preempted. it would have to start without the others
+	if jobDef.GangSize > 0 && (retry.MaxAttempts > 1 || jobDef.Preemptible) {
+		return nil, http.StatusBadRequest, errors.New("Invalid Job Definition. Gangs can't be retried or preempted")
+	}
+
+	if _, err := util.ParseSelector(jobDef.Selector); err != nil {
+		return nil, http.StatusBadRequest, err
+	}
+
+	affinity, err := validateAffinity(jobDef.Affinity)
+	if err != nil {
+		return nil, http.StatusBadRequest, err
+	}
+
+	if jobDef.Placement != "" {
+		if _, err := PlacementStrategyByName(jobDef.Placement); err != nil {
+			return nil, http.StatusBadRequest, errors.New(fmt.Sprintf("Invalid Job Definition. %v", err))
+		}
+	}
+
 	job := structs.NewJob(
 		jobDef.Identifier,
 		jobDef.Driver,
@@ -89,20 +156,180 @@ func postJob(deps ApiDependencies, c *gin.Context) {
 		uint(jobDef.Priority),
 		jobDef.GpuReq,
 		jobDef.UserData,
+		dependsOn,
+		retry,
+		jobDef.Timeout,
 	)
+	job.RunAt = runAt
+	job.Placement = jobDef.Placement
+	job.Resources = jobDef.Resources
+	job.Preemptible = jobDef.Preemptible
+	job.Tenant = jobDef.Tenant
+	if job.Tenant == "" {
+		job.Tenant = DEFAULT_TENANT
+	}
+	job.ConcurrencyKey = jobDef.ConcurrencyKey
+	job.Affinity = affinity
+	job.Selector = jobDef.Selector
+	return job, 0, nil
+}
+
+func postJob(deps ApiDependencies, c *gin.Context) {
+	var jobDef JobDefinition
+	if err := c.ShouldBindJSON(&jobDef); err != nil {
+		sendError(c, http.StatusBadRequest, errors.New("Couldn't parse Job Definition"))
+		return
+	}
+
+	job, code, err := jobFromDefinition(deps, jobDef)
+	if err != nil {
+		sendError(c, code, err)
+		return
+	}
+
+	if jobDef.GangSize > 0 {
+		postGang(deps, c, job, jobDef.GangSize)
+		return
+	}
 
 	fmt.Printf("%+v\n", job)
 
-	_, err := deps.Store.InsertJob(job)
+	_, err = deps.Store.InsertJob(job)
 	if err != nil {
 		fmt.Fprintf(os.Stderr, "Internal Error: %v\n", err)
 		sendError(c, http.StatusInternalServerError, err)
 		return
 	}
+	deps.Trigger.Fire()
 
 	c.JSON(http.StatusCreated, job)
 }
 
+// creates one job per member of the gang. responds with all members
+func postGang(deps ApiDependencies, c *gin.Context, template *structs.Job, size int) {
+	gangId := uuid.New().String()
+	members := make([]*structs.Job, size)
+	for rank := 0; rank < size; rank++ {
+		member := template.NewInstance()
+		member.RunAt = template.RunAt
+		member.GangId = gangId
+		member.GangRank = rank
+		member.GangSize = size
+		members[rank] = member
+	}
+
+	for _, member := range members {
+		if _, err := deps.Store.InsertJob(member); err != nil {
+			fmt.Fprintf(os.Stderr, "Internal Error: %v\n", err)
+			// the members that are in already would wait for the others forever
+			deps.TcpServer.cancelGang(gangId, fmt.Sprintf("Gang couldn't be created: %v", err))
+			sendError(c, http.StatusInternalServerError, err)
+			return
+		}
+	}
+	fmt.Printf("Gang %s with %d members\n", gangId, size)
+	deps.Trigger.Fire()
+
+	c.JSON(http.StatusCreated, members)
+}
+
+// checks that all upstream jobs exist and removes duplicates
+func validateDependencies(deps ApiDependencies, dependsOn []string) ([]string, int, error) {
+	validated := make([]string, 0, len(dependsOn))
+	seen := make(map[string]bool)
+	for _, id := range dependsOn {
+		if seen[id] {
+			continue
+		}
+		seen[id] = true
+
+		upstream, err := deps.Store.JobById(id)
+		if err != nil {
+			return nil, http.StatusInternalServerError, err
+		}
+		if upstream == nil || upstream.Status == structs.JOB_STATUS_DELETE {
+			return nil, http.StatusBadRequest, errors.New(fmt.Sprintf("Invalid Job Definition. Upstream job %s doesn't exist", id))
+		}
+		validated = append(validated, id)
+	}
+	return validated, 0, nil
+}
+
+// returns the time in ms before which the job must not run
+func validateRunAt(runAt string, delay int64) (int64, error) {
+	if runAt != "" && delay != 0 {
+		return 0, errors.New("Invalid Job Definition. Only one of run_at and delay allowed")
+	}
+	if delay < 0 {
+		return 0, errors.New("Invalid Job Definition. Delay must not be negative")
+	}
+	if delay > 0 {
+		return structs.NowMs() + delay * 1000, nil
+	}
+	if runAt != "" {
+		t, err := time.Parse(time.RFC3339, runAt)
+		if err != nil {
+			return 0, errors.New("Invalid Job Definition. run_at must be RFC3339 timestamp")
+		}
+		return t.UnixNano() / 1000000, nil
+	}
+	return 0, nil
+}
+
+func validateAffinity(affinity structs.Affinity) (structs.Affinity, error) {
+	if affinity.Nodes == nil {
+		affinity.Nodes = make([]string, 0)
+	}
+	if affinity.AvoidNodes == nil {
+		affinity.AvoidNodes = make([]string, 0)
+	}
+	if affinity.AntiAffinity == nil {
+		affinity.AntiAffinity = make([]string, 0)
+	}
+	if affinity.Prefer == nil {
+		affinity.Prefer = make([]string, 0)
+	}
+	for _, name := range affinity.Nodes {
+		if util.ContainsString(affinity.AvoidNodes, name) {
+			return affinity, errors.New(fmt.Sprintf("Invalid Affinity. Node %s is pinned and avoided at the same time", name))
+		}
+	}
+	return affinity, nil
+}
+
+func validateRetryPolicy(policy *structs.RetryPolicy) (structs.RetryPolicy, error) {
+	if policy == nil || policy.MaxAttempts <= 1 {
+		return structs.RetryPolicy{RetryOn: make([]string, 0)}, nil
+	}
+	validated := *policy
+
+	if validated.BackoffMs < 0 || validated.MaxBackoffMs < 0 || validated.BackoffFactor < 0 {
+		return validated, errors.New("Invalid Retry Policy. Backoff values must not be negative")
+	}
+	if validated.BackoffMs == 0 {
+		validated.BackoffMs = 1000
+	}
+	if validated.BackoffFactor == 0 {
+		validated.BackoffFactor = 2
+	}
+	if validated.MaxBackoffMs == 0 {
+		validated.MaxBackoffMs = 10 * 60 * 1000
+	}
+
+	if len(validated.RetryOn) == 0 {
+		validated.RetryOn = []string{structs.RETRY_ON_NODE_LOST, structs.RETRY_ON_EXIT_ERROR}
+	}
+	for _, kind := range validated.RetryOn {
+		switch (kind) {
+		case structs.RETRY_ON_NODE_LOST, structs.RETRY_ON_EXIT_ERROR, structs.RETRY_ON_REJECTED, structs.RETRY_ON_TIMEOUT:
+			continue
+		default:
+			return validated, errors.New(fmt.Sprintf("Invalid Retry Policy. Unknown failure kind %s", kind))
+		}
+	}
+	return validated, nil
+}
+
 func getAllJobs(deps ApiDependencies, c *gin.Context) {
 	limit, err := strconv.Atoi(c.DefaultQuery("limit", "0"))
 	if err != nil {
@@ -115,21 +342,107 @@ func getAllJobs(deps ApiDependencies, c *gin.Context) {
 		return
 	}
 
-	jobs, err := deps.Store.AllJobs(uint(limit))
+	var jobs []*structs.Job
+	switch (c.DefaultQuery("view", "all")) {
+	case "all":
+		jobs, err = deps.Store.AllJobs(uint(limit))
+	case "delayed":
+		// waiting jobs that are not due yet (run_at in future or backed off after failure)
+		jobs, err = filterJobs(deps, structs.JOB_STATUS_WAITING, uint(limit), func (job *structs.Job) bool {
+			return job.IsDelayed(structs.NowMs())
+		})
+	case "waiting":
+		// waiting jobs that can be scheduled right now
+		jobs, err = filterJobs(deps, structs.JOB_STATUS_WAITING, uint(limit), func (job *structs.Job) bool {
+			return job.IsDelayed(structs.NowMs()) == false
+		})
+	case "blocked":
+		// waiting jobs that the scheduler held back in its last pass
+		jobs, err = filterJobs(deps, structs.JOB_STATUS_WAITING, uint(limit), func (job *structs.Job) bool {
+			return deps.Scheduler.BlockedReason(job.Id) != ""
+		})
+	default:
+		sendError(c, http.StatusBadRequest, errors.New("view must be all, waiting, delayed or blocked"))
+		return
+	}
 	if err != nil {
 		sendError(c, http.StatusInternalServerError, err)
 		return
 	}
 
+	addSchedulingInfo(deps, jobs)
 	c.JSON(http.StatusOK, jobs)
 }
 
+// fills in the priority the scheduler sees and, for waiting jobs, why they aren't scheduled yet
+func addSchedulingInfo(deps ApiDependencies, jobs []*structs.Job) {
+	now := structs.NowMs()
+	for _, job := range jobs {
+		job.EffectivePriority = effectivePriority(job, now, deps.TcpServer.config.Scheduler.Aging)
+		if job.Status == structs.JOB_STATUS_WAITING {
+			job.BlockedReason = deps.Scheduler.BlockedReason(job.Id)
+		}
+	}
+}
+
+func filterJobs(deps ApiDependencies, status structs.JobStatus, limit uint, keep func (job *structs.Job) bool) ([]*structs.Job, error) {
+	jobs, err := deps.Store.JobsWithStatus(status, 0)
+	if err != nil {
+		return nil, err
+	}
+	filtered := make([]*structs.Job, 0)
+	for _, job := range jobs {
+		if limit > 0 && uint(len(filtered)) >= limit {
+			break
+		}
+		if keep(job) {
+			filtered = append(filtered, job)
+		}
+	}
+	return filtered, nil
+}
+
 func getAllNodes(deps ApiDependencies, c *gin.Context) {
 	nodes := deps.TcpServer.Nodes()
 
 	c.JSON(http.StatusOK, nodes)
 }
 
+func sendNodeMaintenance(c *gin.Context, node *Node, err error) {
+	if err != nil {
+		sendError(c, http.StatusNotFound, err)
+		return
+	}
+	// node isn't connected right now (uncordon after it left)
+	if node == nil {
+		c.Status(http.StatusOK)
+		return
+	}
+	c.JSON(http.StatusOK, node)
+}
+
+func cordonNode(deps ApiDependencies, c *gin.Context) {
+	node, err := deps.TcpServer.CordonNode(c.Param("NodeName"))
+	sendNodeMaintenance(c, node, err)
+}
+
+func uncordonNode(deps ApiDependencies, c *gin.Context) {
+	node, err := deps.TcpServer.UncordonNode(c.Param("NodeName"))
+	sendNodeMaintenance(c, node, err)
+}
+
+// deadline (in seconds) after which running jobs are cancelled and requeued. 0 lets them finish
+func drainNode(deps ApiDependencies, c *gin.Context) {
+	deadline, err := strconv.Atoi(c.DefaultQuery("deadline", "0"))
+	if err != nil || deadline < 0 {
+		sendError(c, http.StatusBadRequest, errors.New("deadline must be a positive integer"))
+		return
+	}
+
+	node, err := deps.TcpServer.DrainNode(c.Param("NodeName"), time.Duration(deadline) * time.Second)
+	sendNodeMaintenance(c, node, err)
+}
+
 func getJobLog(deps ApiDependencies, c *gin.Context) {
 	job, err := deps.Store.JobById(c.Param("JobId"))
 	if err != nil {
@@ -164,9 +477,74 @@ func getJob(deps ApiDependencies, c *gin.Context) {
 		return
 	}
 
+	addSchedulingInfo(deps, []*structs.Job{job})
 	c.JSON(http.StatusOK, job)
 }
 
+func getJobAttempts(deps ApiDependencies, c *gin.Context) {
+	job, err := deps.Store.JobById(c.Param("JobId"))
+	if err != nil {
+		sendError(c, http.StatusInternalServerError, err)
+		return
+	}
+
+	if job == nil {
+		sendError(c, http.StatusNotFound, errors.New("Couldn't find job"))
+		return
+	}
+
+	resp := make(map[string]interface{}, 0)
+	resp["jobId"] = job.Id
+	resp["max_attempts"] = job.Retry.MaxAttempts
+	resp["retry_at"] = job.RetryAt
+	resp["attempts"] = job.Attempts
+
+	c.JSON(http.StatusOK, resp)
+}
+
+func getJobGraph(deps ApiDependencies, c *gin.Context) {
+	job, err := deps.Store.JobById(c.Param("JobId"))
+	if err != nil {
+		sendError(c, http.StatusInternalServerError, err)
+		return
+	}
+
+	if job == nil {
+		sendError(c, http.StatusNotFound, errors.New("Couldn't find job"))
+		return
+	}
+
+	all, err := deps.Store.AllJobs(0)
+	if err != nil {
+		sendError(c, http.StatusInternalServerError, err)
+		return
+	}
+
+	c.JSON(http.StatusOK, buildJobGraph(job, all))
+}
+
+// what the scheduler would do with the job if it ran now and why
+func getJobExplanation(deps ApiDependencies, c *gin.Context) {
+	job, err := deps.Store.JobById(c.Param("JobId"))
+	if err != nil {
+		sendError(c, http.StatusInternalServerError, err)
+		return
+	}
+
+	if job == nil {
+		sendError(c, http.StatusNotFound, errors.New("Couldn't find job"))
+		return
+	}
+
+	explanation, err := deps.Scheduler.Explain(job)
+	if err != nil {
+		sendError(c, http.StatusInternalServerError, err)
+		return
+	}
+
+	c.JSON(http.StatusOK, explanation)
+}
+
 func updateJobStatus(tcpServer *TcpServer, job *structs.Job, value string) (int, error) {
 	switch (value) {
 	case "4", "cancel":
@@ -251,6 +629,18 @@ func deleteJob(deps ApiDependencies, c *gin.Context) {
 		return
 	}
 
+	// deleting would cancel the downstream jobs, even if this one succeeded. the user has to
+	// cancel it or delete them first
+	dependents, err := waitingDependents(deps.Store, job.Id)
+	if err != nil {
+		sendError(c, http.StatusInternalServerError, err)
+		return
+	}
+	if len(dependents) > 0 {
+		sendError(c, http.StatusConflict, errors.New(fmt.Sprintf("Can't delete job that %d waiting jobs depend on (e.g. %s)", len(dependents), dependents[0].Id)))
+		return
+	}
+
 	err = deps.Store.UpdateJobStatus(job.Id, structs.JOB_STATUS_DELETE)
 	if err != nil {
 		sendError(c, http.StatusInternalServerError, err)
@@ -260,6 +650,61 @@ func deleteJob(deps ApiDependencies, c *gin.Context) {
 	c.Status(http.StatusOK)
 }
 
+type TenantUsage struct {
+	Tenant		string	`json:"tenant"`
+	Share		float64	`json:"share"`
+	// decayed slot-seconds including the running jobs
+	Usage		float64	`json:"usage"`
+	JobsRunning	int	`json:"jobs_running"`
+	JobsWaiting	int	`json:"jobs_waiting"`
+}
+
+func getUsage(deps ApiDependencies, c *gin.Context) {
+	running, err := deps.Store.JobsWithStatus(structs.JOB_STATUS_SCHEDULED, 0)
+	if err != nil {
+		sendError(c, http.StatusInternalServerError, err)
+		return
+	}
+	waiting, err := deps.Store.JobsWithStatus(structs.JOB_STATUS_WAITING, 0)
+	if err != nil {
+		sendError(c, http.StatusInternalServerError, err)
+		return
+	}
+
+	cfg := deps.TcpServer.config.Scheduler.FairShare
+	usage := deps.TcpServer.Usage().UsageWithRunning(running, structs.NowMs())
+
+	tenants := make(map[string]*TenantUsage)
+	get := func (tenant string) *TenantUsage {
+		if _, in := tenants[tenant]; in == false {
+			tenants[tenant] = &TenantUsage{Tenant: tenant, Share: cfg.shareOf(tenant)}
+		}
+		return tenants[tenant]
+	}
+	for tenant := range cfg.Shares {
+		get(tenant)
+	}
+	for tenant, u := range usage {
+		get(tenant).Usage = u
+	}
+	for _, job := range running {
+		get(job.Tenant).JobsRunning++
+	}
+	for _, job := range waiting {
+		get(job.Tenant).JobsWaiting++
+	}
+
+	res := make([]*TenantUsage, 0, len(tenants))
+	for _, t := range tenants {
+		res = append(res, t)
+	}
+	sort.Slice(res[:], func (i int, j int) bool {
+		return res[i].Tenant < res[j].Tenant
+	})
+
+	c.JSON(http.StatusOK, res)
+}
+
 func StartApi(config Config, deps ApiDependencies) error {
 
 	gin.SetMode(gin.ReleaseMode)
@@ -286,9 +731,60 @@ func StartApi(config Config, deps ApiDependencies) error {
 		v1.GET("/jobs/:JobId/log", func (c *gin.Context) {
 			getJobLog(deps, c)
 		})
+		v1.GET("/jobs/:JobId/attempts", func (c *gin.Context) {
+			getJobAttempts(deps, c)
+		})
+		v1.GET("/jobs/:JobId/graph", func (c *gin.Context) {
+			getJobGraph(deps, c)
+		})
+		v1.GET("/jobs/:JobId/explain", func (c *gin.Context) {
+			getJobExplanation(deps, c)
+		})
 		v1.GET("/nodes", func (c *gin.Context) {
 			getAllNodes(deps, c)
 		})
+		v1.POST("/nodes/:NodeName/cordon", func (c *gin.Context) {
+			cordonNode(deps, c)
+		})
+		v1.POST("/nodes/:NodeName/uncordon", func (c *gin.Context) {
+			uncordonNode(deps, c)
+		})
+		v1.POST("/nodes/:NodeName/drain", func (c *gin.Context) {
+			drainNode(deps, c)
+		})
+		v1.GET("/usage", func (c *gin.Context) {
+			getUsage(deps, c)
+		})
+		v1.POST("/schedules", func (c *gin.Context) {
+			postSchedule(deps, c)
+		})
+		v1.GET("/schedules", func (c *gin.Context) {
+			getAllSchedules(deps, c)
+		})
+		v1.GET("/schedules/:ScheduleId", func (c *gin.Context) {
+			getSchedule(deps, c)
+		})
+		v1.PUT("/schedules/:ScheduleId", func (c *gin.Context) {
+			putSchedule(deps, c)
+		})
+		v1.DELETE("/schedules/:ScheduleId", func (c *gin.Context) {
+			deleteSchedule(deps, c)
+		})
+		v1.GET("/cluster", func (c *gin.Context) {
+			getCluster(deps.Ha, c)
+		})
+		v1.POST("/arrays", func (c *gin.Context) {
+			postArray(deps, c)
+		})
+		v1.GET("/arrays/:ArrayId", func (c *gin.Context) {
+			getArray(deps, c)
+		})
+		v1.GET("/arrays/:ArrayId/jobs", func (c *gin.Context) {
+			getArrayJobs(deps, c)
+		})
+		v1.PATCH("/arrays/:ArrayId", func (c *gin.Context) {
+			patchArray(deps, c)
+		})
 	}
 
 	return router.Run(config.Addresses.Http)
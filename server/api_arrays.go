@@ -0,0 +1,165 @@
+package server
+
+import (
+	"net/http"
+	"fmt"
+	"os"
+	"errors"
+
+	"taylor/lib/structs"
+	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
+)
+
+// template job that is expanded into count times the combinations of the matrix values.
+// {{index}} and {{<param>}} in the driver config are replaced for every child. the index is
+// the one of the child in the whole array (0 to count * combinations - 1)
+type ArrayDefinition struct {
+	Job		JobDefinition		`json:"job"`
+	// number of times every combination is run. child i runs combination i % combinations
+	Count		int			`json:"count"`
+	// values per parameter. every combination becomes a child
+	Matrix		map[string][]string	`json:"matrix"`
+}
+
+func findArray(deps ApiDependencies, c *gin.Context) []*structs.Job {
+	children, err := deps.Store.JobsInArray(c.Param("ArrayId"))
+	if err != nil {
+		sendError(c, http.StatusInternalServerError, err)
+		return nil
+	}
+
+	if len(children) == 0 {
+		sendError(c, http.StatusNotFound, errors.New("Couldn't find array"))
+		return nil
+	}
+	return children
+}
+
+func postArray(deps ApiDependencies, c *gin.Context) {
+	var def ArrayDefinition
+	if err := c.ShouldBindJSON(&def); err != nil {
+		sendError(c, http.StatusBadRequest, errors.New("Couldn't parse Array Definition"))
+		return
+	}
+
+	if def.Job.GangSize > 0 {
+		sendError(c, http.StatusBadRequest, errors.New("Invalid Array Definition. Children can't be gangs"))
+		return
+	}
+
+	params, err := arrayParams(def.Count, def.Matrix)
+	if err != nil {
+		sendError(c, http.StatusBadRequest, err)
+		return
+	}
+
+	template, code, err := jobFromDefinition(deps, def.Job)
+	if err != nil {
+		sendError(c, code, err)
+		return
+	}
+
+	arrayId := uuid.New().String()
+	children := expandArray(template, arrayId, params)
+	for _, child := range children {
+		if _, err := deps.Store.InsertJob(child); err != nil {
+			fmt.Fprintf(os.Stderr, "Internal Error: %v\n", err)
+			// the children that are in already must not run without the rest
+			rollbackArray(deps, arrayId)
+			sendError(c, http.StatusInternalServerError, err)
+			return
+		}
+	}
+	fmt.Printf("Array %s with %d children\n", arrayId, len(children))
+	deps.Trigger.Fire()
+
+	c.JSON(http.StatusCreated, NewArrayStatus(arrayId, children))
+}
+
+func getArray(deps ApiDependencies, c *gin.Context) {
+	children := findArray(deps, c)
+	if children == nil {
+		return
+	}
+
+	c.JSON(http.StatusOK, NewArrayStatus(c.Param("ArrayId"), children))
+}
+
+func getArrayJobs(deps ApiDependencies, c *gin.Context) {
+	children := findArray(deps, c)
+	if children == nil {
+		return
+	}
+
+	addSchedulingInfo(deps, children)
+	c.JSON(http.StatusOK, children)
+}
+
+// cancels the children of an array that couldn't be inserted completely
+func rollbackArray(deps ApiDependencies, arrayId string) {
+	inserted, err := deps.Store.JobsInArray(arrayId)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Couldn't roll back array %s: %v\n", arrayId, err)
+		return
+	}
+	if _, err := cancelArray(deps.TcpServer, inserted); err != nil {
+		fmt.Fprintf(os.Stderr, "Couldn't roll back array %s: %v\n", arrayId, err)
+	}
+}
+
+// cancels all children that are waiting or scheduled. finished ones are left alone
+func cancelArray(tcpServer *TcpServer, children []*structs.Job) (int, error) {
+	failed := 0
+	for _, child := range children {
+		if child.CanCancel() == false {
+			continue
+		}
+		if err := tcpServer.CancelJob(child); err != nil {
+			fmt.Fprintf(os.Stderr, "Couldn't cancel job %s of array %s: %v\n", child.Id, child.ArrayId, err)
+			failed++
+		}
+	}
+	if failed > 0 {
+		return http.StatusConflict, errors.New(fmt.Sprintf("%d jobs of the array couldn't be cancelled", failed))
+	}
+	return http.StatusAccepted, nil
+}
+
+func patchArray(deps ApiDependencies, c *gin.Context) {
+	var patchDef PatchDefinition
+	if err := c.ShouldBindJSON(&patchDef); err != nil {
+		sendError(c, http.StatusBadRequest, errors.New("Couldn't parse Patch Definition"))
+		return
+	}
+
+	if patchDef.Op == "" || patchDef.Path == "" || patchDef.Value == "" {
+		sendError(c, http.StatusBadRequest, errors.New("Invalid Patch Definition. Op, Path and Value field required"))
+		return
+	}
+
+	if patchDef.Op != "update" {
+		sendError(c, http.StatusNotImplemented, errors.New("op not implemented yet"))
+		return
+	}
+	if patchDef.Path != "/status" && patchDef.Path != "status" {
+		sendError(c, http.StatusBadRequest, errors.New("invalid path (/status)"))
+		return
+	}
+	if patchDef.Value != "4" && patchDef.Value != "cancel" {
+		sendError(c, http.StatusBadRequest, errors.New("invalid value (4 or cancel)"))
+		return
+	}
+
+	children := findArray(deps, c)
+	if children == nil {
+		return
+	}
+
+	code, err := cancelArray(deps.TcpServer, children)
+	if err != nil {
+		sendError(c, code, err)
+		return
+	}
+	c.Status(code)
+}
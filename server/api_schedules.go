@@ -0,0 +1,160 @@
+package server
+
+import (
+	"net/http"
+	"fmt"
+	"time"
+	"errors"
+
+	"taylor/lib/structs"
+	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
+)
+
+type ScheduleDefinition struct {
+	Name		string		`json:"name"`
+	Cron		string		`json:"cron"`
+	Timezone	string		`json:"timezone"`
+	OverlapPolicy	string		`json:"overlap_policy"`
+	Enabled		*bool		`json:"enabled"`
+	Job		JobDefinition	`json:"job"`
+}
+
+// validates def and applies it to schedule
+func applyScheduleDefinition(deps ApiDependencies, def ScheduleDefinition, schedule *structs.Schedule) (int, error) {
+	if def.Name == "" || def.Cron == "" {
+		return http.StatusBadRequest, errors.New("Invalid Schedule Definition. Name and Cron must not be empty")
+	}
+
+	if def.Timezone == "" {
+		def.Timezone = "UTC"
+	}
+
+	switch (def.OverlapPolicy) {
+	case "":
+		def.OverlapPolicy = structs.OVERLAP_SKIP
+	case structs.OVERLAP_SKIP, structs.OVERLAP_QUEUE, structs.OVERLAP_CANCEL:
+		break
+	default:
+		return http.StatusBadRequest, errors.New(fmt.Sprintf("Invalid Schedule Definition. Unknown overlap policy %s", def.OverlapPolicy))
+	}
+
+	nextRun, err := nextRunAt(def.Cron, def.Timezone, time.Now())
+	if err != nil {
+		return http.StatusBadRequest, err
+	}
+
+	template, code, err := jobFromDefinition(deps, def.Job)
+	if err != nil {
+		return code, err
+	}
+	if def.Job.GangSize > 0 {
+		return http.StatusBadRequest, errors.New("Invalid Schedule Definition. Schedules can't create gangs")
+	}
+
+	schedule.Name = def.Name
+	schedule.Cron = def.Cron
+	schedule.Timezone = def.Timezone
+	schedule.OverlapPolicy = def.OverlapPolicy
+	schedule.Enabled = def.Enabled == nil || *def.Enabled
+	schedule.Job = *template
+	schedule.NextRunAt = nextRun
+	return 0, nil
+}
+
+func findSchedule(deps ApiDependencies, c *gin.Context) *structs.Schedule {
+	schedule, err := deps.Store.ScheduleById(c.Param("ScheduleId"))
+	if err != nil {
+		sendError(c, http.StatusInternalServerError, err)
+		return nil
+	}
+
+	if schedule == nil {
+		sendError(c, http.StatusNotFound, errors.New("Couldn't find schedule"))
+		return nil
+	}
+	return schedule
+}
+
+func postSchedule(deps ApiDependencies, c *gin.Context) {
+	var def ScheduleDefinition
+	if err := c.ShouldBindJSON(&def); err != nil {
+		sendError(c, http.StatusBadRequest, errors.New("Couldn't parse Schedule Definition"))
+		return
+	}
+
+	schedule := &structs.Schedule{
+		Id:		uuid.New().String(),
+		Timestamp:	structs.NowMs(),
+	}
+	if code, err := applyScheduleDefinition(deps, def, schedule); err != nil {
+		sendError(c, code, err)
+		return
+	}
+
+	if err := deps.Store.InsertSchedule(schedule); err != nil {
+		sendError(c, http.StatusInternalServerError, err)
+		return
+	}
+
+	c.JSON(http.StatusCreated, schedule)
+}
+
+func getAllSchedules(deps ApiDependencies, c *gin.Context) {
+	schedules, err := deps.Store.AllSchedules()
+	if err != nil {
+		sendError(c, http.StatusInternalServerError, err)
+		return
+	}
+
+	c.JSON(http.StatusOK, schedules)
+}
+
+func getSchedule(deps ApiDependencies, c *gin.Context) {
+	schedule := findSchedule(deps, c)
+	if schedule == nil {
+		return
+	}
+
+	c.JSON(http.StatusOK, schedule)
+}
+
+func putSchedule(deps ApiDependencies, c *gin.Context) {
+	var def ScheduleDefinition
+	if err := c.ShouldBindJSON(&def); err != nil {
+		sendError(c, http.StatusBadRequest, errors.New("Couldn't parse Schedule Definition"))
+		return
+	}
+
+	schedule := findSchedule(deps, c)
+	if schedule == nil {
+		return
+	}
+
+	if code, err := applyScheduleDefinition(deps, def, schedule); err != nil {
+		sendError(c, code, err)
+		return
+	}
+
+	if err := deps.Store.UpdateScheduleDefinition(schedule); err != nil {
+		sendError(c, http.StatusInternalServerError, err)
+		return
+	}
+
+	c.JSON(http.StatusOK, schedule)
+}
+
+// jobs that have already been created by the schedule are not touched
+func deleteSchedule(deps ApiDependencies, c *gin.Context) {
+	schedule := findSchedule(deps, c)
+	if schedule == nil {
+		return
+	}
+
+	if err := deps.Store.DeleteSchedule(schedule.Id); err != nil {
+		sendError(c, http.StatusInternalServerError, err)
+		return
+	}
+
+	c.Status(http.StatusOK)
+}
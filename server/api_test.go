@@ -0,0 +1,203 @@
+package server
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+
+	s "taylor/lib/structs"
+)
+
+func testRequest(method string, body string) (*gin.Context, *httptest.ResponseRecorder) {
+	gin.SetMode(gin.ReleaseMode)
+	recorder := httptest.NewRecorder()
+	c, _ := gin.CreateTestContext(recorder)
+	c.Request, _ = http.NewRequest(method, "/", bytes.NewBufferString(body))
+	c.Request.Header.Set("Content-Type", "application/json")
+	return c, recorder
+}
+
+func TestPostGangRollsBack(t *testing.T) {
+	store := newFakeStore()
+	store.failInsertAt = 2
+	tcpServer, cleanup := newTestTcpServer(t, store)
+	defer cleanup()
+	deps := ApiDependencies{Store: store, TcpServer: tcpServer, DiskLog: tcpServer.diskLog, Trigger: tcpServer.trigger}
+
+	c, recorder := testRequest("POST", `{"identifier": "gang", "driver": "exec", "driver_config": {"cmd": "true"}, "gang_size": 3}`)
+	postJob(deps, c)
+	assertInt(t, recorder.Code, http.StatusInternalServerError)
+
+	// the members that made it in must not wait for the missing one
+	jobs, _ := store.AllJobs(0)
+	assertInt(t, len(jobs), 2)
+	for _, job := range jobs {
+		if job.Status != s.JOB_STATUS_CANCEL {
+			t.Fatal("Member", job.GangRank, "of a gang that couldn't be created has status", job.Status)
+		}
+	}
+	waiting, _ := store.JobsWithStatus(s.JOB_STATUS_WAITING, 0)
+	assertInt(t, len(waiting), 0)
+}
+
+func TestPostArrayRollsBack(t *testing.T) {
+	store := newFakeStore()
+	store.failInsertAt = 3
+	tcpServer, cleanup := newTestTcpServer(t, store)
+	defer cleanup()
+	deps := ApiDependencies{Store: store, TcpServer: tcpServer, DiskLog: tcpServer.diskLog, Trigger: tcpServer.trigger}
+
+	c, recorder := testRequest("POST", `{"job": {"identifier": "array", "driver": "exec", "driver_config": {"cmd": "true"}}, "count": 5}`)
+	postArray(deps, c)
+	assertInt(t, recorder.Code, http.StatusInternalServerError)
+
+	// the children that made it in must not run without the rest
+	jobs, _ := store.AllJobs(0)
+	assertInt(t, len(jobs), 3)
+	for _, job := range jobs {
+		if job.Status != s.JOB_STATUS_CANCEL {
+			t.Fatal("Child", job.ArrayIndex, "of an array that couldn't be created has status", job.Status)
+		}
+	}
+}
+
+func TestValidateRetryPolicy(t *testing.T) {
+	// no policy or a single attempt means no retries
+	for _, policy := range []*s.RetryPolicy{nil, &s.RetryPolicy{MaxAttempts: 1, RetryOn: []string{"unknown"}}} {
+		validated, err := validateRetryPolicy(policy)
+		if err != nil || validated.MaxAttempts != 0 || validated.RetryOn == nil || len(validated.RetryOn) != 0 {
+			t.Fatal("Expected no retries, got", validated, err)
+		}
+	}
+
+	validated, err := validateRetryPolicy(&s.RetryPolicy{MaxAttempts: 3})
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := s.RetryPolicy{
+		MaxAttempts:	3,
+		BackoffMs:	1000,
+		BackoffFactor:	2,
+		MaxBackoffMs:	10 * 60 * 1000,
+		RetryOn:	[]string{s.RETRY_ON_NODE_LOST, s.RETRY_ON_EXIT_ERROR},
+	}
+	if fmt.Sprint(validated) != fmt.Sprint(expected) {
+		t.Fatal("Expected defaults", expected, "got", validated)
+	}
+
+	// given values are kept
+	given := s.RetryPolicy{MaxAttempts: 2, BackoffMs: 5, BackoffFactor: 1, MaxBackoffMs: 10, RetryOn: []string{s.RETRY_ON_REJECTED, s.RETRY_ON_TIMEOUT}}
+	if validated, err := validateRetryPolicy(&given); err != nil || fmt.Sprint(validated) != fmt.Sprint(given) {
+		t.Fatal("Expected", given, "got", validated, err)
+	}
+
+	for _, invalid := range []s.RetryPolicy{
+		s.RetryPolicy{MaxAttempts: 2, RetryOn: []string{s.RETRY_ON_EXIT_ERROR, "oom"}},
+		s.RetryPolicy{MaxAttempts: 2, BackoffMs: -1},
+		s.RetryPolicy{MaxAttempts: 2, BackoffFactor: -1},
+		s.RetryPolicy{MaxAttempts: 2, MaxBackoffMs: -1},
+	} {
+		if _, err := validateRetryPolicy(&invalid); err == nil {
+			t.Fatal("Policy", invalid, "must be invalid")
+		}
+	}
+}
+
+func TestDeleteJobWithWaitingDependents(t *testing.T) {
+	upstream := &s.Job{Id: "upstream", Status: s.JOB_STATUS_SUCCESS}
+	downstream := &s.Job{Id: "downstream", Status: s.JOB_STATUS_WAITING, DependsOn: []string{"upstream"}}
+	store := newFakeStore(upstream, downstream)
+	deps := ApiDependencies{Store: store}
+
+	deleteRequest := func (id string) int {
+		c, recorder := testRequest("DELETE", "")
+		c.Params = gin.Params{gin.Param{Key: "JobId", Value: id}}
+		deleteJob(deps, c)
+		return recorder.Code
+	}
+
+	// the downstream job would be cancelled
+	assertInt(t, deleteRequest("upstream"), http.StatusConflict)
+	if stored, _ := store.JobById("upstream"); stored.Status != s.JOB_STATUS_SUCCESS {
+		t.Fatal("Job must keep its status, has", stored.Status)
+	}
+
+	// once nothing waits for it anymore it can go
+	assertInt(t, deleteRequest("downstream"), http.StatusOK)
+	assertInt(t, deleteRequest("upstream"), http.StatusOK)
+	if stored, _ := store.JobById("upstream"); stored.Status != s.JOB_STATUS_DELETE {
+		t.Fatal("Job must be deleted, has", stored.Status)
+	}
+}
+
+func TestValidateRunAt(t *testing.T) {
+	if runAt, err := validateRunAt("", 0); err != nil || runAt != 0 {
+		t.Fatal("Job without delay must run right away, got", runAt, err)
+	}
+
+	before := s.NowMs()
+	runAt, err := validateRunAt("", 60)
+	if err != nil || runAt < before + 60000 || runAt > s.NowMs() + 60000 {
+		t.Fatal("Delay is in seconds from now, got", runAt - before, err)
+	}
+
+	runAt, err = validateRunAt("2030-01-02T03:04:05+02:00", 0)
+	if err != nil || runAt != time.Date(2030, 1, 2, 1, 4, 5, 0, time.UTC).UnixNano() / 1000000 {
+		t.Fatal("Unexpected run_at", runAt, err)
+	}
+
+	for _, invalid := range []struct {
+		runAt	string
+		delay	int64
+	}{
+		{"2030-01-02T03:04:05Z", 10},
+		{"", -1},
+		{"2030-01-02 03:04:05", 0},
+		{"tomorrow", 0},
+	} {
+		if _, err := validateRunAt(invalid.runAt, invalid.delay); err == nil {
+			t.Fatal("run_at", invalid.runAt, "with delay", invalid.delay, "must be invalid")
+		}
+	}
+}
+
+func TestGetJobsDelayedView(t *testing.T) {
+	now := s.NowMs()
+	delayed := &s.Job{Id: "delayed", Status: s.JOB_STATUS_WAITING, RunAt: now + 60000}
+	backedOff := &s.Job{Id: "backed-off", Status: s.JOB_STATUS_WAITING, RetryAt: now + 60000}
+	due := &s.Job{Id: "due", Status: s.JOB_STATUS_WAITING, RunAt: now - 1000}
+	running := &s.Job{Id: "running", Status: s.JOB_STATUS_SCHEDULED, RunAt: now + 60000}
+	store := newFakeStore(delayed, backedOff, due, running)
+	tcpServer, cleanup := newTestTcpServer(t, store)
+	defer cleanup()
+	deps := ApiDependencies{Store: store, TcpServer: tcpServer, Scheduler: newTestScheduler(tcpServer)}
+
+	view := func (name string) []string {
+		c, recorder := testRequest("GET", "")
+		c.Request.URL.RawQuery = "view=" + name
+		getAllJobs(deps, c)
+		assertInt(t, recorder.Code, http.StatusOK)
+		jobs := make([]*s.Job, 0)
+		if err := json.Unmarshal(recorder.Body.Bytes(), &jobs); err != nil {
+			t.Fatal(err)
+		}
+		ids := make([]string, len(jobs))
+		for idx, job := range jobs {
+			ids[idx] = job.Id
+		}
+		return ids
+	}
+
+	if ids := view("delayed"); len(ids) != 2 || ids[0] != "delayed" || ids[1] != "backed-off" {
+		t.Fatal("Expected delayed and backed-off, got", ids)
+	}
+	if ids := view("waiting"); len(ids) != 1 || ids[0] != "due" {
+		t.Fatal("Expected due, got", ids)
+	}
+}
@@ -0,0 +1,180 @@
+package server
+
+import (
+	"errors"
+	"fmt"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+
+	"taylor/lib/structs"
+)
+
+// upper limit for the number of children of a job array
+const ARRAY_MAX_SIZE = 10000
+
+var arrayParamName = regexp.MustCompile(`^[A-Za-z0-9_]+$`)
+
+// aggregated view on the children of a job array
+type ArrayStatus struct {
+	Id		string				`json:"id"`
+	Size		int				`json:"size"`
+	Status		structs.JobStatus		`json:"status"`
+	// number of children per status
+	Counts		map[structs.JobStatus]int	`json:"counts"`
+	// mean progress of the children
+	Progress	float32				`json:"progress"`
+	Jobs		[]string			`json:"jobs"`
+}
+
+// all combinations of the values of matrix. the last parameter (by name) changes fastest.
+// an empty matrix has a single (empty) combination
+func matrixCombinations(matrix map[string][]string) []map[string]string {
+	names := make([]string, 0, len(matrix))
+	for name := range matrix {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	combinations := []map[string]string{ map[string]string{} }
+	for _, name := range names {
+		next := make([]map[string]string, 0, len(combinations) * len(matrix[name]))
+		for _, combination := range combinations {
+			for _, value := range matrix[name] {
+				params := make(map[string]string, len(combination) + 1)
+				for k, v := range combination {
+					params[k] = v
+				}
+				params[name] = value
+				next = append(next, params)
+			}
+		}
+		combinations = next
+	}
+	return combinations
+}
+
+// parameters of every child of an array with count indices times the combinations of matrix
+func arrayParams(count int, matrix map[string][]string) ([]map[string]string, error) {
+	if count < 0 {
+		return nil, errors.New("Invalid Array Definition. Count must not be negative")
+	}
+	if count == 0 && len(matrix) == 0 {
+		return nil, errors.New("Invalid Array Definition. Count or Matrix required")
+	}
+	if count == 0 {
+		count = 1
+	}
+
+	size := count
+	for name, values := range matrix {
+		if arrayParamName.MatchString(name) == false || name == "index" {
+			return nil, errors.New(fmt.Sprintf("Invalid Array Definition. Invalid parameter name '%s'", name))
+		}
+		if len(values) == 0 {
+			return nil, errors.New(fmt.Sprintf("Invalid Array Definition. Parameter %s has no values", name))
+		}
+		size *= len(values)
+		if size > ARRAY_MAX_SIZE {
+			break
+		}
+	}
+	if size > ARRAY_MAX_SIZE {
+		return nil, errors.New(fmt.Sprintf("Invalid Array Definition. Array must not have more than %d children", ARRAY_MAX_SIZE))
+	}
+
+	combinations := matrixCombinations(matrix)
+	params := make([]map[string]string, 0, size)
+	for i := 0; i < count; i++ {
+		params = append(params, combinations...)
+	}
+	return params, nil
+}
+
+// replaces {{index}} (the array index of the child) and {{<param>}} in all strings of value.
+// returns a copy, value isn't modified
+func substituteParams(value interface{}, index int, params map[string]string) interface{} {
+	switch v := value.(type) {
+	case string:
+		v = strings.ReplaceAll(v, "{{index}}", strconv.Itoa(index))
+		for name, param := range params {
+			v = strings.ReplaceAll(v, "{{" + name + "}}", param)
+		}
+		return v
+	case []interface{}:
+		substituted := make([]interface{}, len(v))
+		for k, item := range v {
+			substituted[k] = substituteParams(item, index, params)
+		}
+		return substituted
+	case map[string]interface{}:
+		substituted := make(map[string]interface{}, len(v))
+		for k, item := range v {
+			substituted[k] = substituteParams(item, index, params)
+		}
+		return substituted
+	}
+	return value
+}
+
+// creates the children of an array from template
+func expandArray(template *structs.Job, arrayId string, params []map[string]string) []*structs.Job {
+	children := make([]*structs.Job, len(params))
+	for index, childParams := range params {
+		child := template.NewInstance()
+		child.RunAt = template.RunAt
+		child.ArrayId = arrayId
+		child.ArrayIndex = index
+		child.ArrayParams = childParams
+		child.DriverConfig, _ = substituteParams(template.DriverConfig, index, childParams).(map[string]interface{})
+		children[index] = child
+	}
+	return children
+}
+
+// status of the array as a whole: scheduled while a child runs, waiting while a child waits.
+// once all children are finished the worst outcome wins (error, timeout, cancel, success).
+// deleted children are ignored unless all of them are deleted
+func aggregateStatus(children []*structs.Job) structs.JobStatus {
+	counts := make(map[structs.JobStatus]int)
+	for _, child := range children {
+		counts[child.Status]++
+	}
+	for _, status := range []structs.JobStatus{
+		structs.JOB_STATUS_SCHEDULED,
+		structs.JOB_STATUS_WAITING,
+		structs.JOB_STATUS_ERROR,
+		structs.JOB_STATUS_TIMEOUT,
+		structs.JOB_STATUS_CANCEL,
+		structs.JOB_STATUS_INTERRUPT,
+		structs.JOB_STATUS_SUCCESS,
+	} {
+		if counts[status] > 0 {
+			if status == structs.JOB_STATUS_INTERRUPT {
+				return structs.JOB_STATUS_CANCEL
+			}
+			return status
+		}
+	}
+	return structs.JOB_STATUS_DELETE
+}
+
+func NewArrayStatus(arrayId string, children []*structs.Job) ArrayStatus {
+	status := ArrayStatus{
+		Id:		arrayId,
+		Size:		len(children),
+		Status:		aggregateStatus(children),
+		Counts:		make(map[structs.JobStatus]int),
+		Jobs:		make([]string, 0, len(children)),
+	}
+	for _, child := range children {
+		status.Counts[child.Status]++
+		status.Progress += child.Progress
+		status.Jobs = append(status.Jobs, child.Id)
+	}
+	if len(children) > 0 {
+		status.Progress /= float32(len(children))
+	}
+	return status
+}
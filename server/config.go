@@ -6,6 +6,9 @@ import (
 	"encoding/json"
 	"io/ioutil"
 	"errors"
+	"time"
+
+	"taylor/server/database"
 )
 
 type AddressConfig struct {
@@ -14,10 +17,115 @@ type AddressConfig struct {
 }
 
 
+type PreemptionConfig struct {
+	Enabled		bool		`json:"enabled"`
+	// a job only preempts jobs whose priority is at least this much lower
+	MinPriorityGap	uint		`json:"min_priority_gap"`
+	// time a preempted job gets to stop before it is killed
+	GraceMs		time.Duration	`json:"grace_ms"`
+}
+
+type FairShareConfig struct {
+	Enabled		bool			`json:"enabled"`
+	// usage older than this counts only half
+	HalfLifeMs	time.Duration		`json:"half_life_ms"`
+	// relative share of the cluster per tenant
+	Shares		map[string]float64	`json:"shares"`
+	// share of tenants that are not in shares
+	DefaultShare	float64			`json:"default_share"`
+}
+
+type QuotaConfig struct {
+	// maximal number of running jobs per tenant
+	Tenants		map[string]int	`json:"tenants"`
+	// maximal number of running jobs per identifier
+	Identifiers	map[string]int	`json:"identifiers"`
+	// maximal number of running jobs per concurrency key. keys that are not listed allow one job at a time
+	ConcurrencyKeys	map[string]int	`json:"concurrency_keys"`
+}
+
+type AgingConfig struct {
+	Enabled		bool		`json:"enabled"`
+	// a waiting job gains step priority every interval
+	IntervalMs	time.Duration	`json:"interval_ms"`
+	Step		uint		`json:"step"`
+	// maximal priority a job can gain by waiting. 0 means no limit
+	MaxBoost	uint		`json:"max_boost"`
+}
+
+type SchedulerConfig struct {
+	// scheduling passes are triggered by events. this is the maximal time between two passes
+	IntervalMs	time.Duration	`json:"interval_ms"`
+	// time an agent has to accept or reject an offer before the job is offered elsewhere
+	OfferTimeoutMs	time.Duration	`json:"offer_timeout_ms"`
+	// placement strategy for jobs (first, binpack, spread, gpu_best_fit or random)
+	Placement	string		`json:"placement"`
+	// placement strategy for jobs with gpu requirements
+	GpuPlacement	string		`json:"gpu_placement"`
+	Preemption	PreemptionConfig `json:"preemption"`
+	FairShare	FairShareConfig	`json:"fair_share"`
+	Quotas		QuotaConfig	`json:"quotas"`
+	Aging		AgingConfig	`json:"aging"`
+}
+
+type HaPeer struct {
+	// name of the server (see name of the server config)
+	Name		string		`json:"name"`
+	// address the servers replicate their store over
+	Raft		string		`json:"raft"`
+	Http		string		`json:"http"`
+	Tcp		string		`json:"tcp"`
+}
+
+type HaConfig struct {
+	Enabled		bool		`json:"enabled"`
+	// all servers of the cluster (including this one)
+	Peers		[]HaPeer	`json:"peers"`
+	// a new leader is elected when the current one hasn't been heard of for this long
+	HeartbeatTimeoutMs time.Duration `json:"heartbeat_timeout_ms"`
+	// time a write waits to be replicated before it fails
+	ApplyTimeoutMs	time.Duration	`json:"apply_timeout_ms"`
+}
+
+type HeartbeatConfig struct {
+	// time between two agent info requests to every agent
+	IntervalMs	time.Duration	`json:"interval_ms"`
+	// an agent that hasn't sent anything for this long is deregistered
+	TimeoutMs	time.Duration	`json:"timeout_ms"`
+}
+
+type DatabaseConfig struct {
+	// ql (default), sqlite or postgres
+	Backend		string		`json:"backend"`
+	// connection string of postgres. ql and sqlite default to a file in data_dir.
+	// the servers of a cluster need a database each, they replicate the writes themselves.
+	// they must all use the same backend, the replicated statements are written in its sql dialect
+	Dsn		string		`json:"dsn"`
+}
+
 type Config struct {
 	Addresses AddressConfig `json:"addresses"`
 	DataDir	  string	`json:"data_dir"`
 	Name	  string	`json:"name"`
+	// time we give agents to report a timed out job before we cancel it ourselves. running jobs are
+	// checked every sixth of it, but not more often than once a second
+	TimeoutGraceMs	time.Duration	`json:"timeout_grace_ms"`
+	// time an agent has to reconnect before the jobs it was running count as lost
+	NodeLostGraceMs	time.Duration	`json:"node_lost_grace_ms"`
+	Heartbeat	HeartbeatConfig	`json:"heartbeat"`
+	Scheduler	SchedulerConfig	`json:"scheduler"`
+	Ha		HaConfig	`json:"ha"`
+	Database	DatabaseConfig	`json:"database"`
+}
+
+// peer entry of this server
+func (c Config) HaSelf() (HaPeer, bool) {
+	for _, peer := range c.Ha.Peers {
+		if peer.Name == c.Name {
+			return peer, true
+		}
+	}
+	return HaPeer{}, false
 }
 
 func defaultName() (string, error) {
@@ -37,6 +145,43 @@ func DevModeConfig() Config {
 		},
 		DataDir: ".taylor-dev-temp/",
 		Name: name,
+		Database: DatabaseConfig{
+			Backend: database.BACKEND_QL,
+		},
+		TimeoutGraceMs: 30000,
+		NodeLostGraceMs: 30000,
+		Heartbeat: HeartbeatConfig{
+			IntervalMs: 1000,
+			TimeoutMs: 10000,
+		},
+		Scheduler: SchedulerConfig{
+			IntervalMs: 10000,
+			OfferTimeoutMs: 10000,
+			Placement: PLACEMENT_SPREAD,
+			GpuPlacement: PLACEMENT_BINPACK,
+			Preemption: PreemptionConfig{
+				Enabled: false,
+				MinPriorityGap: 10,
+				GraceMs: 30000,
+			},
+			FairShare: FairShareConfig{
+				Enabled: false,
+				HalfLifeMs: 24 * 60 * 60 * 1000,
+				Shares: make(map[string]float64),
+				DefaultShare: 1,
+			},
+			Quotas: QuotaConfig{
+				Tenants: make(map[string]int),
+				Identifiers: make(map[string]int),
+				ConcurrencyKeys: make(map[string]int),
+			},
+			Aging: AgingConfig{
+				Enabled: false,
+				IntervalMs: 60000,
+				Step: 1,
+				MaxBoost: 0,
+			},
+		},
 	}
 	return config
 }
@@ -60,15 +205,88 @@ func ReadConfig(path string) (Config, error) {
 	if config.Addresses.Tcp == "" {
 		config.Addresses.Tcp = "127.0.0.1:8401"
 	}
+	if config.Scheduler.IntervalMs == 0 {
+		config.Scheduler.IntervalMs = 10000
+	}
+	if config.Scheduler.OfferTimeoutMs == 0 {
+		config.Scheduler.OfferTimeoutMs = 10000
+	}
+	if config.Scheduler.Placement == "" {
+		config.Scheduler.Placement = PLACEMENT_SPREAD
+	}
+	if config.Scheduler.GpuPlacement == "" {
+		config.Scheduler.GpuPlacement = PLACEMENT_BINPACK
+	}
+	if config.Scheduler.Preemption.MinPriorityGap == 0 {
+		config.Scheduler.Preemption.MinPriorityGap = 10
+	}
+	if config.Scheduler.Preemption.GraceMs == 0 {
+		config.Scheduler.Preemption.GraceMs = 30000
+	}
+	if config.Scheduler.FairShare.HalfLifeMs == 0 {
+		config.Scheduler.FairShare.HalfLifeMs = 24 * 60 * 60 * 1000
+	}
+	if config.Scheduler.FairShare.DefaultShare <= 0 {
+		config.Scheduler.FairShare.DefaultShare = 1
+	}
+	if config.Scheduler.FairShare.Shares == nil {
+		config.Scheduler.FairShare.Shares = make(map[string]float64)
+	}
+	if config.Scheduler.Aging.IntervalMs == 0 {
+		config.Scheduler.Aging.IntervalMs = 60000
+	}
+	if config.Scheduler.Aging.Step == 0 {
+		config.Scheduler.Aging.Step = 1
+	}
+	if _, err := NewPlacement(config.Scheduler); err != nil {
+		return config, err
+	}
+	if config.TimeoutGraceMs == 0 {
+		config.TimeoutGraceMs = 30000
+	}
+	if config.NodeLostGraceMs == 0 {
+		config.NodeLostGraceMs = 30000
+	}
+	if config.Heartbeat.IntervalMs == 0 {
+		config.Heartbeat.IntervalMs = 1000
+	}
+	if config.Heartbeat.TimeoutMs == 0 {
+		config.Heartbeat.TimeoutMs = 10000
+	}
+	if config.Heartbeat.TimeoutMs <= config.Heartbeat.IntervalMs {
+		return config, errors.New("heartbeat.timeout_ms must be larger than heartbeat.interval_ms")
+	}
 	if config.DataDir == "" {
 		return config, errors.New("No data_dir specified")
 	}
+	switch (config.Database.Backend) {
+	case "":
+		config.Database.Backend = database.BACKEND_QL
+	case database.BACKEND_QL, database.BACKEND_SQLITE:
+	case database.BACKEND_POSTGRES:
+		if config.Database.Dsn == "" {
+			return config, errors.New("database.dsn is required for postgres")
+		}
+	default:
+		return config, errors.New(fmt.Sprintf("Unknown database.backend %s (ql, sqlite or postgres)", config.Database.Backend))
+	}
 	if config.Name == "" {
 		config.Name, err = defaultName()
 		if err != nil {
 			return config, err
 		}
 	}
+	if config.Ha.Enabled {
+		if self, in := config.HaSelf(); in == false || self.Raft == "" {
+			return config, errors.New(fmt.Sprintf("ha.peers has no raft address for %s", config.Name))
+		}
+		if config.Ha.HeartbeatTimeoutMs == 0 {
+			config.Ha.HeartbeatTimeoutMs = 1000
+		}
+		if config.Ha.ApplyTimeoutMs == 0 {
+			config.Ha.ApplyTimeoutMs = 10000
+		}
+	}
 
 	fmt.Printf("%+v\n", config)
 
@@ -0,0 +1,183 @@
+package server
+
+import (
+	"fmt"
+
+	"taylor/lib/structs"
+	"taylor/server/database"
+)
+
+type DependencyState int
+
+const (
+	// all upstream jobs finished successfully
+	DEPENDENCIES_DONE DependencyState = iota
+
+	// at least one upstream job is still waiting or running
+	DEPENDENCIES_PENDING
+
+	// at least one upstream job failed. the job will never be able to run
+	DEPENDENCIES_FAILED
+
+	// at least one upstream job has been cancelled. deleted upstream jobs count as cancelled,
+	// but jobs can't be deleted while others wait for them (see deleteJob)
+	DEPENDENCIES_CANCELLED
+)
+
+type GraphNode struct {
+	Id		string			`json:"id"`
+	Identifier	string			`json:"identifier"`
+	Status		structs.JobStatus	`json:"status"`
+}
+
+type GraphEdge struct {
+	From		string	`json:"from"`
+	To		string	`json:"to"`
+}
+
+type JobGraph struct {
+	JobId		string		`json:"job_id"`
+	Nodes		[]GraphNode	`json:"nodes"`
+	Edges		[]GraphEdge	`json:"edges"`
+}
+
+// checks the upstream jobs of job. lookup returns nil if a job doesn't exist (anymore).
+// returns the state and - if the dependencies can't be fulfilled anymore - the id of the
+// upstream job that is responsible for it
+func dependencyState(job *structs.Job, lookup func (id string) *structs.Job) (DependencyState, string) {
+	state := DEPENDENCIES_DONE
+	for _, depId := range job.DependsOn {
+		dep := lookup(depId)
+		if dep == nil {
+			return DEPENDENCIES_CANCELLED, depId
+		}
+		switch (dep.Status) {
+		case structs.JOB_STATUS_SUCCESS:
+			continue
+		case structs.JOB_STATUS_WAITING, structs.JOB_STATUS_SCHEDULED:
+			state = DEPENDENCIES_PENDING
+		case structs.JOB_STATUS_CANCEL, structs.JOB_STATUS_DELETE:
+			return DEPENDENCIES_CANCELLED, depId
+		default:
+			return DEPENDENCIES_FAILED, depId
+		}
+	}
+	return state, ""
+}
+
+// waiting jobs that depend on the job with id
+func waitingDependents(store database.JobStore, id string) ([]*structs.Job, error) {
+	waiting, err := store.JobsWithStatus(structs.JOB_STATUS_WAITING, 0)
+	if err != nil {
+		return nil, err
+	}
+	res := make([]*structs.Job, 0)
+	for _, job := range waiting {
+		for _, dep := range job.DependsOn {
+			if dep == id {
+				res = append(res, job)
+				break
+			}
+		}
+	}
+	return res, nil
+}
+
+// filters out all jobs whose upstream jobs aren't done yet. jobs whose upstream jobs
+// failed or have been cancelled are cascaded and will not be returned
+func (s *Scheduler) resolveDependencies(jobs []*structs.Job) []*structs.Job {
+	cache := make(map[string]*structs.Job)
+	for _, job := range jobs {
+		cache[job.Id] = job
+	}
+
+	lookup := func (id string) *structs.Job {
+		if job, in := cache[id]; in {
+			return job
+		}
+		job, err := s.store.JobById(id)
+		if err != nil {
+			fmt.Printf("Error looking up dependency %s: %v\n", id, err)
+			// treat as pending. we try again in next round
+			return &structs.Job{Id: id, Status: structs.JOB_STATUS_WAITING}
+		}
+		cache[id] = job
+		return job
+	}
+
+	ready := make([]*structs.Job, 0, len(jobs))
+	for _, job := range jobs {
+		if len(job.DependsOn) == 0 {
+			ready = append(ready, job)
+			continue
+		}
+
+		state, culprit := dependencyState(job, lookup)
+		switch (state) {
+		case DEPENDENCIES_DONE:
+			ready = append(ready, job)
+		case DEPENDENCIES_PENDING:
+			continue
+		case DEPENDENCIES_FAILED:
+			s.tcpServer.finishWaitingJob(job, structs.JOB_STATUS_ERROR, fmt.Sprintf("Upstream job %s failed", culprit))
+			// so that jobs further down in the same pass see it
+			job.Status = structs.JOB_STATUS_ERROR
+		case DEPENDENCIES_CANCELLED:
+			s.tcpServer.finishWaitingJob(job, structs.JOB_STATUS_CANCEL, fmt.Sprintf("Upstream job %s cancelled", culprit))
+			job.Status = structs.JOB_STATUS_CANCEL
+		}
+	}
+	return ready
+}
+
+// builds the connected graph of all upstream and downstream jobs of root.
+// edges point from the upstream job to the job depending on it
+func buildJobGraph(root *structs.Job, all []*structs.Job) JobGraph {
+	byId := make(map[string]*structs.Job, len(all)+1)
+	downstream := make(map[string][]string)
+	for _, job := range all {
+		byId[job.Id] = job
+		for _, dep := range job.DependsOn {
+			downstream[dep] = append(downstream[dep], job.Id)
+		}
+	}
+	byId[root.Id] = root
+
+	graph := JobGraph{
+		JobId: root.Id,
+		Nodes: make([]GraphNode, 0),
+		Edges: make([]GraphEdge, 0),
+	}
+
+	visited := make(map[string]bool)
+	queue := []string{root.Id}
+	for len(queue) > 0 {
+		id := queue[0]
+		queue = queue[1:]
+		if visited[id] {
+			continue
+		}
+		visited[id] = true
+
+		job, in := byId[id]
+		if in == false {
+			// upstream job that has been deleted
+			graph.Nodes = append(graph.Nodes, GraphNode{Id: id, Status: structs.JOB_STATUS_DELETE})
+			continue
+		}
+		graph.Nodes = append(graph.Nodes, GraphNode{
+			Id:		job.Id,
+			Identifier:	job.Identifier,
+			Status:		job.Status,
+		})
+
+		// every edge ends in a job that we visit, so adding the upstream edges is enough
+		for _, dep := range job.DependsOn {
+			graph.Edges = append(graph.Edges, GraphEdge{From: dep, To: job.Id})
+			queue = append(queue, dep)
+		}
+		queue = append(queue, downstream[job.Id]...)
+	}
+
+	return graph
+}
@@ -0,0 +1,116 @@
+package database
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+
+	_ "github.com/lib/pq"
+	_ "modernc.org/sqlite"
+)
+
+const (
+	BACKEND_QL		= "ql"
+	BACKEND_SQLITE		= "sqlite"
+	BACKEND_POSTGRES	= "postgres"
+)
+
+// the parts of sql that differ between the backends. the schema is written with the
+// types of ql (STRING, INT, BIGINT, FLOAT, BOOL), they are mapped to the ones of the backend
+type dialect struct {
+	// one of the BACKEND_ constants
+	name		string
+	// name of the database/sql driver
+	driver		string
+	types		map[string]string
+	// string literal
+	quote		func(str string) string
+	// query that returns the names of the columns of a table
+	columnsQuery	func(table string) string
+}
+
+func quoteSingle(str string) string {
+	return "'" + strings.ReplaceAll(str, "'", "''") + "'"
+}
+
+func dialectQl() *dialect {
+	return &dialect{
+		name:		BACKEND_QL,
+		driver:		"ql",
+		types:		map[string]string{},
+		quote:		strconv.Quote,
+		columnsQuery:	func(table string) string {
+			return fmt.Sprintf("SELECT Name FROM __Column WHERE TableName = %s", strconv.Quote(table))
+		},
+	}
+}
+
+func dialectSqlite() *dialect {
+	return &dialect{
+		name:		BACKEND_SQLITE,
+		driver:		"sqlite",
+		types:		map[string]string{
+			"STRING":	"TEXT",
+			"INT":		"INTEGER",
+			"BIGINT":	"INTEGER",
+			"FLOAT":	"REAL",
+			"BOOL":		"BOOLEAN",
+		},
+		quote:		quoteSingle,
+		columnsQuery:	func(table string) string {
+			return fmt.Sprintf("SELECT name FROM pragma_table_info(%s)", quoteSingle(table))
+		},
+	}
+}
+
+func dialectPostgres() *dialect {
+	return &dialect{
+		name:		BACKEND_POSTGRES,
+		driver:		"postgres",
+		types:		map[string]string{
+			"STRING":	"TEXT",
+			"INT":		"BIGINT",
+			"BIGINT":	"BIGINT",
+			"FLOAT":	"DOUBLE PRECISION",
+			"BOOL":		"BOOLEAN",
+		},
+		quote:		quoteSingle,
+		columnsQuery:	func(table string) string {
+			return fmt.Sprintf("SELECT column_name FROM information_schema.columns WHERE table_schema = current_schema() AND table_name = %s", quoteSingle(table))
+		},
+	}
+}
+
+func dialectOf(backend string) (*dialect, error) {
+	switch (backend) {
+	case BACKEND_QL, "":
+		return dialectQl(), nil
+	case BACKEND_SQLITE:
+		return dialectSqlite(), nil
+	case BACKEND_POSTGRES:
+		return dialectPostgres(), nil
+	default:
+		return nil, errors.New(fmt.Sprintf("Unknown database backend: %s", backend))
+	}
+}
+
+func (d *dialect) typ(qlType string) string {
+	if t, in := d.types[qlType]; in {
+		return t
+	}
+	return qlType
+}
+
+type column struct {
+	name	string
+	typ	string
+}
+
+func (d *dialect) createTableStmt(table string, columns []column) string {
+	defs := make([]string, len(columns))
+	for k, c := range columns {
+		defs[k] = c.name + " " + d.typ(c.typ)
+	}
+	return fmt.Sprintf("CREATE TABLE IF NOT EXISTS %s (\n\t\t%s\n\t);", table, strings.Join(defs, "\n\t\t,"))
+}
@@ -0,0 +1,41 @@
+package database
+
+import (
+	"taylor/lib/structs"
+)
+
+// everything the server keeps about jobs and schedules. Store implements it for the sql
+// backends, see Open. replication is not part of it (see ReplicatedStore)
+type JobStore interface {
+	InsertJob(job *structs.Job) (int, error)
+	// nil if there is no job with that id
+	JobById(id string) (*structs.Job, error)
+	// all jobs that are not deleted, oldest first. limit 0 means no limit
+	AllJobs(limit uint) ([]*structs.Job, error)
+	// oldest first. limit 0 means no limit
+	JobsWithStatus(status structs.JobStatus, limit uint) ([]*structs.Job, error)
+	JobsFromNodeWithStatus(nodeName string, status structs.JobStatus) ([]*structs.Job, error)
+	// ordered by rank
+	JobsInGang(gangId string) ([]*structs.Job, error)
+	// ordered by index
+	JobsInArray(arrayId string) ([]*structs.Job, error)
+
+	UpdateJobAgentName(id string, agentName string) error
+	UpdateJobStatus(id string, status structs.JobStatus) error
+	UpdateJobProgress(id string, progress float32) error
+	UpdateJobAttempts(id string, attempts []structs.JobAttempt) error
+	UpdateJobGpuIndices(id string, gpuIndices []int) error
+	// puts a job back to the queue: sets attempts and retry_at, clears agent, gpus and progress
+	// and sets the status to WAITING. all at once, so that a failure doesn't leave it half requeued
+	RequeueJob(id string, attempts []structs.JobAttempt, retryAt int64) error
+
+	InsertSchedule(schedule *structs.Schedule) error
+	// nil if there is no schedule with that id
+	ScheduleById(id string) (*structs.Schedule, error)
+	AllSchedules() ([]*structs.Schedule, error)
+	UpdateScheduleDefinition(schedule *structs.Schedule) error
+	UpdateScheduleRunState(id string, nextRunAt int64, lastRunAt int64, lastJobId string, queued int) error
+	DeleteSchedule(id string) error
+
+	Close() error
+}
@@ -0,0 +1,138 @@
+package database
+
+import (
+	"database/sql"
+	"fmt"
+
+	"taylor/lib/structs"
+)
+
+// applies write statements on all servers of a cluster (see server/ha.go)
+type Replicator interface {
+	// returns once stmt has been applied to the local store
+	Replicate(stmt string) error
+}
+
+// store whose writes are replicated as statements of its backend. a statement can only be
+// applied by a store of the same backend, so all servers of a cluster need the same one
+type ReplicatedStore interface {
+	JobStore
+	// name of the backend (e.g. BACKEND_QL)
+	Backend() string
+	SetReplicator(r Replicator)
+	Apply(index uint64, stmt string) error
+	AppliedIndex() (uint64, error)
+	Dump() (*Dump, error)
+	Restore(dump *Dump) error
+}
+
+var _ ReplicatedStore = &Store{}
+
+// content of the store at a position of the replicated log
+type Dump struct {
+	Index		uint64			`json:"index"`
+	Jobs		[]*structs.Job		`json:"jobs"`
+	Schedules	[]*structs.Schedule	`json:"schedules"`
+}
+
+// the replication table holds the index of the last statement of the replicated log that
+// has been applied. it stays 0 if the server doesn't run in a cluster
+func (s *Store) initReplication(tx *sql.Tx) error {
+	_, err := tx.Exec(s.d.createTableStmt("replication", []column{{ "applied_index", "BIGINT" }}))
+	if err != nil {
+		return err
+	}
+
+	var rows int
+	if err := tx.QueryRow("SELECT count(*) FROM replication").Scan(&rows); err != nil {
+		return err
+	}
+	if rows == 0 {
+		_, err = tx.Exec("INSERT INTO replication (applied_index) VALUES (0)")
+	}
+	return err
+}
+
+func (s *Store) Backend() string {
+	return s.d.name
+}
+
+// from now on, writes go through r instead of being executed right away
+func (s *Store) SetReplicator(r Replicator) {
+	s.replicator = r
+}
+
+func (s *Store) exec(stmt string) error {
+	if s.replicator != nil {
+		return s.replicator.Replicate(stmt)
+	}
+	return s.execLocal(stmt)
+}
+
+// executes stmts in a single transaction
+func (s *Store) execLocal(stmts ...string) error {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+
+	for _, stmt := range stmts {
+		if _, err := tx.Exec(stmt); err != nil {
+			tx.Rollback()
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+func (s *Store) AppliedIndex() (uint64, error) {
+	var index int64
+	err := s.db.QueryRow("SELECT applied_index FROM replication").Scan(&index)
+	return uint64(index), err
+}
+
+func setAppliedIndexStmt(index uint64) string {
+	return fmt.Sprintf("UPDATE replication SET applied_index = %d", index)
+}
+
+// executes a statement of the replicated log. statements up to the applied index are
+// skipped, they are already in the db (e.g. when the log is replayed after a restart)
+func (s *Store) Apply(index uint64, stmt string) error {
+	applied, err := s.AppliedIndex()
+	if err != nil {
+		return err
+	}
+	if index <= applied {
+		return nil
+	}
+	return s.execLocal(stmt, setAppliedIndexStmt(index))
+}
+
+func (s *Store) Dump() (*Dump, error) {
+	index, err := s.AppliedIndex()
+	if err != nil {
+		return nil, err
+	}
+	jobs, err := s.CollectQuery("SELECT * FROM jobs ORDER BY ts ASC")
+	if err != nil {
+		return nil, err
+	}
+	schedules, err := s.AllSchedules()
+	if err != nil {
+		return nil, err
+	}
+	return &Dump{Index: index, Jobs: jobs, Schedules: schedules}, nil
+}
+
+// replaces everything in the store with the content of dump
+func (s *Store) Restore(dump *Dump) error {
+	stmts := []string{"DELETE FROM jobs", "DELETE FROM schedules"}
+	for _, job := range dump.Jobs {
+		stmts = append(stmts, s.insertJobStmt(job))
+	}
+	for _, schedule := range dump.Schedules {
+		stmts = append(stmts, s.insertScheduleStmt(schedule))
+	}
+	stmts = append(stmts, setAppliedIndexStmt(dump.Index))
+	return s.execLocal(stmts...)
+}
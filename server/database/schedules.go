@@ -0,0 +1,157 @@
+package database
+
+import (
+	"fmt"
+
+	"taylor/lib/structs"
+)
+
+func schedulesColumns() []column {
+	return []column{
+		{ "id", "STRING" },
+		{ "name", "STRING" },
+		{ "cron", "STRING" },
+		{ "timezone", "STRING" },
+		{ "overlap_policy", "STRING" },
+		{ "enabled", "BOOL" },
+		{ "job", "STRING" },
+		{ "ts", "BIGINT" },
+		{ "next_run_at", "BIGINT" },
+		{ "last_run_at", "BIGINT" },
+		{ "last_job_id", "STRING" },
+		{ "queued", "INT" },
+	}
+}
+
+func (s *Store) insertScheduleStmt(schedule *structs.Schedule) string {
+	job, _ := encodeData(schedule.Job)
+	q := s.d.quote
+
+	query := fmt.Sprintf(`
+	INSERT INTO schedules (
+		id,
+		name,
+		cron,
+		timezone,
+		overlap_policy,
+		enabled,
+		job,
+		ts,
+		next_run_at,
+		last_run_at,
+		last_job_id,
+		queued
+	) VALUES (%s, %s, %s, %s, %s, %t, %s, %d, %d, %d, %s, %d)
+	`,
+		q(schedule.Id),
+		q(schedule.Name),
+		q(schedule.Cron),
+		q(schedule.Timezone),
+		q(schedule.OverlapPolicy),
+		schedule.Enabled,
+		q(job),
+		schedule.Timestamp,
+		schedule.NextRunAt,
+		schedule.LastRunAt,
+		q(schedule.LastJobId),
+		schedule.Queued,
+	)
+	return query
+}
+
+func (s *Store) InsertSchedule(schedule *structs.Schedule) error {
+	return s.exec(s.insertScheduleStmt(schedule))
+}
+
+func (s *Store) collectSchedules(query string) ([]*structs.Schedule, error) {
+	rows, err := s.db.Query(query)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	schedules := make([]*structs.Schedule, 0)
+	for rows.Next() {
+		var schedule structs.Schedule
+		var encodedJob string
+
+		err := rows.Scan(
+			&schedule.Id,
+			&schedule.Name,
+			&schedule.Cron,
+			&schedule.Timezone,
+			&schedule.OverlapPolicy,
+			&schedule.Enabled,
+			&encodedJob,
+			&schedule.Timestamp,
+			&schedule.NextRunAt,
+			&schedule.LastRunAt,
+			&schedule.LastJobId,
+			&schedule.Queued,
+		)
+		if err != nil {
+			return nil, err
+		}
+
+		if err := decodeDataInto(encodedJob, &schedule.Job); err != nil {
+			return nil, err
+		}
+
+		schedules = append(schedules, &schedule)
+	}
+
+	return schedules, nil
+}
+
+func (s *Store) ScheduleById(id string) (*structs.Schedule, error) {
+	schedules, err := s.collectSchedules(fmt.Sprintf("SELECT * FROM schedules WHERE id = %s;", s.d.quote(id)))
+	if err != nil {
+		return nil, err
+	}
+	if len(schedules) == 0 {
+		return nil, nil
+	}
+	return schedules[0], nil
+}
+
+func (s *Store) AllSchedules() ([]*structs.Schedule, error) {
+	return s.collectSchedules("SELECT * FROM schedules ORDER BY ts ASC")
+}
+
+// updates everything that can be changed via the api
+func (s *Store) UpdateScheduleDefinition(schedule *structs.Schedule) error {
+	job, _ := encodeData(schedule.Job)
+	q := s.d.quote
+
+	stmt := fmt.Sprintf(
+		"UPDATE schedules SET name = %s, cron = %s, timezone = %s, overlap_policy = %s, enabled = %t, job = %s, next_run_at = %d WHERE id = %s",
+		q(schedule.Name),
+		q(schedule.Cron),
+		q(schedule.Timezone),
+		q(schedule.OverlapPolicy),
+		schedule.Enabled,
+		q(job),
+		schedule.NextRunAt,
+		q(schedule.Id),
+	)
+
+	return s.exec(stmt)
+}
+
+// updates the bookkeeping of the schedule runner
+func (s *Store) UpdateScheduleRunState(id string, nextRunAt int64, lastRunAt int64, lastJobId string, queued int) error {
+	stmt := fmt.Sprintf(
+		"UPDATE schedules SET next_run_at = %d, last_run_at = %d, last_job_id = %s, queued = %d WHERE id = %s",
+		nextRunAt,
+		lastRunAt,
+		s.d.quote(lastJobId),
+		queued,
+		s.d.quote(id),
+	)
+
+	return s.exec(stmt)
+}
+
+func (s *Store) DeleteSchedule(id string) error {
+	return s.exec(fmt.Sprintf("DELETE FROM schedules WHERE id = %s", s.d.quote(id)))
+}
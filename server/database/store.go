@@ -12,8 +12,103 @@ import (
 	//"taylor/lib/util"
 )
 
+// JobStore backed by a sql database (see dialect.go for the supported ones)
 type Store struct {
 	db *sql.DB
+	d *dialect
+	// nil unless the server runs in a cluster
+	replicator Replicator
+}
+
+var _ JobStore = &Store{}
+
+type columnMigration struct {
+	column
+	def	string
+}
+
+// columns of the first version of the jobs table
+func jobsBaseColumns() []column {
+	return []column{
+		{ "id", "STRING" },
+		{ "identifier", "STRING" },
+		{ "status", "INT" },
+		{ "ts", "BIGINT" },
+		{ "agent_name", "STRING" },
+		{ "driver", "STRING" },
+		{ "driver_config", "STRING" },
+		{ "update_handlers", "STRING" },
+		{ "restrict", "STRING" },
+		{ "priority", "INT" },
+		{ "progress", "FLOAT" },
+		{ "user_data", "STRING" },
+		{ "gpu_requirement", "STRING" },
+	}
+}
+
+// columns that have been added after the jobs table was created the first time.
+// new tables get them right away. they must stay in this order because we rely on
+// SELECT * returning the columns in that order.
+func jobsMigrations(d *dialect) []columnMigration {
+	emptyList, _ := encodeData(make([]string, 0))
+	noRetry, _ := encodeData(structs.RetryPolicy{})
+	noResources, _ := encodeData(structs.ResourceRequirement{})
+	noAffinity, _ := encodeData(structs.Affinity{})
+	noParams, _ := encodeData(map[string]string{})
+	return []columnMigration{
+		{ column{ "depends_on", "STRING" }, d.quote(emptyList) },
+		{ column{ "retry", "STRING" }, d.quote(noRetry) },
+		{ column{ "attempts", "STRING" }, d.quote(emptyList) },
+		{ column{ "retry_at", "BIGINT" }, "0" },
+		{ column{ "timeout", "BIGINT" }, "0" },
+		{ column{ "schedule_id", "STRING" }, d.quote("") },
+		{ column{ "run_at", "BIGINT" }, "0" },
+		{ column{ "placement", "STRING" }, d.quote("") },
+		{ column{ "resources", "STRING" }, d.quote(noResources) },
+		{ column{ "gpu_indices", "STRING" }, d.quote(emptyList) },
+		{ column{ "preemptible", "BOOL" }, "false" },
+		{ column{ "tenant", "STRING" }, d.quote("default") },
+		{ column{ "concurrency_key", "STRING" }, d.quote("") },
+		{ column{ "gang_id", "STRING" }, d.quote("") },
+		{ column{ "gang_rank", "INT" }, "0" },
+		{ column{ "gang_size", "INT" }, "0" },
+		{ column{ "affinity", "STRING" }, d.quote(noAffinity) },
+		{ column{ "selector", "STRING" }, d.quote("") },
+		{ column{ "array_id", "STRING" }, d.quote("") },
+		{ column{ "array_index", "INT" }, "0" },
+		{ column{ "array_params", "STRING" }, d.quote(noParams) },
+	}
+}
+
+func (s *Store) migrate(tx *sql.Tx, table string, migrations []columnMigration) error {
+	rows, err := tx.Query(s.d.columnsQuery(table))
+	if err != nil {
+		return err
+	}
+	existing := make(map[string]bool)
+	for rows.Next() {
+		var name string
+		if err := rows.Scan(&name); err != nil {
+			rows.Close()
+			return err
+		}
+		existing[name] = true
+	}
+	rows.Close()
+
+	for _, m := range migrations {
+		if existing[m.name] == true {
+			continue
+		}
+		fmt.Printf("migrate table %s: add column %s\n", table, m.name)
+		if _, err := tx.Exec(fmt.Sprintf("ALTER TABLE %s ADD %s %s", table, m.name, s.d.typ(m.typ))); err != nil {
+			return err
+		}
+		if _, err := tx.Exec(fmt.Sprintf("UPDATE %s SET %s = %s", table, m.name, m.def)); err != nil {
+			return err
+		}
+	}
+	return nil
 }
 
 func (s *Store) init() error {
@@ -22,23 +117,26 @@ func (s *Store) init() error {
 		return err
 	}
 
-	_, err = tx.Exec(`
-	CREATE TABLE IF NOT EXISTS jobs (
-		id STRING
-		,identifier STRING
-		,status INT
-		,ts BIGINT
-		,agent_name STRING
-		,driver STRING
-		,driver_config STRING
-		,update_handlers STRING
-		,restrict STRING
-		,priority INT
-		,progress FLOAT
-		,user_data STRING
-		,gpu_requirement STRING
-	);
-	`)
+	jobsColumns := jobsBaseColumns()
+	for _, m := range jobsMigrations(s.d) {
+		jobsColumns = append(jobsColumns, m.column)
+	}
+	_, err = tx.Exec(s.d.createTableStmt("jobs", jobsColumns))
+	if err != nil {
+		return err
+	}
+
+	_, err = tx.Exec(s.d.createTableStmt("schedules", schedulesColumns()))
+	if err != nil {
+		return err
+	}
+
+	err = s.migrate(tx, "jobs", jobsMigrations(s.d))
+	if err != nil {
+		return err
+	}
+
+	err = s.initReplication(tx)
 	if err != nil {
 		return err
 	}
@@ -50,17 +148,27 @@ func (s *Store) init() error {
 	return nil
 }
 
-func Open(dbPath string) (*Store, error) {
+// opens the store of backend (BACKEND_QL if empty). dsn is the path of the db file for ql and
+// sqlite and the connection string for postgres. ql ("memory://<name>") and sqlite (":memory:")
+// can keep everything in memory
+func Open(backend string, dsn string) (*Store, error) {
+	d, err := dialectOf(backend)
+	if err != nil {
+		return nil, err
+	}
 
 	ql.RegisterDriver()
 
-	store := &Store{}
+	store := &Store{d: d}
 
-	dbh, err := sql.Open("ql", dbPath)
+	dbh, err := sql.Open(d.driver, dsn)
 	if err != nil {
-		dbh.Close()
 		return nil, err
 	}
+	if d.driver == "sqlite" {
+		// sqlite has a single writer anyway. and every connection to :memory: would get its own db
+		dbh.SetMaxOpenConns(1)
+	}
 
 	store.db = dbh
 
@@ -73,6 +181,10 @@ func Open(dbPath string) (*Store, error) {
 	return store, nil
 }
 
+func (s *Store) Close() error {
+	return s.db.Close()
+}
+
 func encodeData(data interface{}) (string, error) {
 	js, err := json.Marshal(data)
 	if err != nil {
@@ -95,17 +207,28 @@ func decodeData(data string) (interface{}, error) {
 	return decoded, nil
 }
 
-func (s *Store) InsertJob(job *structs.Job) (int, error) {
-	tx, err := s.db.Begin()
+func decodeDataInto(data string, v interface{}) error {
+	hsJson, err := base64.RawStdEncoding.DecodeString(data)
 	if err != nil {
-		return 0, err
+		return err
 	}
+	return json.Unmarshal(hsJson, v)
+}
 
+func (s *Store) insertJobStmt(job *structs.Job) string {
 	driverConfig, _ := encodeData(job.DriverConfig)
 	updateHandlers, _ := encodeData(job.UpdateHandlers)
 	restrict, _ := encodeData(job.Restrict)
 	userData, _ := encodeData(job.UserData)
 	gpuRequirement, _ := encodeData(job.GpuRequirement)
+	dependsOn, _ := encodeData(job.DependsOn)
+	retry, _ := encodeData(job.Retry)
+	attempts, _ := encodeData(job.Attempts)
+	resources, _ := encodeData(job.Resources)
+	gpuIndices, _ := encodeData(job.GpuIndices)
+	affinity, _ := encodeData(job.Affinity)
+	arrayParams, _ := encodeData(job.ArrayParams)
+	q := s.d.quote
 
 	query := fmt.Sprintf(`
 	INSERT INTO jobs (
@@ -122,35 +245,72 @@ func (s *Store) InsertJob(job *structs.Job) (int, error) {
 		progress,
 		user_data,
 		gpu_requirement,
-	) VALUES ("%s", "%s", %d, %d, "%s", "%s", "%s", "%s", "%s", %d, %f, "%s", "%s")
+		depends_on,
+		retry,
+		attempts,
+		retry_at,
+		timeout,
+		schedule_id,
+		run_at,
+		placement,
+		resources,
+		gpu_indices,
+		preemptible,
+		tenant,
+		concurrency_key,
+		gang_id,
+		gang_rank,
+		gang_size,
+		affinity,
+		selector,
+		array_id,
+		array_index,
+		array_params
+	) VALUES (%s, %s, %d, %d, %s, %s, %s, %s, %s, %d, %f, %s, %s, %s, %s, %s, %d, %d, %s, %d, %s, %s, %s, %t, %s, %s, %s, %d, %d, %s, %s, %s, %d, %s)
 	`,
-		job.Id,
-		job.Identifier,
+		q(job.Id),
+		q(job.Identifier),
 		job.Status,
 		job.Timestamp,
-		job.AgentName,
-		job.Driver,
-		string(driverConfig),
-		string(updateHandlers),
-		string(restrict),
+		q(job.AgentName),
+		q(job.Driver),
+		q(driverConfig),
+		q(updateHandlers),
+		q(restrict),
 		job.Priority,
 		job.Progress,
-		string(userData),
-		string(gpuRequirement),
+		q(userData),
+		q(gpuRequirement),
+		q(dependsOn),
+		q(retry),
+		q(attempts),
+		job.RetryAt,
+		job.Timeout,
+		q(job.ScheduleId),
+		job.RunAt,
+		q(job.Placement),
+		q(resources),
+		q(gpuIndices),
+		job.Preemptible,
+		q(job.Tenant),
+		q(job.ConcurrencyKey),
+		q(job.GangId),
+		job.GangRank,
+		job.GangSize,
+		q(affinity),
+		q(job.Selector),
+		q(job.ArrayId),
+		job.ArrayIndex,
+		q(arrayParams),
 	)
 
 	//fmt.Println(query)
 
-	_, err = tx.Exec(query)
-	if err != nil {
-		return 0, err
-	}
+	return query
+}
 
-	err = tx.Commit()
-	if err != nil {
-		return 0, err
-	}
-	return 0, nil
+func (s *Store) InsertJob(job *structs.Job) (int, error) {
+	return 0, s.exec(s.insertJobStmt(job))
 }
 
 func (s *Store) IterQuery(query string, fun func (job *structs.Job)) error {
@@ -168,6 +328,13 @@ func (s *Store) IterQuery(query string, fun func (job *structs.Job)) error {
 		var encodedRestrict string
 		var encodedUserData string
 		var encodedGpuReq string
+		var encodedDependsOn string
+		var encodedRetry string
+		var encodedAttempts string
+		var encodedResources string
+		var encodedGpuIndices string
+		var encodedAffinity string
+		var encodedArrayParams string
 
 		err := rows.Scan(
 			&job.Id,
@@ -183,6 +350,27 @@ func (s *Store) IterQuery(query string, fun func (job *structs.Job)) error {
 			&job.Progress,
 			&encodedUserData,
 			&encodedGpuReq,
+			&encodedDependsOn,
+			&encodedRetry,
+			&encodedAttempts,
+			&job.RetryAt,
+			&job.Timeout,
+			&job.ScheduleId,
+			&job.RunAt,
+			&job.Placement,
+			&encodedResources,
+			&encodedGpuIndices,
+			&job.Preemptible,
+			&job.Tenant,
+			&job.ConcurrencyKey,
+			&job.GangId,
+			&job.GangRank,
+			&job.GangSize,
+			&encodedAffinity,
+			&job.Selector,
+			&job.ArrayId,
+			&job.ArrayIndex,
+			&encodedArrayParams,
 		)
 		if err != nil {
 			return err
@@ -253,6 +441,36 @@ func (s *Store) IterQuery(query string, fun func (job *structs.Job)) error {
 		job.UserData = userData
 		job.GpuRequirement = gpuReqs
 
+		job.DependsOn = make([]string, 0)
+		decodeDataInto(encodedDependsOn, &job.DependsOn)
+		if job.DependsOn == nil {
+			job.DependsOn = make([]string, 0)
+		}
+
+		decodeDataInto(encodedRetry, &job.Retry)
+
+		job.Attempts = make([]structs.JobAttempt, 0)
+		decodeDataInto(encodedAttempts, &job.Attempts)
+		if job.Attempts == nil {
+			job.Attempts = make([]structs.JobAttempt, 0)
+		}
+
+		decodeDataInto(encodedResources, &job.Resources)
+
+		job.GpuIndices = make([]int, 0)
+		decodeDataInto(encodedGpuIndices, &job.GpuIndices)
+		if job.GpuIndices == nil {
+			job.GpuIndices = make([]int, 0)
+		}
+
+		decodeDataInto(encodedAffinity, &job.Affinity)
+
+		job.ArrayParams = make(map[string]string)
+		decodeDataInto(encodedArrayParams, &job.ArrayParams)
+		if job.ArrayParams == nil {
+			job.ArrayParams = make(map[string]string)
+		}
+
 		fun(&job)
 	}
 
@@ -271,7 +489,7 @@ func (s *Store) CollectQuery(query string) ([]*structs.Job, error) {
 }
 
 func (s *Store) JobById(id string) (*structs.Job, error) {
-	q := fmt.Sprintf("SELECT * FROM jobs WHERE id = \"%s\";", id)
+	q := fmt.Sprintf("SELECT * FROM jobs WHERE id = %s;", s.d.quote(id))
 
 	jobs, err := s.CollectQuery(q)
 	if err != nil {
@@ -298,7 +516,23 @@ func (s *Store) AllJobs(limit uint) ([]*structs.Job, error) {
 
 func (s *Store) JobsFromNodeWithStatus(nodeName string, status structs.JobStatus) ([]*structs.Job, error) {
 
-	query := fmt.Sprintf("SELECT * FROM jobs WHERE agent_name = \"%s\" AND status = %d ORDER BY ts ASC", nodeName, int(status))
+	query := fmt.Sprintf("SELECT * FROM jobs WHERE agent_name = %s AND status = %d ORDER BY ts ASC", s.d.quote(nodeName), int(status))
+
+	return s.CollectQuery(query)
+}
+
+// all members of a gang ordered by rank
+func (s *Store) JobsInGang(gangId string) ([]*structs.Job, error) {
+
+	query := fmt.Sprintf("SELECT * FROM jobs WHERE gang_id = %s ORDER BY gang_rank ASC", s.d.quote(gangId))
+
+	return s.CollectQuery(query)
+}
+
+// all children of a job array ordered by index
+func (s *Store) JobsInArray(arrayId string) ([]*structs.Job, error) {
+
+	query := fmt.Sprintf("SELECT * FROM jobs WHERE array_id = %s ORDER BY array_index ASC", s.d.quote(arrayId))
 
 	return s.CollectQuery(query)
 }
@@ -315,61 +549,42 @@ func (s *Store) JobsWithStatus(status structs.JobStatus, limit uint) ([]*structs
 }
 
 func (s *Store) UpdateJobAgentName(id string, agentName string) error {
-	tx, err := s.db.Begin()
-	if err != nil {
-		return err
-	}
+	q := fmt.Sprintf("UPDATE jobs SET agent_name = %s WHERE id = %s", s.d.quote(agentName), s.d.quote(id))
 
-	q := fmt.Sprintf("UPDATE jobs SET agent_name = \"%s\" WHERE id = \"%s\"", agentName, id)
+	return s.exec(q)
+}
 
-	_, err = tx.Exec(q)
-	if err != nil {
-		return err
-	}
+func (s *Store) UpdateJobStatus(id string, status structs.JobStatus) error {
+	q := fmt.Sprintf("UPDATE jobs SET status = %d WHERE id = %s", int(status), s.d.quote(id))
 
-	err = tx.Commit()
-	if err != nil {
-		return err
-	}
-	return nil
+	return s.exec(q)
 }
 
-func (s *Store) UpdateJobStatus(id string, status structs.JobStatus) error {
-	tx, err := s.db.Begin()
-	if err != nil {
-		return err
-	}
+func (s *Store) UpdateJobProgress(id string, progress float32) error {
+	q := fmt.Sprintf("UPDATE jobs SET progress = %f WHERE id = %s", progress, s.d.quote(id))
 
-	q := fmt.Sprintf("UPDATE jobs SET status = %d WHERE id = \"%s\"", int(status), id)
+	return s.exec(q)
+}
 
-	_, err = tx.Exec(q)
-	if err != nil {
-		return err
-	}
+func (s *Store) UpdateJobAttempts(id string, attempts []structs.JobAttempt) error {
+	encoded, _ := encodeData(attempts)
+	q := fmt.Sprintf("UPDATE jobs SET attempts = %s WHERE id = %s", s.d.quote(encoded), s.d.quote(id))
 
-	err = tx.Commit()
-	if err != nil {
-		return err
-	}
-	return nil
+	return s.exec(q)
 }
 
-func (s *Store) UpdateJobProgress(id string, progress float32) error {
-	tx, err := s.db.Begin()
-	if err != nil {
-		return err
-	}
+func (s *Store) UpdateJobGpuIndices(id string, gpuIndices []int) error {
+	encoded, _ := encodeData(gpuIndices)
+	q := fmt.Sprintf("UPDATE jobs SET gpu_indices = %s WHERE id = %s", s.d.quote(encoded), s.d.quote(id))
 
-	q := fmt.Sprintf("UPDATE jobs SET progress = %f WHERE id = \"%s\"", progress, id)
+	return s.exec(q)
+}
 
-	_, err = tx.Exec(q)
-	if err != nil {
-		return err
-	}
+func (s *Store) RequeueJob(id string, attempts []structs.JobAttempt, retryAt int64) error {
+	encodedAttempts, _ := encodeData(attempts)
+	encodedGpuIndices, _ := encodeData(make([]int, 0))
+	q := fmt.Sprintf("UPDATE jobs SET attempts = %s, retry_at = %d, progress = %f, agent_name = %s, gpu_indices = %s, status = %d WHERE id = %s",
+		s.d.quote(encodedAttempts), retryAt, float32(0), s.d.quote(""), s.d.quote(encodedGpuIndices), int(structs.JOB_STATUS_WAITING), s.d.quote(id))
 
-	err = tx.Commit()
-	if err != nil {
-		return err
-	}
-	return nil
+	return s.exec(q)
 }
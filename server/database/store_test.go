@@ -0,0 +1,409 @@
+package database
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"os"
+	"strings"
+	"testing"
+
+	s "taylor/lib/structs"
+)
+
+// every backend has to pass the same tests. postgres is skipped unless TAYLOR_TEST_POSTGRES_DSN
+// points to a database the tests may drop the tables of (see make test-postgres)
+type conformanceBackend struct {
+	backend		string
+	// dsn of an empty database
+	emptyDsn	func(t *testing.T) string
+}
+
+func conformanceBackends() []conformanceBackend {
+	memName := func(t *testing.T) string {
+		return strings.ReplaceAll(t.Name(), "/", "_")
+	}
+	backends := []conformanceBackend{
+		{
+			backend: BACKEND_QL,
+			emptyDsn: func(t *testing.T) string {
+				return "memory://" + memName(t)
+			},
+		},
+		{
+			backend: BACKEND_SQLITE,
+			emptyDsn: func(t *testing.T) string {
+				return fmt.Sprintf("file:%s?mode=memory&cache=shared", memName(t))
+			},
+		},
+	}
+
+	return append(backends, conformanceBackend{
+		backend: BACKEND_POSTGRES,
+		emptyDsn: func(t *testing.T) string {
+			pgDsn := os.Getenv("TAYLOR_TEST_POSTGRES_DSN")
+			if pgDsn == "" {
+				t.Skip("TAYLOR_TEST_POSTGRES_DSN not set")
+			}
+			db, err := sql.Open("postgres", pgDsn)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer db.Close()
+			for _, table := range []string{"jobs", "schedules", "replication"} {
+				if _, err := db.Exec("DROP TABLE IF EXISTS " + table); err != nil {
+					t.Fatal(err)
+				}
+			}
+			return pgDsn
+		},
+	})
+}
+
+func runConformance(t *testing.T, test func(t *testing.T, backend conformanceBackend, store JobStore)) {
+	for _, backend := range conformanceBackends() {
+		t.Run(backend.backend, func(t *testing.T) {
+			store, err := Open(backend.backend, backend.emptyDsn(t))
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer store.Close()
+			test(t, backend, store)
+		})
+	}
+}
+
+func testJob(identifier string, ts int64) *s.Job {
+	job := s.NewJob(identifier, "exec", map[string]interface{}{"cmd": "echo"}, []s.UpdateHandler{}, []string{}, 10, []s.GpuRequirement{}, map[string]interface{}{}, []string{}, s.RetryPolicy{}, 0)
+	job.Timestamp = ts
+	return job
+}
+
+func mustInsert(t *testing.T, store JobStore, jobs ...*s.Job) {
+	for _, job := range jobs {
+		if _, err := store.InsertJob(job); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func assertJson(t *testing.T, actual interface{}, expected interface{}) {
+	a, _ := json.Marshal(actual)
+	e, _ := json.Marshal(expected)
+	if string(a) != string(e) {
+		t.Errorf("\n%s\n!=\n%s", a, e)
+	}
+}
+
+func assertIdentifiers(t *testing.T, jobs []*s.Job, expected ...string) {
+	identifiers := make([]string, len(jobs))
+	for k, job := range jobs {
+		identifiers[k] = job.Identifier
+	}
+	if strings.Join(identifiers, ",") != strings.Join(expected, ",") {
+		t.Errorf("%v != %v", identifiers, expected)
+	}
+}
+
+func TestStoreJobRoundTrip(t *testing.T) {
+	runConformance(t, func(t *testing.T, backend conformanceBackend, store JobStore) {
+		job := testJob(`quotes ' " \ and ünïcode`, 42)
+		job.Status = s.JOB_STATUS_SCHEDULED
+		job.AgentName = "agent'1"
+		job.DriverConfig = map[string]interface{}{"cmd": "sh", "args": []interface{}{"-c", "echo 'hi'"}}
+		job.UpdateHandlers = []s.UpdateHandler{{Type: "http", OnEventList: []string{"done"}, Config: map[string]interface{}{"url": "http://x"}}}
+		job.Restrict = []string{"linux"}
+		job.GpuRequirement = []s.GpuRequirement{{MemoryAvailable: 1024, Type: "nvidia"}}
+		job.Progress = 0.5
+		job.UserData = map[string]interface{}{"owner": "o'brien"}
+		job.DependsOn = []string{"a", "b"}
+		job.Retry = s.RetryPolicy{MaxAttempts: 3, BackoffMs: 100, BackoffFactor: 2, RetryOn: []string{s.RETRY_ON_NODE_LOST}}
+		job.Attempts = []s.JobAttempt{{Attempt: 1, AgentName: "agent'1", StartedAt: 1, EndedAt: 2, Status: s.JOB_STATUS_ERROR, Reason: "it's broken", GpuIndices: []int{}}}
+		job.RetryAt = 7
+		job.Timeout = 60
+		job.ScheduleId = "schedule"
+		job.RunAt = 8
+		job.Placement = "binpack"
+		job.Resources = s.ResourceRequirement{Cpu: 2, MemoryMB: 512}
+		job.GpuIndices = []int{0, 3}
+		job.Preemptible = true
+		job.Tenant = "team'a"
+		job.ConcurrencyKey = "key"
+		job.GangId = "gang"
+		job.GangRank = 1
+		job.GangSize = 2
+		job.Affinity = s.Affinity{Nodes: []string{"n1"}}
+		job.Selector = "zone in (a, b)"
+		job.ArrayId = "array"
+		job.ArrayIndex = 4
+		job.ArrayParams = map[string]string{"lr": "0.1"}
+		mustInsert(t, store, job)
+
+		stored, err := store.JobById(job.Id)
+		if err != nil {
+			t.Fatal(err)
+		}
+		assertJson(t, stored, job)
+
+		missing, err := store.JobById("missing")
+		if err != nil || missing != nil {
+			t.Errorf("expected no job, got %v (%v)", missing, err)
+		}
+	})
+}
+
+func TestStoreJobQueries(t *testing.T) {
+	runConformance(t, func(t *testing.T, backend conformanceBackend, store JobStore) {
+		waiting1 := testJob("waiting1", 1)
+		waiting2 := testJob("waiting2", 3)
+		deleted := testJob("deleted", 2)
+		deleted.Status = s.JOB_STATUS_DELETE
+		onA := testJob("onA", 4)
+		onA.Status = s.JOB_STATUS_SCHEDULED
+		onA.AgentName = "a"
+		onB := testJob("onB", 5)
+		onB.Status = s.JOB_STATUS_SCHEDULED
+		onB.AgentName = "b"
+		downstream := testJob("downstream", 6)
+		downstream.DependsOn = []string{waiting1.Id}
+		gang1 := testJob("gang1", 8)
+		gang1.GangId, gang1.GangRank = "g", 1
+		gang0 := testJob("gang0", 9)
+		gang0.GangId, gang0.GangRank = "g", 0
+		array1 := testJob("array1", 10)
+		array1.ArrayId, array1.ArrayIndex = "arr", 1
+		array0 := testJob("array0", 11)
+		array0.ArrayId, array0.ArrayIndex = "arr", 0
+		mustInsert(t, store, waiting2, deleted, waiting1, onB, onA, downstream, gang1, gang0, array1, array0)
+
+		all, err := store.AllJobs(0)
+		if err != nil {
+			t.Fatal(err)
+		}
+		assertIdentifiers(t, all, "waiting1", "waiting2", "onA", "onB", "downstream", "gang1", "gang0", "array1", "array0")
+
+		limited, _ := store.AllJobs(2)
+		assertIdentifiers(t, limited, "waiting1", "waiting2")
+
+		scheduled, _ := store.JobsWithStatus(s.JOB_STATUS_SCHEDULED, 0)
+		assertIdentifiers(t, scheduled, "onA", "onB")
+		firstWaiting, _ := store.JobsWithStatus(s.JOB_STATUS_WAITING, 1)
+		assertIdentifiers(t, firstWaiting, "waiting1")
+
+		fromA, _ := store.JobsFromNodeWithStatus("a", s.JOB_STATUS_SCHEDULED)
+		assertIdentifiers(t, fromA, "onA")
+		fromAWaiting, _ := store.JobsFromNodeWithStatus("a", s.JOB_STATUS_WAITING)
+		assertIdentifiers(t, fromAWaiting)
+
+		gang, _ := store.JobsInGang("g")
+		assertIdentifiers(t, gang, "gang0", "gang1")
+		array, _ := store.JobsInArray("arr")
+		assertIdentifiers(t, array, "array0", "array1")
+	})
+}
+
+func TestStoreJobUpdates(t *testing.T) {
+	runConformance(t, func(t *testing.T, backend conformanceBackend, store JobStore) {
+		job := testJob("job", 1)
+		other := testJob("other", 2)
+		mustInsert(t, store, job, other)
+
+		attempts := []s.JobAttempt{{Attempt: 1, AgentName: "a", Status: s.JOB_STATUS_INTERRUPT, Reason: "preempted", GpuIndices: []int{1}}}
+		for _, err := range []error{
+			store.UpdateJobAgentName(job.Id, "a"),
+			store.UpdateJobStatus(job.Id, s.JOB_STATUS_SCHEDULED),
+			store.UpdateJobProgress(job.Id, 0.25),
+			store.UpdateJobAttempts(job.Id, attempts),
+			store.UpdateJobGpuIndices(job.Id, []int{1}),
+		} {
+			if err != nil {
+				t.Fatal(err)
+			}
+		}
+
+		job.AgentName = "a"
+		job.Status = s.JOB_STATUS_SCHEDULED
+		job.Progress = 0.25
+		job.Attempts = attempts
+		job.GpuIndices = []int{1}
+		stored, _ := store.JobById(job.Id)
+		assertJson(t, stored, job)
+
+		// the other job is left alone
+		storedOther, _ := store.JobById(other.Id)
+		assertJson(t, storedOther, other)
+
+		requeued := append(attempts, s.JobAttempt{Attempt: 2, AgentName: "b", Status: s.JOB_STATUS_ERROR})
+		if err := store.RequeueJob(job.Id, requeued, 123); err != nil {
+			t.Fatal(err)
+		}
+		job.AgentName = ""
+		job.Status = s.JOB_STATUS_WAITING
+		job.Progress = 0
+		job.Attempts = requeued
+		job.GpuIndices = []int{}
+		job.RetryAt = 123
+		stored, _ = store.JobById(job.Id)
+		assertJson(t, stored, job)
+		storedOther, _ = store.JobById(other.Id)
+		assertJson(t, storedOther, other)
+	})
+}
+
+func TestStoreSchedules(t *testing.T) {
+	runConformance(t, func(t *testing.T, backend conformanceBackend, store JobStore) {
+		schedule := &s.Schedule{
+			Id:		"schedule1",
+			Name:		"nightly 'backup'",
+			Cron:		"0 3 * * *",
+			Timezone:	"Europe/Berlin",
+			OverlapPolicy:	s.OVERLAP_QUEUE,
+			Enabled:	true,
+			Job:		*testJob("backup", 0),
+			Timestamp:	1,
+			NextRunAt:	2,
+		}
+		second := &s.Schedule{Id: "schedule2", Name: "second", Cron: "* * * * *", OverlapPolicy: s.OVERLAP_SKIP, Job: *testJob("second", 0), Timestamp: 2}
+		for _, schedule := range []*s.Schedule{second, schedule} {
+			if err := store.InsertSchedule(schedule); err != nil {
+				t.Fatal(err)
+			}
+		}
+
+		stored, err := store.ScheduleById(schedule.Id)
+		if err != nil {
+			t.Fatal(err)
+		}
+		assertJson(t, stored, schedule)
+
+		schedule.Name = "weekly"
+		schedule.Enabled = false
+		schedule.NextRunAt = 20
+		if err := store.UpdateScheduleDefinition(schedule); err != nil {
+			t.Fatal(err)
+		}
+		if err := store.UpdateScheduleRunState(schedule.Id, 30, 25, "job'1", 2); err != nil {
+			t.Fatal(err)
+		}
+		schedule.NextRunAt, schedule.LastRunAt, schedule.LastJobId, schedule.Queued = 30, 25, "job'1", 2
+		stored, _ = store.ScheduleById(schedule.Id)
+		assertJson(t, stored, schedule)
+
+		all, _ := store.AllSchedules()
+		assertJson(t, all, []*s.Schedule{schedule, second})
+
+		if err := store.DeleteSchedule(second.Id); err != nil {
+			t.Fatal(err)
+		}
+		deleted, err := store.ScheduleById(second.Id)
+		if err != nil || deleted != nil {
+			t.Errorf("expected no schedule, got %v (%v)", deleted, err)
+		}
+	})
+}
+
+type recordingReplicator struct {
+	stmts	[]string
+}
+
+func (r *recordingReplicator) Replicate(stmt string) error {
+	r.stmts = append(r.stmts, stmt)
+	return nil
+}
+
+func TestStoreReplication(t *testing.T) {
+	runConformance(t, func(t *testing.T, backend conformanceBackend, jobStore JobStore) {
+		store := jobStore.(ReplicatedStore)
+		if store.Backend() != backend.backend {
+			t.Errorf("backend %s != %s", store.Backend(), backend.backend)
+		}
+		job := testJob("job", 1)
+		mustInsert(t, store, job)
+		store.InsertSchedule(&s.Schedule{Id: "schedule", Job: *testJob("template", 0)})
+
+		// writes go through the replicator and are applied once
+		replicator := &recordingReplicator{}
+		store.SetReplicator(replicator)
+		store.UpdateJobStatus(job.Id, s.JOB_STATUS_SUCCESS)
+		if len(replicator.stmts) != 1 {
+			t.Fatalf("expected 1 replicated statement, got %d", len(replicator.stmts))
+		}
+		for _, index := range []uint64{1, 1} {
+			if err := store.Apply(index, replicator.stmts[0]); err != nil {
+				t.Fatal(err)
+			}
+		}
+		applied, _ := store.AppliedIndex()
+		if applied != 1 {
+			t.Errorf("applied index %d != 1", applied)
+		}
+
+		dump, err := store.Dump()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if dump.Index != 1 || len(dump.Jobs) != 1 || dump.Jobs[0].Status != s.JOB_STATUS_SUCCESS || len(dump.Schedules) != 1 {
+			t.Fatalf("unexpected dump %+v", dump)
+		}
+
+		// restore replaces everything
+		mustInsert(t, store, testJob("gone", 2))
+		if err := store.Restore(dump); err != nil {
+			t.Fatal(err)
+		}
+		restored, _ := store.Dump()
+		assertJson(t, restored, dump)
+	})
+}
+
+func TestStoreMigratesOldJobsTable(t *testing.T) {
+	for _, backend := range conformanceBackends() {
+		t.Run(backend.backend, func(t *testing.T) {
+			d, _ := dialectOf(backend.backend)
+			dsn := backend.emptyDsn(t)
+
+			// the raw handle keeps the in memory dbs alive until the store is opened
+			db, err := sql.Open(d.driver, dsn)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer db.Close()
+
+			job := testJob("old", 1)
+			encoded := make([]string, 5)
+			for k, v := range []interface{}{job.DriverConfig, job.UpdateHandlers, job.Restrict, job.UserData, job.GpuRequirement} {
+				encoded[k], _ = encodeData(v)
+			}
+			tx, err := db.Begin()
+			if err != nil {
+				t.Fatal(err)
+			}
+			tx.Exec(d.createTableStmt("jobs", jobsBaseColumns()))
+			_, err = tx.Exec(fmt.Sprintf(
+				"INSERT INTO jobs VALUES (%s, %s, 0, 1, %s, %s, %s, %s, %s, 10, 0.0, %s, %s)",
+				d.quote(job.Id), d.quote(job.Identifier), d.quote(""), d.quote(job.Driver),
+				d.quote(encoded[0]), d.quote(encoded[1]), d.quote(encoded[2]), d.quote(encoded[3]), d.quote(encoded[4]),
+			))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if err := tx.Commit(); err != nil {
+				t.Fatal(err)
+			}
+
+			store, err := Open(backend.backend, dsn)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer store.Close()
+
+			stored, err := store.JobById(job.Id)
+			if err != nil {
+				t.Fatal(err)
+			}
+			// the added columns have their defaults
+			job.Tenant = "default"
+			assertJson(t, stored, job)
+		})
+	}
+}
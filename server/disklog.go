@@ -6,17 +6,20 @@ import (
 	"bufio"
 	"errors"
 	"path"
+	"sync"
 
 	"taylor/lib/structs"
 )
 
 type DiskLog struct {
+	mtx		*sync.Mutex
 	dir		string
 	files		map[string]*os.File
 }
 
 func NewDiskLog(dir string) *DiskLog {
 	return &DiskLog{
+		mtx:	&sync.Mutex{},
 		dir:	dir,
 		files:  make(map[string]*os.File, 0),
 	}
@@ -26,11 +29,15 @@ func (d *DiskLog) makeLogfilePath(job *structs.Job) string {
 }
 
 func (d *DiskLog) Open(job *structs.Job) error {
+	d.mtx.Lock()
+	defer d.mtx.Unlock()
+
 	_, in := d.files[job.Id]
 	if in == true {
 		return errors.New(fmt.Sprintf("Log already open for job: %s\n", job.Id))
 	}
-	f, err := os.Create(d.makeLogfilePath(job))
+	// append, so that retries of a job keep the logs of former attempts
+	f, err := os.OpenFile(d.makeLogfilePath(job), os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
 	if err != nil {
 		return err
 	}
@@ -39,6 +46,9 @@ func (d *DiskLog) Open(job *structs.Job) error {
 }
 
 func (d *DiskLog) WriteString(job *structs.Job, str string) (int, error) {
+	d.mtx.Lock()
+	defer d.mtx.Unlock()
+
 	f, in := d.files[job.Id]
 	if in == false {
 		return 0, errors.New(fmt.Sprintf("No open log for job: %s\n", job.Id))
@@ -47,6 +57,9 @@ func (d *DiskLog) WriteString(job *structs.Job, str string) (int, error) {
 }
 
 func (d *DiskLog) Close(job *structs.Job) error {
+	d.mtx.Lock()
+	defer d.mtx.Unlock()
+
 	f, in := d.files[job.Id]
 	if in == false {
 		return errors.New(fmt.Sprintf("No open log for job: %s\n", job.Id))
@@ -56,6 +69,21 @@ func (d *DiskLog) Close(job *structs.Job) error {
 	return nil
 }
 
+// flushes and closes all logs. used on shutdown, the logs of jobs that are still running
+// are opened again on the next start
+func (d *DiskLog) CloseAll() {
+	d.mtx.Lock()
+	defer d.mtx.Unlock()
+
+	for jobId, f := range d.files {
+		if err := f.Sync(); err != nil {
+			fmt.Fprintf(os.Stderr, "Error flushing log of job %s: %v\n", jobId, err)
+		}
+		f.Close()
+		delete(d.files, jobId)
+	}
+}
+
 func (d *DiskLog) GetLogs(job *structs.Job) ([]string, error) {
 	lines := []string{}
 
@@ -0,0 +1,168 @@
+package server
+
+import (
+	"fmt"
+	"sort"
+
+	"taylor/lib/structs"
+	"taylor/lib/util"
+)
+
+// filters of distribute that can rule out a node
+const (
+	FILTER_CORDONED		= "cordoned"
+	FILTER_CAPACITY		= "capacity"
+	FILTER_CAPABILITIES	= "capabilities"
+	FILTER_SELECTOR		= "selector"
+	FILTER_AFFINITY		= "affinity"
+	FILTER_ANTI_AFFINITY	= "anti_affinity"
+	FILTER_RESOURCES	= "resources"
+	FILTER_GPU_COUNT	= "gpu_count"
+	FILTER_GPU_TYPE		= "gpu_type"
+	FILTER_GPU_MEMORY	= "gpu_memory"
+)
+
+type NodeExplanation struct {
+	Node		string	`json:"node"`
+	Fits		bool	`json:"fits"`
+	// first filter that rejected the node. empty if the job fits
+	RejectedBy	string	`json:"rejected_by"`
+	Reason		string	`json:"reason"`
+}
+
+// what the scheduler would do with a job right now
+type Explanation struct {
+	JobId		string			`json:"job_id"`
+	Status		structs.JobStatus	`json:"status"`
+	// why the last scheduling pass didn't place the job (if it was waiting)
+	BlockedReason	string			`json:"blocked_reason"`
+	// quota the job would exceed. empty if none
+	Quota		string			`json:"quota"`
+	Nodes		[]NodeExplanation	`json:"nodes"`
+	// node the job would go to if it was scheduled now. empty if it doesn't fit anywhere or exceeds a quota
+	Placement	string			`json:"placement"`
+	GpuIndices	[]int			`json:"gpu_indices"`
+}
+
+// gpus of node that are not pinned to a job
+func freeGpus(node *Node) []structs.GpuInfo {
+	reserved := make(map[int]bool, len(node.GpusReserved))
+	for _, k := range node.GpusReserved {
+		reserved[k] = true
+	}
+	free := make([]structs.GpuInfo, 0, len(node.GpuInfo))
+	for k, gpuInfo := range node.GpuInfo {
+		if reserved[k] == false {
+			free = append(free, gpuInfo)
+		}
+	}
+	return free
+}
+
+// tells which of the gpu requirements the node can't fulfill
+func explainGpus(node *Node, gpuReqs []structs.GpuRequirement) (string, string) {
+	free := freeGpus(node)
+	if len(free) < len(gpuReqs) {
+		return FILTER_GPU_COUNT, fmt.Sprintf("Node has %d free gpus, job needs %d", len(free), len(gpuReqs))
+	}
+	for _, gpuReq := range gpuReqs {
+		if gpuReq.Type == "" {
+			continue
+		}
+		found := false
+		for _, gpuInfo := range free {
+			found = found || gpuInfo.NameGPU == gpuReq.Type
+		}
+		if found == false {
+			return FILTER_GPU_TYPE, fmt.Sprintf("Node has no free gpu of type %s", gpuReq.Type)
+		}
+	}
+	return FILTER_GPU_MEMORY, "Node has not enough free gpus with the required memory"
+}
+
+// runs the filters of distribute (in the same order) against a single node
+func explainNode(node *Node, job *structs.Job, selector jobSelector) NodeExplanation {
+	reject := func (filter string, reason string) NodeExplanation {
+		return NodeExplanation{Node: node.Name, RejectedBy: filter, Reason: reason}
+	}
+
+	if node.IsCordoned() {
+		return reject(FILTER_CORDONED, "Node is cordoned or draining")
+	}
+	if node.Capacity <= node.JobsRunning {
+		return reject(FILTER_CAPACITY, fmt.Sprintf("Node runs %d of %d jobs", node.JobsRunning, node.Capacity))
+	}
+	if util.IsSubsetString(job.Restrict, node.Capabilities) == false {
+		return reject(FILTER_CAPABILITIES, fmt.Sprintf("Node has capabilities %v, job needs %v", node.Capabilities, job.Restrict))
+	}
+	if selector.matches(node) == false {
+		return reject(FILTER_SELECTOR, fmt.Sprintf("Labels %v don't match '%s'", node.Labels, job.Selector))
+	}
+	if nodeAllowed(node, job) == false {
+		return reject(FILTER_AFFINITY, "Node is not one of the pinned nodes or is avoided")
+	}
+	if antiAffinityConflict(node, job) {
+		return reject(FILTER_ANTI_AFFINITY, fmt.Sprintf("Node runs %v, job avoids %v", node.Identifiers, job.Affinity.AntiAffinity))
+	}
+	if node.Resources.Fulfills(job.Resources) == false {
+		return reject(FILTER_RESOURCES, fmt.Sprintf("Node has %.2f cpu and %d MB left, job needs %.2f cpu and %d MB",
+			node.Resources.CpuAllocatable, node.Resources.MemoryAllocatableMB, job.Resources.Cpu, job.Resources.MemoryMB))
+	}
+	if len(job.GpuRequirement) > 0 && matchGpus(node, job.GpuRequirement) == nil {
+		filter, reason := explainGpus(node, job.GpuRequirement)
+		return reject(filter, reason)
+	}
+	return NodeExplanation{Node: node.Name, Fits: true}
+}
+
+// nodes as a scheduling pass sees them: with the offers that haven't been answered
+// yet and the identifiers of the jobs that run on them
+func (s *Scheduler) clusterState(running []*structs.Job, pending map[string][]*structs.Job) []*Node {
+	nodes := nodesWithPendingOffers(s.tcpServer.Nodes(), pending)
+	addRunningIdentifiers(nodes, running)
+	return nodes
+}
+
+// dry run of the scheduler for job. nothing gets offered
+func (s *Scheduler) Explain(job *structs.Job) (*Explanation, error) {
+	running, err := s.store.JobsWithStatus(structs.JOB_STATUS_SCHEDULED, 0)
+	if err != nil {
+		return nil, err
+	}
+	pending := s.tcpServer.Offers().PendingPerNode()
+	nodes := s.clusterState(running, pending)
+
+	explanation := &Explanation{
+		JobId:		job.Id,
+		Status:		job.Status,
+		BlockedReason:	s.BlockedReason(job.Id),
+		Nodes:		make([]NodeExplanation, 0, len(nodes)),
+		GpuIndices:	make([]int, 0),
+	}
+
+	quotas := NewQuotaUsage(s.config.Scheduler.Quotas, activeJobs(running, pending))
+	if quotas.Admit(job) == false {
+		explanation.Quota = quotas.Blocked()[job.Id]
+	}
+
+	selector := selectorOf(job)
+	proxyNodes := make([]*Node, len(nodes))
+	for idx, node := range nodes {
+		proxyNodes[idx] = copyNode(node)
+		explanation.Nodes = append(explanation.Nodes, explainNode(node, job, selector))
+	}
+	sort.Slice(explanation.Nodes[:], func (i int, j int) bool {
+		return explanation.Nodes[i].Node < explanation.Nodes[j].Node
+	})
+
+	if explanation.Quota != "" {
+		return explanation, nil
+	}
+	if njm := placeJob(proxyNodes, job, s.placement); njm != nil {
+		explanation.Placement = njm.node.Name
+		if njm.gpus != nil {
+			explanation.GpuIndices = njm.gpus
+		}
+	}
+	return explanation, nil
+}
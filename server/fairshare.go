@@ -0,0 +1,171 @@
+package server
+
+import (
+	"math"
+	"sort"
+	"sync"
+	"time"
+
+	"taylor/server/database"
+	"taylor/lib/structs"
+)
+
+// jobs without tenant belong to this one
+const DEFAULT_TENANT = "default"
+
+type tenantUsage struct {
+	// decayed slot-seconds at asOf (ms)
+	value	float64
+	asOf	int64
+}
+
+// recent usage (slot-seconds) of each tenant. old usage decays with the configured half-life
+type UsageTracker struct {
+	mtx		*sync.Mutex
+	usage		map[string]*tenantUsage
+	halfLife	time.Duration
+}
+
+func NewUsageTracker(halfLife time.Duration) *UsageTracker {
+	return &UsageTracker{
+		mtx:		&sync.Mutex{},
+		usage:		make(map[string]*tenantUsage),
+		halfLife:	halfLife,
+	}
+}
+
+func (t *UsageTracker) decay(value float64, elapsedMs int64) float64 {
+	if elapsedMs <= 0 || t.halfLife <= 0 {
+		return value
+	}
+	return value * math.Pow(0.5, float64(elapsedMs) / float64(t.halfLife / time.Millisecond))
+}
+
+// adds slotSeconds of usage that happened at atMs
+func (t *UsageTracker) Add(tenant string, slotSeconds float64, atMs int64) {
+	t.mtx.Lock()
+	defer t.mtx.Unlock()
+
+	u, in := t.usage[tenant]
+	if in == false {
+		u = &tenantUsage{asOf: atMs}
+		t.usage[tenant] = u
+	}
+	if atMs >= u.asOf {
+		u.value = t.decay(u.value, atMs - u.asOf) + slotSeconds
+		u.asOf = atMs
+	} else {
+		u.value += t.decay(slotSeconds, u.asOf - atMs)
+	}
+}
+
+// adds the usage of the last attempt of job if it is finished
+func (t *UsageTracker) AddAttempt(job *structs.Job, attempts []structs.JobAttempt) {
+	if len(attempts) == 0 {
+		return
+	}
+	last := attempts[len(attempts)-1]
+	if last.EndedAt == 0 || last.EndedAt <= last.StartedAt {
+		return
+	}
+	t.Add(job.Tenant, float64(last.EndedAt - last.StartedAt) / 1000.0, last.EndedAt)
+}
+
+// decayed usage of finished attempts per tenant at nowMs
+func (t *UsageTracker) Usage(nowMs int64) map[string]float64 {
+	t.mtx.Lock()
+	defer t.mtx.Unlock()
+
+	res := make(map[string]float64, len(t.usage))
+	for tenant, u := range t.usage {
+		res[tenant] = t.decay(u.value, nowMs - u.asOf)
+	}
+	return res
+}
+
+// usage including the jobs that are running right now
+func (t *UsageTracker) UsageWithRunning(running []*structs.Job, nowMs int64) map[string]float64 {
+	usage := t.Usage(nowMs)
+	for _, job := range running {
+		if len(job.Attempts) == 0 {
+			continue
+		}
+		startedAt := job.Attempts[len(job.Attempts)-1].StartedAt
+		if startedAt < nowMs {
+			usage[job.Tenant] += float64(nowMs - startedAt) / 1000.0
+		}
+	}
+	return usage
+}
+
+// restores the usage from the attempts of all jobs (e.g. after a restart)
+func (t *UsageTracker) Rebuild(store database.JobStore) error {
+	jobs, err := store.AllJobs(0)
+	if err != nil {
+		return err
+	}
+	for _, job := range jobs {
+		for idx := range job.Attempts {
+			t.AddAttempt(job, job.Attempts[:idx+1])
+		}
+	}
+	return nil
+}
+
+func (cfg FairShareConfig) shareOf(tenant string) float64 {
+	if share, in := cfg.Shares[tenant]; in && share > 0 {
+		return share
+	}
+	return cfg.DefaultShare
+}
+
+// orders jobs so that tenants get dispatched according to their shares. within a priority,
+// tenants take turns (weighted by share). tenants that used less than their share go first
+func fairShareOrder(jobs []*structs.Job, usage map[string]float64, cfg FairShareConfig) []*structs.Job {
+	sort.SliceStable(jobs[:], func (i int, j int) bool {
+		return priorityOf(jobs[i]) > priorityOf(jobs[j])
+	})
+
+	res := make([]*structs.Job, 0, len(jobs))
+	for start := 0; start < len(jobs); {
+		end := start
+		for end < len(jobs) && priorityOf(jobs[end]) == priorityOf(jobs[start]) {
+			end++
+		}
+
+		queues := make(map[string][]*structs.Job)
+		tenants := make([]string, 0)
+		maxShare := 0.0
+		for _, job := range jobs[start:end] {
+			if _, in := queues[job.Tenant]; in == false {
+				tenants = append(tenants, job.Tenant)
+				maxShare = math.Max(maxShare, cfg.shareOf(job.Tenant))
+			}
+			queues[job.Tenant] = append(queues[job.Tenant], job)
+		}
+
+		sort.SliceStable(tenants[:], func (i int, j int) bool {
+			return usage[tenants[i]] / cfg.shareOf(tenants[i]) < usage[tenants[j]] / cfg.shareOf(tenants[j])
+		})
+
+		// weighted round robin. the tenant with the biggest share gets one job per round.
+		// everyone gets one in the first round
+		credit := make(map[string]float64)
+		for _, tenant := range tenants {
+			credit[tenant] = 1 - cfg.shareOf(tenant) / maxShare
+		}
+		for left := end - start; left > 0; {
+			for _, tenant := range tenants {
+				credit[tenant] += cfg.shareOf(tenant) / maxShare
+				for credit[tenant] >= 1 - 1e-9 && len(queues[tenant]) > 0 {
+					res = append(res, queues[tenant][0])
+					queues[tenant] = queues[tenant][1:]
+					credit[tenant]--
+					left--
+				}
+			}
+		}
+		start = end
+	}
+	return res
+}
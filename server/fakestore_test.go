@@ -0,0 +1,317 @@
+package server
+
+import (
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"os"
+	"sort"
+	"sync"
+	"testing"
+	"time"
+
+	s "taylor/lib/structs"
+	"taylor/server/database"
+)
+
+// in memory JobStore for tests. hands out copies like the sql stores do
+type fakeStore struct {
+	mtx		sync.Mutex
+	jobs		[]*s.Job
+	schedules	[]*s.Schedule
+	// InsertJob fails once this many jobs are in. -1 never fails
+	failInsertAt	int
+	// JobsWithStatus fails
+	failQueries	bool
+}
+
+var _ database.JobStore = &fakeStore{}
+
+func newFakeStore(jobs ...*s.Job) *fakeStore {
+	store := &fakeStore{failInsertAt: -1}
+	for _, job := range jobs {
+		store.InsertJob(job)
+	}
+	return store
+}
+
+func copyJob(job *s.Job) *s.Job {
+	data, _ := json.Marshal(job)
+	res := &s.Job{}
+	json.Unmarshal(data, res)
+	return res
+}
+
+func copySchedule(schedule *s.Schedule) *s.Schedule {
+	data, _ := json.Marshal(schedule)
+	res := &s.Schedule{}
+	json.Unmarshal(data, res)
+	return res
+}
+
+func (f *fakeStore) find(id string) *s.Job {
+	for _, job := range f.jobs {
+		if job.Id == id {
+			return job
+		}
+	}
+	return nil
+}
+
+func (f *fakeStore) filter(keep func (job *s.Job) bool, limit uint) []*s.Job {
+	res := make([]*s.Job, 0)
+	for _, job := range f.jobs {
+		if keep(job) {
+			res = append(res, copyJob(job))
+		}
+	}
+	sort.SliceStable(res[:], func (i int, j int) bool {
+		return res[i].Timestamp < res[j].Timestamp
+	})
+	if limit > 0 && uint(len(res)) > limit {
+		res = res[:limit]
+	}
+	return res
+}
+
+func (f *fakeStore) update(id string, fun func (job *s.Job)) error {
+	f.mtx.Lock()
+	defer f.mtx.Unlock()
+
+	job := f.find(id)
+	if job == nil {
+		return errors.New("No job with id " + id)
+	}
+	fun(job)
+	return nil
+}
+
+func (f *fakeStore) InsertJob(job *s.Job) (int, error) {
+	f.mtx.Lock()
+	defer f.mtx.Unlock()
+
+	if f.failInsertAt >= 0 && len(f.jobs) >= f.failInsertAt {
+		return 0, errors.New("Insert failed")
+	}
+	f.jobs = append(f.jobs, copyJob(job))
+	return len(f.jobs), nil
+}
+
+func (f *fakeStore) JobById(id string) (*s.Job, error) {
+	f.mtx.Lock()
+	defer f.mtx.Unlock()
+
+	if job := f.find(id); job != nil {
+		return copyJob(job), nil
+	}
+	return nil, nil
+}
+
+func (f *fakeStore) AllJobs(limit uint) ([]*s.Job, error) {
+	f.mtx.Lock()
+	defer f.mtx.Unlock()
+
+	return f.filter(func (job *s.Job) bool {
+		return job.Status != s.JOB_STATUS_DELETE
+	}, limit), nil
+}
+
+func (f *fakeStore) JobsWithStatus(status s.JobStatus, limit uint) ([]*s.Job, error) {
+	f.mtx.Lock()
+	defer f.mtx.Unlock()
+
+	if f.failQueries {
+		return nil, errors.New("Query failed")
+	}
+
+	return f.filter(func (job *s.Job) bool {
+		return job.Status == status
+	}, limit), nil
+}
+
+func (f *fakeStore) JobsFromNodeWithStatus(nodeName string, status s.JobStatus) ([]*s.Job, error) {
+	f.mtx.Lock()
+	defer f.mtx.Unlock()
+
+	return f.filter(func (job *s.Job) bool {
+		return job.AgentName == nodeName && job.Status == status
+	}, 0), nil
+}
+
+func (f *fakeStore) JobsInGang(gangId string) ([]*s.Job, error) {
+	f.mtx.Lock()
+	defer f.mtx.Unlock()
+
+	res := f.filter(func (job *s.Job) bool {
+		return job.GangId == gangId
+	}, 0)
+	sort.SliceStable(res[:], func (i int, j int) bool {
+		return res[i].GangRank < res[j].GangRank
+	})
+	return res, nil
+}
+
+func (f *fakeStore) JobsInArray(arrayId string) ([]*s.Job, error) {
+	f.mtx.Lock()
+	defer f.mtx.Unlock()
+
+	res := f.filter(func (job *s.Job) bool {
+		return job.ArrayId == arrayId
+	}, 0)
+	sort.SliceStable(res[:], func (i int, j int) bool {
+		return res[i].ArrayIndex < res[j].ArrayIndex
+	})
+	return res, nil
+}
+
+func (f *fakeStore) UpdateJobAgentName(id string, agentName string) error {
+	return f.update(id, func (job *s.Job) { job.AgentName = agentName })
+}
+
+func (f *fakeStore) UpdateJobStatus(id string, status s.JobStatus) error {
+	return f.update(id, func (job *s.Job) { job.Status = status })
+}
+
+func (f *fakeStore) UpdateJobProgress(id string, progress float32) error {
+	return f.update(id, func (job *s.Job) { job.Progress = progress })
+}
+
+func (f *fakeStore) UpdateJobAttempts(id string, attempts []s.JobAttempt) error {
+	return f.update(id, func (job *s.Job) { job.Attempts = append([]s.JobAttempt{}, attempts...) })
+}
+
+func (f *fakeStore) UpdateJobGpuIndices(id string, gpuIndices []int) error {
+	return f.update(id, func (job *s.Job) { job.GpuIndices = append([]int{}, gpuIndices...) })
+}
+
+func (f *fakeStore) RequeueJob(id string, attempts []s.JobAttempt, retryAt int64) error {
+	return f.update(id, func (job *s.Job) {
+		job.Attempts = append([]s.JobAttempt{}, attempts...)
+		job.RetryAt = retryAt
+		job.Progress = 0
+		job.AgentName = ""
+		job.GpuIndices = []int{}
+		job.Status = s.JOB_STATUS_WAITING
+	})
+}
+
+func (f *fakeStore) findSchedule(id string) (int, *s.Schedule) {
+	for idx, schedule := range f.schedules {
+		if schedule.Id == id {
+			return idx, schedule
+		}
+	}
+	return -1, nil
+}
+
+func (f *fakeStore) InsertSchedule(schedule *s.Schedule) error {
+	f.mtx.Lock()
+	defer f.mtx.Unlock()
+
+	f.schedules = append(f.schedules, copySchedule(schedule))
+	return nil
+}
+
+func (f *fakeStore) ScheduleById(id string) (*s.Schedule, error) {
+	f.mtx.Lock()
+	defer f.mtx.Unlock()
+
+	if _, schedule := f.findSchedule(id); schedule != nil {
+		return copySchedule(schedule), nil
+	}
+	return nil, nil
+}
+
+func (f *fakeStore) AllSchedules() ([]*s.Schedule, error) {
+	f.mtx.Lock()
+	defer f.mtx.Unlock()
+
+	res := make([]*s.Schedule, len(f.schedules))
+	for idx, schedule := range f.schedules {
+		res[idx] = copySchedule(schedule)
+	}
+	return res, nil
+}
+
+func (f *fakeStore) UpdateScheduleDefinition(schedule *s.Schedule) error {
+	f.mtx.Lock()
+	defer f.mtx.Unlock()
+
+	idx, _ := f.findSchedule(schedule.Id)
+	if idx < 0 {
+		return errors.New("No schedule with id " + schedule.Id)
+	}
+	f.schedules[idx] = copySchedule(schedule)
+	return nil
+}
+
+func (f *fakeStore) UpdateScheduleRunState(id string, nextRunAt int64, lastRunAt int64, lastJobId string, queued int) error {
+	f.mtx.Lock()
+	defer f.mtx.Unlock()
+
+	_, schedule := f.findSchedule(id)
+	if schedule == nil {
+		return errors.New("No schedule with id " + id)
+	}
+	schedule.NextRunAt = nextRunAt
+	schedule.LastRunAt = lastRunAt
+	schedule.LastJobId = lastJobId
+	schedule.Queued = queued
+	return nil
+}
+
+func (f *fakeStore) DeleteSchedule(id string) error {
+	f.mtx.Lock()
+	defer f.mtx.Unlock()
+
+	if idx, _ := f.findSchedule(id); idx >= 0 {
+		f.schedules = append(f.schedules[:idx], f.schedules[idx+1:]...)
+	}
+	return nil
+}
+
+func (f *fakeStore) Close() error {
+	return nil
+}
+
+// a tcp server without listener and agents. the log dir is removed by the returned func
+func newTestTcpServer(t *testing.T, store database.JobStore) (*TcpServer, func()) {
+	dir, err := ioutil.TempDir("", "taylor")
+	if err != nil {
+		t.Fatal(err)
+	}
+	tcpServer := &TcpServer{
+		nodes:		make(map[string]*Node),
+		nodesMtx:	&sync.RWMutex{},
+		store:		store,
+		cliChan:	make(chan NodeMsgPair, 50),
+		config:		Config{},
+		diskLog:	NewDiskLog(dir),
+		trigger:	NewTrigger(),
+		offers:		NewOfferTable(time.Second),
+		preemptions:	NewPreemptionTable(time.Second),
+		usage:		NewUsageTracker(time.Hour),
+		maintenance:	NewMaintenanceTable(),
+		disconnected:	NewDisconnectTable(),
+		timeouts:	NewTimeoutTable(),
+		shutdownMtx:	&sync.Mutex{},
+		readLoops:	&sync.WaitGroup{},
+	}
+	return tcpServer, func() {
+		tcpServer.diskLog.CloseAll()
+		os.RemoveAll(dir)
+	}
+}
+
+func newTestScheduler(tcpServer *TcpServer) *Scheduler {
+	placement, _ := NewPlacement(tcpServer.config.Scheduler)
+	return &Scheduler{
+		placement:	placement,
+		trigger:	tcpServer.trigger,
+		store:		tcpServer.store,
+		tcpServer:	tcpServer,
+		config:		tcpServer.config,
+		blockedMtx:	&sync.Mutex{},
+		blocked:	make(map[string]string),
+	}
+}
@@ -0,0 +1,316 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path"
+	"strings"
+	"sync"
+	"time"
+
+	"taylor/server/database"
+	"github.com/gin-gonic/gin"
+	"github.com/hashicorp/raft"
+	raftboltdb "github.com/hashicorp/raft-boltdb/v2"
+)
+
+// server of a cluster. the write statements of the store are replicated with raft, so
+// every server has all jobs. only the leader listens for agents, schedules and serves the
+// api. the others redirect api requests to it
+type HaNode struct {
+	config		Config
+	raft		*raft.Raft
+	transport	*raft.NetworkTransport
+	logStore	*raftboltdb.BoltStore
+	leaderCh	chan bool
+	// backend of the store. the replicated statements are written in its sql dialect
+	backend		string
+	stopMtx		*sync.Mutex
+	// set by Shutdown. losing the leadership is expected then
+	stopped		bool
+}
+
+// what a server knows about the cluster
+type ClusterInfo struct {
+	Name		string		`json:"name"`
+	State		string		`json:"state"`
+	Leader		string		`json:"leader"`
+	Peers		[]HaPeer	`json:"peers"`
+}
+
+// applies the replicated statements to the store
+type storeFsm struct {
+	store	database.ReplicatedStore
+}
+
+// log entries are "<backend>\n<statement>"
+func encodeEntry(backend string, stmt string) []byte {
+	return []byte(backend + "\n" + stmt)
+}
+
+func decodeEntry(data []byte) (string, string) {
+	parts := strings.SplitN(string(data), "\n", 2)
+	if len(parts) < 2 {
+		return "", parts[0]
+	}
+	return parts[0], parts[1]
+}
+
+func (f *storeFsm) Apply(l *raft.Log) interface{} {
+	backend, stmt := decodeEntry(l.Data)
+	if backend != f.store.Backend() {
+		err := errors.New(fmt.Sprintf("Log entry %d has been written by a server with backend %s, this one uses %s. All servers of a cluster need the same database.backend", l.Index, backend, f.store.Backend()))
+		fmt.Fprintf(os.Stderr, "%v\n", err)
+		return err
+	}
+	if err := f.store.Apply(l.Index, stmt); err != nil {
+		fmt.Fprintf(os.Stderr, "Error applying log entry %d: %v\n", l.Index, err)
+		return err
+	}
+	return nil
+}
+
+func (f *storeFsm) Snapshot() (raft.FSMSnapshot, error) {
+	dump, err := f.store.Dump()
+	if err != nil {
+		return nil, err
+	}
+	return &storeSnapshot{dump: dump}, nil
+}
+
+func (f *storeFsm) Restore(rc io.ReadCloser) error {
+	defer rc.Close()
+
+	var dump database.Dump
+	if err := json.NewDecoder(rc).Decode(&dump); err != nil {
+		return err
+	}
+	return f.store.Restore(&dump)
+}
+
+type storeSnapshot struct {
+	dump	*database.Dump
+}
+
+func (s *storeSnapshot) Persist(sink raft.SnapshotSink) error {
+	if err := json.NewEncoder(sink).Encode(s.dump); err != nil {
+		sink.Cancel()
+		return err
+	}
+	return sink.Close()
+}
+
+func (s *storeSnapshot) Release() {}
+
+// joins the cluster of config.Ha. the first start of a server bootstraps the cluster with all peers
+func StartHa(config Config, store database.ReplicatedStore) (*HaNode, error) {
+	self, _ := config.HaSelf()
+
+	raftDir := path.Join(config.DataDir, "raft")
+	if err := os.MkdirAll(raftDir, os.ModePerm); err != nil {
+		return nil, err
+	}
+	if err := checkRaftBackend(raftDir, store.Backend()); err != nil {
+		return nil, err
+	}
+
+	h := &HaNode{
+		config:		config,
+		leaderCh:	make(chan bool, 1),
+		backend:	store.Backend(),
+		stopMtx:	&sync.Mutex{},
+	}
+
+	raftConfig := raft.DefaultConfig()
+	raftConfig.LocalID = raft.ServerID(config.Name)
+	raftConfig.HeartbeatTimeout = config.Ha.HeartbeatTimeoutMs * time.Millisecond
+	raftConfig.ElectionTimeout = config.Ha.HeartbeatTimeoutMs * time.Millisecond
+	raftConfig.LeaderLeaseTimeout = config.Ha.HeartbeatTimeoutMs * time.Millisecond / 2
+	raftConfig.NotifyCh = h.leaderCh
+
+	logStore, err := raftboltdb.NewBoltStore(path.Join(raftDir, "log.db"))
+	if err != nil {
+		return nil, err
+	}
+	snapshots, err := raft.NewFileSnapshotStore(raftDir, 2, os.Stderr)
+	if err != nil {
+		logStore.Close()
+		return nil, err
+	}
+	transport, err := raft.NewTCPTransport(self.Raft, nil, 3, 10 * time.Second, os.Stderr)
+	if err != nil {
+		logStore.Close()
+		return nil, err
+	}
+	h.logStore = logStore
+	h.transport = transport
+
+	existing, err := raft.HasExistingState(logStore, logStore, snapshots)
+	if err != nil {
+		h.Shutdown()
+		return nil, err
+	}
+
+	h.raft, err = raft.NewRaft(raftConfig, &storeFsm{store: store}, logStore, logStore, snapshots, transport)
+	if err != nil {
+		h.Shutdown()
+		return nil, err
+	}
+
+	if existing == false {
+		servers := make([]raft.Server, len(config.Ha.Peers))
+		for k, peer := range config.Ha.Peers {
+			servers[k] = raft.Server{ID: raft.ServerID(peer.Name), Address: raft.ServerAddress(peer.Raft)}
+		}
+		if err := h.raft.BootstrapCluster(raft.Configuration{Servers: servers}).Error(); err != nil {
+			h.Shutdown()
+			return nil, err
+		}
+	}
+
+	store.SetReplicator(h)
+	return h, nil
+}
+
+// the log of raftDir can only be replayed into a store of the backend it has been written with
+func checkRaftBackend(raftDir string, backend string) error {
+	marker := path.Join(raftDir, "backend")
+	written, err := ioutil.ReadFile(marker)
+	if os.IsNotExist(err) {
+		return ioutil.WriteFile(marker, []byte(backend), 0644)
+	}
+	if err != nil {
+		return err
+	}
+	if string(written) != backend {
+		return errors.New(fmt.Sprintf("%s has been created with database.backend %s, not %s. Remove it to start over", raftDir, string(written), backend))
+	}
+	return nil
+}
+
+// returns once stmt has been committed by the cluster and applied to the local store
+func (h *HaNode) Replicate(stmt string) error {
+	f := h.raft.Apply(encodeEntry(h.backend, stmt), h.config.Ha.ApplyTimeoutMs * time.Millisecond)
+	if err := f.Error(); err != nil {
+		return err
+	}
+	if err, ok := f.Response().(error); ok {
+		return err
+	}
+	return nil
+}
+
+// blocks until this server is the leader and its store contains everything that has been
+// committed. when the server loses its leadership later on, the process exits: agents,
+// scheduler and api can't be handed over while running, so a restart turns it into a follower
+func (h *HaNode) WaitForLeadership() error {
+	for leader := range h.leaderCh {
+		if leader {
+			break
+		}
+	}
+	if err := h.raft.Barrier(h.config.Ha.ApplyTimeoutMs * time.Millisecond).Error(); err != nil {
+		return err
+	}
+	fmt.Printf("Server %s is the leader\n", h.config.Name)
+
+	go func() {
+		for leader := range h.leaderCh {
+			if leader == false && h.isStopped() == false {
+				fmt.Fprintf(os.Stderr, "Server %s lost its leadership. Exiting\n", h.config.Name)
+				os.Exit(1)
+			}
+		}
+	}()
+	return nil
+}
+
+func (h *HaNode) isStopped() bool {
+	h.stopMtx.Lock()
+	defer h.stopMtx.Unlock()
+
+	return h.stopped
+}
+
+// leaves the cluster for now. the others elect a new leader if this server was it
+func (h *HaNode) Shutdown() error {
+	h.stopMtx.Lock()
+	h.stopped = true
+	h.stopMtx.Unlock()
+
+	var err error
+	if h.raft != nil {
+		err = h.raft.Shutdown().Error()
+	}
+	h.transport.Close()
+	h.logStore.Close()
+	return err
+}
+
+func (h *HaNode) leaderPeer() (HaPeer, bool) {
+	_, id := h.raft.LeaderWithID()
+	for _, peer := range h.config.Ha.Peers {
+		if peer.Name == string(id) {
+			return peer, true
+		}
+	}
+	return HaPeer{}, false
+}
+
+func (h *HaNode) Info() ClusterInfo {
+	leader, _ := h.leaderPeer()
+	return ClusterInfo{
+		Name:		h.config.Name,
+		State:		h.raft.State().String(),
+		Leader:		leader.Name,
+		Peers:		h.config.Ha.Peers,
+	}
+}
+
+func getCluster(ha *HaNode, c *gin.Context) {
+	if ha == nil {
+		sendError(c, http.StatusNotFound, errors.New("Server doesn't run in a cluster"))
+		return
+	}
+	c.JSON(http.StatusOK, ha.Info())
+}
+
+func (h *HaNode) redirectToLeader(c *gin.Context) {
+	leader, in := h.leaderPeer()
+	if in == false || leader.Name == h.config.Name {
+		sendError(c, http.StatusServiceUnavailable, errors.New("No leader elected yet"))
+		return
+	}
+	c.Redirect(http.StatusTemporaryRedirect, "http://" + leader.Http + c.Request.URL.RequestURI())
+}
+
+// api of a follower. everything but the cluster info is redirected to the leader.
+// call the returned function to stop it
+func (h *HaNode) StartFollowerApi() func () {
+	router := gin.Default()
+	router.GET("/v1/cluster", func (c *gin.Context) {
+		getCluster(h, c)
+	})
+	router.NoRoute(func (c *gin.Context) {
+		h.redirectToLeader(c)
+	})
+
+	server := &http.Server{Addr: h.config.Addresses.Http, Handler: router}
+	go func() {
+		if err := server.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+			fmt.Fprintf(os.Stderr, "Error Starting Follower Api: %v\n", err)
+		}
+	}()
+
+	return func () {
+		ctx, cancel := context.WithTimeout(context.Background(), 5 * time.Second)
+		defer cancel()
+		server.Shutdown(ctx)
+	}
+}
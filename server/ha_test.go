@@ -0,0 +1,212 @@
+package server
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"os"
+	"path"
+	"testing"
+	"time"
+
+	"github.com/hashicorp/raft"
+
+	s "taylor/lib/structs"
+	"taylor/server/database"
+)
+
+func freeAddress(t *testing.T) string {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	return ln.Addr().String()
+}
+
+type testHaNode struct {
+	ha	*HaNode
+	store	*database.Store
+	// stops the follower api
+	stopApi	func ()
+}
+
+func (n *testHaNode) stop() {
+	if n.stopApi != nil {
+		n.stopApi()
+	}
+	n.ha.Shutdown()
+	n.store.Close()
+}
+
+// three servers on localhost, each with its own in memory store
+func startTestCluster(t *testing.T, dir string) []*testHaNode {
+	peers := make([]HaPeer, 3)
+	for k := range peers {
+		peers[k] = HaPeer{
+			Name:	fmt.Sprintf("server-%d", k),
+			Raft:	freeAddress(t),
+			Http:	freeAddress(t),
+			Tcp:	freeAddress(t),
+		}
+	}
+
+	nodes := make([]*testHaNode, len(peers))
+	for k, peer := range peers {
+		config := Config{
+			Name:		peer.Name,
+			DataDir:	path.Join(dir, peer.Name),
+			Addresses:	AddressConfig{Http: peer.Http, Tcp: peer.Tcp},
+			Ha:		HaConfig{
+				Enabled:		true,
+				Peers:			peers,
+				HeartbeatTimeoutMs:	300,
+				ApplyTimeoutMs:		5000,
+			},
+		}
+		store, err := database.Open(database.BACKEND_QL, fmt.Sprintf("memory://%s-%s", path.Base(dir), peer.Name))
+		if err != nil {
+			t.Fatal(err)
+		}
+		ha, err := StartHa(config, store)
+		if err != nil {
+			t.Fatal(err)
+		}
+		// nobody waits for the leadership here, raft must not block on telling us about it
+		go func() {
+			for range ha.leaderCh {
+			}
+		}()
+		nodes[k] = &testHaNode{ha: ha, store: store}
+	}
+	return nodes
+}
+
+// the leader among nodes once it applied everything that has been committed
+func waitForLeader(t *testing.T, nodes []*testHaNode) *testHaNode {
+	deadline := time.Now().Add(20 * time.Second)
+	for time.Now().Before(deadline) {
+		for _, node := range nodes {
+			if node.ha.raft.State() == raft.Leader && node.ha.raft.Barrier(5 * time.Second).Error() == nil {
+				return node
+			}
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+	t.Fatal("No leader elected")
+	return nil
+}
+
+// a job like the api creates it. the sql stores can't read jobs with nil lists
+func haJob(identifier string) *s.Job {
+	return s.NewJob(identifier, "exec", map[string]interface{}{"cmd": "true"}, []s.UpdateHandler{}, []string{}, 10, []s.GpuRequirement{}, map[string]interface{}{}, []string{}, s.RetryPolicy{}, 0)
+}
+
+func waitingIdentifiers(t *testing.T, store database.JobStore) map[string]bool {
+	jobs, err := store.JobsWithStatus(s.JOB_STATUS_WAITING, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	identifiers := make(map[string]bool, len(jobs))
+	for _, job := range jobs {
+		identifiers[job.Identifier] = true
+	}
+	return identifiers
+}
+
+func TestHaFailover(t *testing.T) {
+	if testing.Short() {
+		t.Skip("starts a cluster of three servers")
+	}
+	dir, err := ioutil.TempDir("", "taylor-ha")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	nodes := startTestCluster(t, dir)
+	stopped := make(map[*testHaNode]bool)
+	defer func() {
+		for _, node := range nodes {
+			if stopped[node] == false {
+				node.stop()
+			}
+		}
+	}()
+
+	leader := waitForLeader(t, nodes)
+	for k := 0; k < 3; k++ {
+		job := haJob(fmt.Sprintf("job-%d", k))
+		if _, err := leader.store.InsertJob(job); err != nil {
+			t.Fatal(err)
+		}
+	}
+	done := haJob("done")
+	if _, err := leader.store.InsertJob(done); err != nil {
+		t.Fatal(err)
+	}
+	if err := leader.store.UpdateJobStatus(done.Id, s.JOB_STATUS_SUCCESS); err != nil {
+		t.Fatal(err)
+	}
+
+	// followers can't write, the leader does that for them
+	for _, node := range nodes {
+		if node == leader {
+			continue
+		}
+		if _, err := node.store.InsertJob(haJob("follower")); err == nil {
+			t.Fatal("Follower", node.ha.config.Name, "must not accept writes")
+		}
+	}
+
+	leader.stop()
+	stopped[leader] = true
+	remaining := make([]*testHaNode, 0, 2)
+	for _, node := range nodes {
+		if node != leader {
+			remaining = append(remaining, node)
+		}
+	}
+
+	newLeader := waitForLeader(t, remaining)
+	waiting := waitingIdentifiers(t, newLeader.store)
+	if len(waiting) != 3 || waiting["job-0"] == false || waiting["job-1"] == false || waiting["job-2"] == false {
+		t.Fatal("New leader must have the waiting jobs, has", waiting)
+	}
+	if stored, _ := newLeader.store.JobById(done.Id); stored == nil || stored.Status != s.JOB_STATUS_SUCCESS {
+		t.Fatal("New leader must have the updates of the old one")
+	}
+
+	// the follower redirects writes to the new leader
+	var follower *testHaNode
+	for _, node := range remaining {
+		if node != newLeader {
+			follower = node
+		}
+	}
+	follower.stopApi = follower.ha.StartFollowerApi()
+	client := &http.Client{
+		CheckRedirect: func (req *http.Request, via []*http.Request) error {
+			return http.ErrUseLastResponse
+		},
+	}
+	var response *http.Response
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		response, err = client.Post("http://" + follower.ha.config.Addresses.Http + "/v1/jobs", "application/json", nil)
+		if err == nil || time.Now().After(deadline) {
+			break
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	response.Body.Close()
+	assertInt(t, response.StatusCode, http.StatusTemporaryRedirect)
+	expected := "http://" + newLeader.ha.config.Addresses.Http + "/v1/jobs"
+	if location := response.Header.Get("Location"); location != expected {
+		t.Fatal("Follower redirects to", location, "expected", expected)
+	}
+}
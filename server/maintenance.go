@@ -0,0 +1,175 @@
+package server
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"sync"
+	"time"
+
+	"taylor/lib/structs"
+)
+
+// maintenance state of a node. it outlives the connection of the agent, so a node that
+// reconnects during maintenance stays cordoned
+type NodeMaintenance struct {
+	// no new jobs are placed on the node
+	Cordoned	bool	`json:"cordoned"`
+	Draining	bool	`json:"draining"`
+	// running jobs are cancelled and requeued after this time (in ms). 0 means they may finish
+	DrainDeadline	int64	`json:"drain_deadline"`
+}
+
+type MaintenanceTable struct {
+	mtx		*sync.Mutex
+	nodes		map[string]NodeMaintenance
+	// jobs that have been cancelled because their node got drained
+	evicted		map[string]bool
+}
+
+func NewMaintenanceTable() *MaintenanceTable {
+	return &MaintenanceTable{
+		mtx:		&sync.Mutex{},
+		nodes:		make(map[string]NodeMaintenance),
+		evicted:	make(map[string]bool),
+	}
+}
+
+func (t *MaintenanceTable) Get(nodeName string) NodeMaintenance {
+	t.mtx.Lock()
+	defer t.mtx.Unlock()
+
+	return t.nodes[nodeName]
+}
+
+func (t *MaintenanceTable) Set(nodeName string, m NodeMaintenance) {
+	t.mtx.Lock()
+	defer t.mtx.Unlock()
+
+	if m == (NodeMaintenance{}) {
+		delete(t.nodes, nodeName)
+		return
+	}
+	t.nodes[nodeName] = m
+}
+
+func (t *MaintenanceTable) Has(nodeName string) bool {
+	t.mtx.Lock()
+	defer t.mtx.Unlock()
+
+	_, in := t.nodes[nodeName]
+	return in
+}
+
+// returns false if the job has already been evicted
+func (t *MaintenanceTable) Evict(jobId string) bool {
+	t.mtx.Lock()
+	defer t.mtx.Unlock()
+
+	if t.evicted[jobId] {
+		return false
+	}
+	t.evicted[jobId] = true
+	return true
+}
+
+// removes job from the evicted ones. returns whether it was evicted
+func (t *MaintenanceTable) TakeEvicted(jobId string) bool {
+	t.mtx.Lock()
+	defer t.mtx.Unlock()
+
+	in := t.evicted[jobId]
+	delete(t.evicted, jobId)
+	return in
+}
+
+// node takes no new jobs
+func (node *Node) IsCordoned() bool {
+	return node.Maintenance.Cordoned || node.Maintenance.Draining
+}
+
+// action is only used for logging
+func (s *TcpServer) setMaintenance(nodeName string, m NodeMaintenance, action string) (*Node, error) {
+	s.nodesMtx.Lock()
+	node, in := s.nodes[nodeName]
+	if in == false && s.maintenance.Has(nodeName) == false {
+		s.nodesMtx.Unlock()
+		return nil, errors.New(fmt.Sprintf("Couldn't find node %s", nodeName))
+	}
+	s.maintenance.Set(nodeName, m)
+	var res *Node
+	if in {
+		node.Maintenance = m
+		copy := *node
+		res = &copy
+	}
+	s.nodesMtx.Unlock()
+
+	fmt.Printf("%s agent %s\n", action, nodeName)
+	// jobs might fit elsewhere (or here again after uncordon)
+	s.trigger.Fire()
+	return res, nil
+}
+
+func (s *TcpServer) CordonNode(nodeName string) (*Node, error) {
+	m := s.maintenance.Get(nodeName)
+	m.Cordoned = true
+	return s.setMaintenance(nodeName, m, "Cordon")
+}
+
+// also stops a drain. jobs that have already been evicted stay requeued
+func (s *TcpServer) UncordonNode(nodeName string) (*Node, error) {
+	return s.setMaintenance(nodeName, NodeMaintenance{}, "Uncordon")
+}
+
+// cordons the node. if deadline is > 0, jobs still running on the node after it are
+// cancelled and put back to the queue
+func (s *TcpServer) DrainNode(nodeName string, deadline time.Duration) (*Node, error) {
+	m := NodeMaintenance{Cordoned: true, Draining: true}
+	if deadline > 0 {
+		m.DrainDeadline = structs.NowMs() + int64(deadline / time.Millisecond)
+	}
+	return s.setMaintenance(nodeName, m, fmt.Sprintf("Drain (deadline %v)", deadline))
+}
+
+// puts a job of a drained node back to the queue. like preempted jobs, it doesn't count as retry
+func (s *TcpServer) requeueEvictedJob(job *structs.Job) error {
+	reason := fmt.Sprintf("Node %s drained", job.AgentName)
+	fmt.Printf("Requeue job %s (%s). %s\n", job.Id, job.Identifier, reason)
+
+	s.diskLog.WriteString(job, "DRAIN >> " + reason + "\n")
+	if err := s.diskLog.Close(job); err != nil {
+		fmt.Fprintf(os.Stderr, "%v\n", err)
+	}
+
+	attempts := finishAttempt(job.Attempts, structs.JOB_STATUS_INTERRUPT, reason)
+	s.usage.AddAttempt(job, attempts)
+	return s.requeueJobAt(job, attempts, 0, "drain", reason)
+}
+
+// cancels the jobs of nodes whose drain deadline passed
+func (s *TcpServer) drainLoop() {
+	for {
+		time.Sleep(1 * time.Second)
+
+		now := structs.NowMs()
+		for _, node := range s.Nodes() {
+			m := node.Maintenance
+			if m.Draining == false || m.DrainDeadline == 0 || now < m.DrainDeadline {
+				continue
+			}
+
+			jobs, err := s.store.JobsFromNodeWithStatus(node.Name, structs.JOB_STATUS_SCHEDULED)
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "%v\n", err)
+				continue
+			}
+			for _, job := range jobs {
+				if s.maintenance.Evict(job.Id) {
+					fmt.Printf("Evict job %s (%s) from draining agent %s\n", job.Id, job.Identifier, node.Name)
+					s.sendCancelRequest(node, job, 0)
+				}
+			}
+		}
+	}
+}
@@ -0,0 +1,108 @@
+package server
+
+import (
+	"fmt"
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	s "taylor/lib/structs"
+	"taylor/lib/tcp"
+)
+
+func testNode(name string) *Node {
+	local, remote := net.Pipe()
+	remote.Close()
+	return NodeFromMessage(tcp.NewConn(local), tcp.MsgHandshakeInitial{
+		MsgBase:	tcp.MsgBase{Command: tcp.MSG_HANDSHAKE_INITIAL, NodeName: name},
+		MsgAgentInfo:	tcp.MsgAgentInfo{Capacity: 2},
+	})
+}
+
+func TestCordonReturnsCopy(t *testing.T) {
+	tcpServer, cleanup := newTestTcpServer(t, newFakeStore())
+	defer cleanup()
+
+	if _, err := tcpServer.CordonNode("agent"); err == nil {
+		t.Fatal("Unknown node must not be cordoned")
+	}
+	tcpServer.registerNode(testNode("agent"))
+	node, err := tcpServer.CordonNode("agent")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if node.IsCordoned() == false {
+		t.Fatal("Returned node must be cordoned")
+	}
+
+	// changing what we got doesn't change the registered node
+	node.Maintenance = NodeMaintenance{}
+	if registered, _ := tcpServer.registeredNode("agent"); registered.IsCordoned() == false {
+		t.Fatal("Registered node must stay cordoned")
+	}
+	for _, node := range tcpServer.Nodes() {
+		node.Capacity = 100
+	}
+	if registered, _ := tcpServer.registeredNode("agent"); registered.Capacity != 2 {
+		t.Fatal("Nodes must return copies")
+	}
+}
+
+// agents come and go and report their state while nodes are cordoned, drained and read.
+// only finds something with -race
+func TestMaintenanceWhileAgentsChange(t *testing.T) {
+	tcpServer, cleanup := newTestTcpServer(t, newFakeStore())
+	defer cleanup()
+
+	done := make(chan struct{})
+	wg := &sync.WaitGroup{}
+	repeat := func(fun func(k int)) {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for k := 0; ; k++ {
+				select {
+				case <-done:
+					return
+				default:
+				}
+				fun(k)
+			}
+		}()
+	}
+
+	repeat(func(k int) {
+		node := testNode(fmt.Sprintf("agent-%d", k % 3))
+		if tcpServer.registerNode(node) {
+			tcpServer.deregisterNode(node)
+		}
+	})
+	repeat(func(k int) {
+		msgBase := tcp.MsgBase{NodeName: fmt.Sprintf("agent-%d", k % 3)}
+		tcpServer.updateNodeFromMessage(msgBase, tcp.MsgAgentInfo{Capacity: uint(k % 5), Labels: map[string]string{"k": "v"}})
+	})
+	repeat(func(k int) {
+		nodeName := fmt.Sprintf("agent-%d", k % 3)
+		switch (k % 3) {
+		case 0:
+			tcpServer.CordonNode(nodeName)
+		case 1:
+			tcpServer.DrainNode(nodeName, time.Millisecond)
+		default:
+			tcpServer.UncordonNode(nodeName)
+		}
+	})
+	repeat(func(k int) {
+		for _, node := range tcpServer.Nodes() {
+			if node.IsCordoned() && node.Maintenance.DrainDeadline > s.NowMs() + 1000 {
+				t.Error("Unexpected drain deadline")
+			}
+		}
+		tcpServer.registeredNode("agent-0")
+	})
+
+	time.Sleep(200 * time.Millisecond)
+	close(done)
+	wg.Wait()
+}
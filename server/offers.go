@@ -0,0 +1,133 @@
+package server
+
+import (
+	"sync"
+	"time"
+
+	"taylor/lib/structs"
+)
+
+type offerLease struct {
+	job		*structs.Job
+	nodeName	string
+	expiresAt	int64
+}
+
+// jobs that have been offered to an agent that hasn't accepted or rejected them yet.
+// as long as a job has a lease, it won't be offered to another agent
+type OfferTable struct {
+	mtx		*sync.Mutex
+	leases		map[string]offerLease
+	ttl		time.Duration
+}
+
+func NewOfferTable(ttl time.Duration) *OfferTable {
+	return &OfferTable{
+		mtx:	&sync.Mutex{},
+		leases:	make(map[string]offerLease),
+		ttl:	ttl,
+	}
+}
+
+func (t *OfferTable) expire(nowMs int64) {
+	for jobId, lease := range t.leases {
+		if lease.expiresAt <= nowMs {
+			delete(t.leases, jobId)
+		}
+	}
+}
+
+// returns false if the job is already offered to a node
+func (t *OfferTable) Acquire(job *structs.Job, nodeName string) bool {
+	t.mtx.Lock()
+	defer t.mtx.Unlock()
+
+	now := structs.NowMs()
+	t.expire(now)
+
+	if _, in := t.leases[job.Id]; in {
+		return false
+	}
+	t.leases[job.Id] = offerLease{
+		job:		job,
+		nodeName:	nodeName,
+		expiresAt:	now + int64(t.ttl / time.Millisecond),
+	}
+	return true
+}
+
+// releases the lease of job. returns false if the lease is not held by node (anymore)
+func (t *OfferTable) Release(jobId string, nodeName string) bool {
+	t.mtx.Lock()
+	defer t.mtx.Unlock()
+
+	t.expire(structs.NowMs())
+
+	lease, in := t.leases[jobId]
+	if in == false || lease.nodeName != nodeName {
+		return false
+	}
+	delete(t.leases, jobId)
+	return true
+}
+
+// releases all leases of a node (e.g. because it disconnected)
+func (t *OfferTable) ReleaseNode(nodeName string) {
+	t.mtx.Lock()
+	defer t.mtx.Unlock()
+
+	for jobId, lease := range t.leases {
+		if lease.nodeName == nodeName {
+			delete(t.leases, jobId)
+		}
+	}
+}
+
+// node holds the lease of job
+func (t *OfferTable) Holds(jobId string, nodeName string) bool {
+	t.mtx.Lock()
+	defer t.mtx.Unlock()
+
+	t.expire(structs.NowMs())
+
+	lease, in := t.leases[jobId]
+	return in && lease.nodeName == nodeName
+}
+
+func (t *OfferTable) IsOffered(jobId string) bool {
+	t.mtx.Lock()
+	defer t.mtx.Unlock()
+
+	t.expire(structs.NowMs())
+
+	_, in := t.leases[jobId]
+	return in
+}
+
+// jobs per node that are offered but not yet accepted
+func (t *OfferTable) PendingPerNode() map[string][]*structs.Job {
+	t.mtx.Lock()
+	defer t.mtx.Unlock()
+
+	t.expire(structs.NowMs())
+
+	pending := make(map[string][]*structs.Job)
+	for _, lease := range t.leases {
+		pending[lease.nodeName] = append(pending[lease.nodeName], lease.job)
+	}
+	return pending
+}
+
+// time (in ms) at which the next lease expires. 0 if there is none
+func (t *OfferTable) NextExpiry() int64 {
+	t.mtx.Lock()
+	defer t.mtx.Unlock()
+
+	var next int64 = 0
+	for _, lease := range t.leases {
+		if next == 0 || lease.expiresAt < next {
+			next = lease.expiresAt
+		}
+	}
+	return next
+}
@@ -0,0 +1,159 @@
+package server
+
+import (
+	"fmt"
+	"errors"
+	"math/rand"
+
+	"taylor/lib/structs"
+)
+
+const (
+	// first capable node (least capabilities, least gpus)
+	PLACEMENT_FIRST		= "first"
+	// fill up nodes before using the next one
+	PLACEMENT_BINPACK	= "binpack"
+	// least loaded node
+	PLACEMENT_SPREAD	= "spread"
+	// node where the least gpu memory is left over after placing the job
+	PLACEMENT_GPU_BEST_FIT	= "gpu_best_fit"
+	PLACEMENT_RANDOM	= "random"
+)
+
+type PlacementStrategy interface {
+	// chooses the node for job. all nodes are capable of running it and nodes is never empty
+	Pick(job *structs.Job, nodes []*Node) *Node
+}
+
+type firstPlacement struct {}
+
+func (p firstPlacement) Pick(job *structs.Job, nodes []*Node) *Node {
+	return nodes[0]
+}
+
+type binpackPlacement struct {}
+
+func (p binpackPlacement) Pick(job *structs.Job, nodes []*Node) *Node {
+	best := nodes[0]
+	for _, node := range nodes[1:] {
+		if node.Capacity - node.JobsRunning < best.Capacity - best.JobsRunning {
+			best = node
+		}
+	}
+	return best
+}
+
+type spreadPlacement struct {}
+
+func load(node *Node) float64 {
+	return float64(node.JobsRunning) / float64(node.Capacity)
+}
+
+func (p spreadPlacement) Pick(job *structs.Job, nodes []*Node) *Node {
+	best := nodes[0]
+	for _, node := range nodes[1:] {
+		if load(node) < load(best) {
+			best = node
+		}
+	}
+	return best
+}
+
+type gpuBestFitPlacement struct {}
+
+// free gpu memory of node that is left if job gets placed there. jobs without
+// gpu requirements should go where they waste the least gpu memory
+func gpuMemoryLeft(job *structs.Job, node *Node) int {
+	left := 0
+	if len(job.GpuRequirement) == 0 {
+		for _, gpuInfo := range node.GpuInfo {
+			left += gpuInfo.MemoryFreeMB
+		}
+		return left
+	}
+
+	for idx, k := range matchGpus(node, job.GpuRequirement) {
+		left += node.GpuInfo[k].MemoryFreeMB
+		if job.GpuRequirement[idx].MemoryAvailable > 0 {
+			left -= job.GpuRequirement[idx].MemoryAvailable
+		}
+	}
+	return left
+}
+
+func (p gpuBestFitPlacement) Pick(job *structs.Job, nodes []*Node) *Node {
+	best := nodes[0]
+	bestLeft := gpuMemoryLeft(job, best)
+	for _, node := range nodes[1:] {
+		if left := gpuMemoryLeft(job, node); left < bestLeft {
+			best = node
+			bestLeft = left
+		}
+	}
+	return best
+}
+
+type randomPlacement struct {}
+
+func (p randomPlacement) Pick(job *structs.Job, nodes []*Node) *Node {
+	return nodes[rand.Intn(len(nodes))]
+}
+
+func PlacementStrategyByName(name string) (PlacementStrategy, error) {
+	switch (name) {
+	case PLACEMENT_FIRST:
+		return firstPlacement{}, nil
+	case PLACEMENT_BINPACK:
+		return binpackPlacement{}, nil
+	case PLACEMENT_SPREAD:
+		return spreadPlacement{}, nil
+	case PLACEMENT_GPU_BEST_FIT:
+		return gpuBestFitPlacement{}, nil
+	case PLACEMENT_RANDOM:
+		return randomPlacement{}, nil
+	default:
+		return nil, errors.New(fmt.Sprintf("Unknown placement strategy %s", name))
+	}
+}
+
+// placement strategies of the scheduler. the zero value places every job on the first capable node
+type Placement struct {
+	Default		PlacementStrategy
+	// jobs with gpu requirements
+	Gpu		PlacementStrategy
+}
+
+func NewPlacement(config SchedulerConfig) (Placement, error) {
+	var placement Placement
+	var err error
+
+	if config.Placement != "" {
+		placement.Default, err = PlacementStrategyByName(config.Placement)
+		if err != nil {
+			return placement, err
+		}
+	}
+	if config.GpuPlacement != "" {
+		placement.Gpu, err = PlacementStrategyByName(config.GpuPlacement)
+		if err != nil {
+			return placement, err
+		}
+	}
+	return placement, nil
+}
+
+// jobs can override the strategy of the server
+func (p Placement) strategyFor(job *structs.Job) PlacementStrategy {
+	if job.Placement != "" {
+		if strategy, err := PlacementStrategyByName(job.Placement); err == nil {
+			return strategy
+		}
+	}
+	if len(job.GpuRequirement) > 0 && p.Gpu != nil {
+		return p.Gpu
+	}
+	if p.Default != nil {
+		return p.Default
+	}
+	return firstPlacement{}
+}
@@ -0,0 +1,248 @@
+package server
+
+import (
+	"fmt"
+	"os"
+	"sort"
+	"sync"
+	"time"
+
+	"taylor/lib/structs"
+	"taylor/lib/util"
+)
+
+type preemption struct {
+	preemptorId	string
+	expiresAt	int64
+}
+
+// jobs that have been asked to stop to make room for a job with higher priority.
+// when they report back, they are put back to the queue instead of being cancelled
+type PreemptionTable struct {
+	mtx		*sync.Mutex
+	victims		map[string]preemption
+	ttl		time.Duration
+}
+
+func NewPreemptionTable(ttl time.Duration) *PreemptionTable {
+	return &PreemptionTable{
+		mtx:		&sync.Mutex{},
+		victims:	make(map[string]preemption),
+		ttl:		ttl,
+	}
+}
+
+func (t *PreemptionTable) expire(nowMs int64) {
+	for victimId, p := range t.victims {
+		if p.expiresAt <= nowMs {
+			delete(t.victims, victimId)
+		}
+	}
+}
+
+func (t *PreemptionTable) Add(victimId string, preemptorId string) {
+	t.mtx.Lock()
+	defer t.mtx.Unlock()
+
+	t.victims[victimId] = preemption{
+		preemptorId:	preemptorId,
+		expiresAt:	structs.NowMs() + int64(t.ttl / time.Millisecond),
+	}
+}
+
+// removes victim from the table. returns the job it was preempted for
+func (t *PreemptionTable) Take(victimId string) (string, bool) {
+	t.mtx.Lock()
+	defer t.mtx.Unlock()
+
+	t.expire(structs.NowMs())
+
+	p, in := t.victims[victimId]
+	if in == false {
+		return "", false
+	}
+	delete(t.victims, victimId)
+	return p.preemptorId, true
+}
+
+func (t *PreemptionTable) IsVictim(jobId string) bool {
+	t.mtx.Lock()
+	defer t.mtx.Unlock()
+
+	t.expire(structs.NowMs())
+
+	_, in := t.victims[jobId]
+	return in
+}
+
+// preemptor waits for victims to stop
+func (t *PreemptionTable) HasVictims(preemptorId string) bool {
+	t.mtx.Lock()
+	defer t.mtx.Unlock()
+
+	t.expire(structs.NowMs())
+
+	for _, p := range t.victims {
+		if p.preemptorId == preemptorId {
+			return true
+		}
+	}
+	return false
+}
+
+func canPlace(node *Node, job *structs.Job, selector jobSelector) bool {
+	if node.IsCordoned() || node.Capacity <= node.JobsRunning {
+		return false
+	}
+	if util.IsSubsetString(job.Restrict, node.Capabilities) == false {
+		return false
+	}
+	if selector.matches(node) == false || fulfillsAffinity(node, job) == false {
+		return false
+	}
+	if node.Resources.Fulfills(job.Resources) == false {
+		return false
+	}
+	return len(job.GpuRequirement) == 0 || matchGpus(node, job.GpuRequirement) != nil
+}
+
+// gives everything job occupies on node back
+func releaseJob(node *Node, job *structs.Job) {
+	if node.JobsRunning > 0 {
+		node.JobsRunning--
+	}
+	node.Resources.Release(job.Resources)
+	removeIdentifier(node, job.Identifier)
+
+	for idx, k := range job.GpuIndices {
+		for i, reserved := range node.GpusReserved {
+			if reserved == k {
+				node.GpusReserved = append(node.GpusReserved[:i], node.GpusReserved[i+1:]...)
+				break
+			}
+		}
+		if idx < len(job.GpuRequirement) && job.GpuRequirement[idx].MemoryAvailable > 0 && k < len(node.GpuInfo) {
+			node.GpuInfo[k].MemoryFreeMB += job.GpuRequirement[idx].MemoryAvailable
+		}
+	}
+}
+
+// lowest priority first. of those, the ones that started last (they lose the least work)
+func sortVictimCandidates(jobs []*structs.Job) {
+	startedAt := func (job *structs.Job) int64 {
+		if len(job.Attempts) == 0 {
+			return 0
+		}
+		return job.Attempts[len(job.Attempts)-1].StartedAt
+	}
+	sort.SliceStable(jobs[:], func (i int, j int) bool {
+		if jobs[i].Priority != jobs[j].Priority {
+			return jobs[i].Priority < jobs[j].Priority
+		}
+		return startedAt(jobs[i]) > startedAt(jobs[j])
+	})
+}
+
+// victims that need to stop on node so that job can run there. nil if that isn't possible
+// (or not necessary). node gets modified
+func victimsOnNode(node *Node, job *structs.Job, selector jobSelector, candidates []*structs.Job, minGap uint) []*structs.Job {
+	if util.IsSubsetString(job.Restrict, node.Capabilities) == false || selector.matches(node) == false || nodeAllowed(node, job) == false {
+		return nil
+	}
+
+	victims := make([]*structs.Job, 0)
+	for _, candidate := range candidates {
+		if canPlace(node, job, selector) {
+			break
+		}
+		// static priorities only. waiting long doesn't entitle a job to stop others
+		if candidate.Priority + minGap > job.Priority {
+			// candidates are sorted by priority
+			break
+		}
+		releaseJob(node, candidate)
+		victims = append(victims, candidate)
+	}
+
+	if len(victims) == 0 || canPlace(node, job, selector) == false {
+		return nil
+	}
+	return victims
+}
+
+// asks preemptible jobs with lower priority to stop so that jobs which couldn't
+// be placed get room. nodes must reflect the state after distribute
+func (s *Scheduler) preempt(nodes []*Node, unplaced []*structs.Job) {
+	if len(unplaced) == 0 {
+		return
+	}
+	cfg := s.config.Scheduler.Preemption
+	preemptions := s.tcpServer.Preemptions()
+
+	running, err := s.store.JobsWithStatus(structs.JOB_STATUS_SCHEDULED, 0)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error %v\n", err)
+		return
+	}
+
+	candidates := make(map[string][]*structs.Job)
+	for _, job := range running {
+		if job.Preemptible == false || preemptions.IsVictim(job.Id) {
+			continue
+		}
+		candidates[job.AgentName] = append(candidates[job.AgentName], job)
+	}
+	if len(candidates) == 0 {
+		return
+	}
+	for _, jobs := range candidates {
+		sortVictimCandidates(jobs)
+	}
+
+	for _, job := range unplaced {
+		// gangs would need room on several nodes at once. they wait for it instead
+		if job.IsGangMember() || preemptions.HasVictims(job.Id) {
+			continue
+		}
+
+		// take the node where the least jobs need to stop
+		selector := selectorOf(job)
+		var bestNode *Node
+		var bestVictims []*structs.Job
+		for _, node := range nodes {
+			proxy := copyNode(node)
+			victims := victimsOnNode(proxy, job, selector, candidates[node.Name], cfg.MinPriorityGap)
+			if victims != nil && (bestVictims == nil || len(victims) < len(bestVictims)) {
+				bestNode = proxy
+				bestVictims = victims
+			}
+		}
+		if bestVictims == nil {
+			continue
+		}
+
+		for _, victim := range bestVictims {
+			fmt.Printf("Preempt job %s (%s) for job %s (%s)\n", victim.Id, victim.Identifier, job.Id, job.Identifier)
+			s.tcpServer.PreemptJob(victim, job)
+		}
+
+		// the space on the node is taken by job now
+		for idx, node := range nodes {
+			if node.Name == bestNode.Name {
+				nodes[idx] = bestNode
+			}
+		}
+		reserveGpus(bestNode, job.GpuRequirement)
+		bestNode.Resources.Allocate(job.Resources)
+		bestNode.JobsRunning++
+		bestNode.Identifiers = append(bestNode.Identifiers, job.Identifier)
+
+		remaining := make([]*structs.Job, 0)
+		for _, candidate := range candidates[bestNode.Name] {
+			if preemptions.IsVictim(candidate.Id) == false {
+				remaining = append(remaining, candidate)
+			}
+		}
+		candidates[bestNode.Name] = remaining
+	}
+}
@@ -0,0 +1,109 @@
+package server
+
+import (
+	"testing"
+
+	s "taylor/lib/structs"
+)
+
+func preemptibleJob(identifier string, agentName string, cpu float64) *s.Job {
+	job := scheduledJob(identifier, agentName, s.RetryPolicy{})
+	job.Priority = 10
+	job.Preemptible = true
+	job.Resources = s.ResourceRequirement{Cpu: cpu}
+	return job
+}
+
+// nodes as the scheduler sees them: full, no cpu left
+func fullNodes() []*Node {
+	return []*Node{
+		&Node{Name: "a", Capacity: 10, JobsRunning: 2},
+		&Node{Name: "b", Capacity: 10, JobsRunning: 1},
+	}
+}
+
+func TestPreemptTakesFewestVictims(t *testing.T) {
+	a1 := preemptibleJob("a1", "a", 1)
+	a2 := preemptibleJob("a2", "a", 1)
+	b1 := preemptibleJob("b1", "b", 2)
+	// not preemptible, even though it would make room on its own
+	c1 := scheduledJob("c1", "c", s.RetryPolicy{})
+	c1.Resources = s.ResourceRequirement{Cpu: 2}
+	store := newFakeStore(a1, a2, b1, c1)
+
+	tcpServer, cleanup := newTestTcpServer(t, store)
+	defer cleanup()
+	tcpServer.config.Scheduler.Preemption.MinPriorityGap = 10
+	for _, name := range []string{"a", "b", "c"} {
+		tcpServer.registerNode(testNode(name))
+	}
+	scheduler := newTestScheduler(tcpServer)
+
+	first := &s.Job{Id: "first", Priority: 100, Resources: s.ResourceRequirement{Cpu: 2}}
+	second := &s.Job{Id: "second", Priority: 100, Resources: s.ResourceRequirement{Cpu: 2}}
+	nodes := append(fullNodes(), &Node{Name: "c", Capacity: 10, JobsRunning: 1})
+	scheduler.preempt(nodes, []*s.Job{first, second})
+
+	// first takes b, where only one job has to stop. b is full again then, so second takes a
+	cancelled := cancelRequests(tcpServer)
+	onA := map[string]bool{a1.Id: true, a2.Id: true}
+	if len(cancelled) != 3 || cancelled[0] != b1.Id || onA[cancelled[1]] == false || onA[cancelled[2]] == false || cancelled[1] == cancelled[2] {
+		t.Fatal("Expected b1 for first and a1, a2 for second, got", cancelled)
+	}
+	preemptions := tcpServer.Preemptions()
+	if preemptions.HasVictims("first") == false || preemptions.HasVictims("second") == false {
+		t.Fatal("Both jobs must wait for their victims")
+	}
+	if preemptions.IsVictim(c1.Id) {
+		t.Fatal("Jobs that aren't preemptible must not be preempted")
+	}
+
+	// the victims are still running in the next pass. they must not be preempted twice
+	third := &s.Job{Id: "third", Priority: 100, Resources: s.ResourceRequirement{Cpu: 1}}
+	scheduler.preempt(fullNodes(), []*s.Job{first, second, third})
+	if cancelled := cancelRequests(tcpServer); len(cancelled) != 0 {
+		t.Fatal("Victims must not be preempted again, got", cancelled)
+	}
+	if preemptions.HasVictims("third") {
+		t.Fatal("Third job must not get victims of the others")
+	}
+}
+
+func TestPreemptedJobIsRequeued(t *testing.T) {
+	victim := preemptibleJob("victim", "a", 1)
+	finished := preemptibleJob("finished", "a", 1)
+	store := newFakeStore(victim, finished)
+
+	tcpServer, cleanup := newTestTcpServer(t, store)
+	defer cleanup()
+	tcpServer.registerNode(testNode("a"))
+
+	preemptor := &s.Job{Id: "preemptor", Priority: 100}
+	tcpServer.PreemptJob(victim, preemptor)
+	tcpServer.PreemptJob(finished, preemptor)
+	assertInt(t, len(cancelRequests(tcpServer)), 2)
+
+	if err := tcpServer.handleMsgJobDone(jobDone(victim, s.JOB_STATUS_CANCEL)); err != nil {
+		t.Fatal(err)
+	}
+	stored, _ := store.JobById(victim.Id)
+	if stored.Status != s.JOB_STATUS_WAITING || stored.AgentName != "" || stored.RetryAt != 0 {
+		t.Fatal("Preempted job must be back in the queue right away, is", stored.Status, stored.AgentName, stored.RetryAt)
+	}
+	assertInt(t, len(stored.Attempts), 1)
+	if stored.Attempts[0].Status != s.JOB_STATUS_INTERRUPT || stored.Attempts[0].Reason != "Preempted by job preemptor" {
+		t.Fatal("Attempt must be interrupted by the preemptor, is", stored.Attempts[0])
+	}
+	assertInt(t, stored.RetryAttempts(), 0)
+
+	// a victim that managed to finish keeps its result
+	if err := tcpServer.handleMsgJobDone(jobDone(finished, s.JOB_STATUS_SUCCESS)); err != nil {
+		t.Fatal(err)
+	}
+	if stored, _ := store.JobById(finished.Id); stored.Status != s.JOB_STATUS_SUCCESS {
+		t.Fatal("Finished victim must succeed, is", stored.Status)
+	}
+	if tcpServer.Preemptions().HasVictims(preemptor.Id) {
+		t.Fatal("Preemptor must not wait anymore")
+	}
+}
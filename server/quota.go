@@ -0,0 +1,120 @@
+package server
+
+import (
+	"fmt"
+
+	"taylor/lib/structs"
+)
+
+// running jobs per quota during a scheduling pass. a nil QuotaUsage doesn't limit anything
+type QuotaUsage struct {
+	config		QuotaConfig
+	tenants		map[string]int
+	identifiers	map[string]int
+	keys		map[string]int
+	// reasons of the jobs that have been held back (by job id)
+	blocked		map[string]string
+}
+
+// active are the jobs that count against the quotas (running and offered ones)
+func NewQuotaUsage(config QuotaConfig, active []*structs.Job) *QuotaUsage {
+	q := &QuotaUsage{
+		config:		config,
+		tenants:	make(map[string]int),
+		identifiers:	make(map[string]int),
+		keys:		make(map[string]int),
+		blocked:	make(map[string]string),
+	}
+	for _, job := range active {
+		q.Take(job)
+	}
+	return q
+}
+
+func (q *QuotaUsage) keyLimit(key string) int {
+	if limit, in := q.config.ConcurrencyKeys[key]; in {
+		return limit
+	}
+	return 1
+}
+
+// returns false if job would exceed a quota. the reason is remembered for Blocked
+func (q *QuotaUsage) Admit(job *structs.Job) bool {
+	if q == nil {
+		return true
+	}
+	if ok, reason := q.check(job); ok == false {
+		q.blocked[job.Id] = reason
+		return false
+	}
+	return true
+}
+
+func (q *QuotaUsage) check(job *structs.Job) (bool, string) {
+	if limit, in := q.config.Tenants[job.Tenant]; in && q.tenants[job.Tenant] >= limit {
+		return false, fmt.Sprintf("Tenant %s has %d of %d jobs running", job.Tenant, q.tenants[job.Tenant], limit)
+	}
+	if limit, in := q.config.Identifiers[job.Identifier]; in && q.identifiers[job.Identifier] >= limit {
+		return false, fmt.Sprintf("Identifier %s has %d of %d jobs running", job.Identifier, q.identifiers[job.Identifier], limit)
+	}
+	if job.ConcurrencyKey != "" && q.keys[job.ConcurrencyKey] >= q.keyLimit(job.ConcurrencyKey) {
+		return false, fmt.Sprintf("Concurrency key %s has %d of %d jobs running", job.ConcurrencyKey, q.keys[job.ConcurrencyKey], q.keyLimit(job.ConcurrencyKey))
+	}
+	return true, ""
+}
+
+func (q *QuotaUsage) Take(job *structs.Job) {
+	if q == nil {
+		return
+	}
+	q.tenants[job.Tenant]++
+	q.identifiers[job.Identifier]++
+	if job.ConcurrencyKey != "" {
+		q.keys[job.ConcurrencyKey]++
+	}
+}
+
+// jobs that have been held back by a quota and why
+func (q *QuotaUsage) Blocked() map[string]string {
+	if q == nil {
+		return map[string]string{}
+	}
+	return q.blocked
+}
+
+// copy to try out whether a group of jobs fits. nil stays nil
+func (q *QuotaUsage) clone() *QuotaUsage {
+	if q == nil {
+		return nil
+	}
+	c := NewQuotaUsage(q.config, nil)
+	for k, v := range q.tenants {
+		c.tenants[k] = v
+	}
+	for k, v := range q.identifiers {
+		c.identifiers[k] = v
+	}
+	for k, v := range q.keys {
+		c.keys[k] = v
+	}
+	return c
+}
+
+// takes over the counts of a clone
+func (q *QuotaUsage) adopt(c *QuotaUsage) {
+	if q == nil {
+		return
+	}
+	q.tenants = c.tenants
+	q.identifiers = c.identifiers
+	q.keys = c.keys
+}
+
+func (q *QuotaUsage) block(jobs []*structs.Job, reason string) {
+	if q == nil {
+		return
+	}
+	for _, job := range jobs {
+		q.blocked[job.Id] = reason
+	}
+}
@@ -0,0 +1,154 @@
+package server
+
+import (
+	"fmt"
+	"os"
+	"sync"
+	"time"
+
+	"taylor/lib/structs"
+)
+
+// agents that lost their connection. their jobs stay scheduled until the deadline, the
+// agent might just reconnect and still run them
+type DisconnectTable struct {
+	mtx		*sync.Mutex
+	// node name -> time (in ms) after which its jobs count as lost
+	deadlines	map[string]int64
+}
+
+func NewDisconnectTable() *DisconnectTable {
+	return &DisconnectTable{
+		mtx:		&sync.Mutex{},
+		deadlines:	make(map[string]int64),
+	}
+}
+
+func (t *DisconnectTable) Add(nodeName string, deadline int64) {
+	t.mtx.Lock()
+	defer t.mtx.Unlock()
+
+	t.deadlines[nodeName] = deadline
+}
+
+// returns false if the node wasn't disconnected
+func (t *DisconnectTable) Remove(nodeName string) bool {
+	t.mtx.Lock()
+	defer t.mtx.Unlock()
+
+	_, in := t.deadlines[nodeName]
+	delete(t.deadlines, nodeName)
+	return in
+}
+
+func (t *DisconnectTable) Has(nodeName string) bool {
+	t.mtx.Lock()
+	defer t.mtx.Unlock()
+
+	_, in := t.deadlines[nodeName]
+	return in
+}
+
+// removes and returns the nodes whose deadline passed
+func (t *DisconnectTable) Expired(nowMs int64) []string {
+	t.mtx.Lock()
+	defer t.mtx.Unlock()
+
+	expired := make([]string, 0)
+	for nodeName, deadline := range t.deadlines {
+		if deadline <= nowMs {
+			expired = append(expired, nodeName)
+			delete(t.deadlines, nodeName)
+		}
+	}
+	return expired
+}
+
+// puts the scheduled jobs of a node that is gone back to the queue (or fails them if they
+// don't want to be retried)
+func (s *TcpServer) failJobsOfNode(nodeName string, jobs []*structs.Job, reason string) {
+	for _, job := range jobs {
+		fmt.Printf("Job %s (%s) at %s is lost. %s\n", job.Id, job.Identifier, nodeName, reason)
+		s.preemptions.Take(job.Id)
+		s.maintenance.TakeEvicted(job.Id)
+		// a hung agent never confirmed the cancel of its timed out job
+		if s.timeouts.Take(job.Id) {
+			s.deregisterScheduledJob(job, structs.JOB_STATUS_TIMEOUT, TIMEOUT_BACKSTOP_MESSAGE, structs.RETRY_ON_TIMEOUT)
+			continue
+		}
+		s.deregisterScheduledJob(job, structs.JOB_STATUS_ERROR, reason, structs.RETRY_ON_NODE_LOST)
+	}
+}
+
+// keeps the jobs of a node that lost its connection until it reconnects or the grace window ends
+func (s *TcpServer) disconnectNode(nodeName string) {
+	jobs, err := s.store.JobsFromNodeWithStatus(nodeName, structs.JOB_STATUS_SCHEDULED)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%v\n", err)
+		return
+	}
+	if len(jobs) == 0 {
+		return
+	}
+
+	grace := s.config.NodeLostGraceMs * time.Millisecond
+	fmt.Printf("Keep %d jobs of agent %s for %v\n", len(jobs), nodeName, grace)
+	s.disconnected.Add(nodeName, structs.NowMs() + int64(grace / time.Millisecond))
+}
+
+// compares the jobs an agent reports in its handshake with the ones scheduled on it.
+// scheduled jobs the agent doesn't know are lost. jobs the agent runs but shouldn't (e.g.
+// because they have been requeued after the grace window) are cancelled on the agent
+func (s *TcpServer) reconcileNode(node *Node, reported []string) {
+	if s.disconnected.Remove(node.Name) {
+		fmt.Printf("Agent %s reconnected with %d jobs\n", node.Name, len(reported))
+	}
+
+	stored, err := s.store.JobsFromNodeWithStatus(node.Name, structs.JOB_STATUS_SCHEDULED)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%v\n", err)
+		return
+	}
+
+	isReported := make(map[string]bool, len(reported))
+	for _, jobId := range reported {
+		isReported[jobId] = true
+	}
+	isStored := make(map[string]bool, len(stored))
+	lost := make([]*structs.Job, 0)
+	for _, job := range stored {
+		isStored[job.Id] = true
+		if isReported[job.Id] == false {
+			lost = append(lost, job)
+		}
+	}
+	s.failJobsOfNode(node.Name, lost, "Agent doesn't run the job anymore")
+
+	for _, jobId := range reported {
+		if isStored[jobId] {
+			continue
+		}
+		job, err := s.store.JobById(jobId)
+		if err != nil || job == nil {
+			continue
+		}
+		fmt.Printf("Agent %s runs job %s (%s) that isn't scheduled there anymore. Cancel it\n", node.Name, job.Id, job.Identifier)
+		s.sendCancelRequest(node, job, 0)
+	}
+}
+
+// fails the jobs of agents that didn't come back in time
+func (s *TcpServer) lostNodeLoop() {
+	for {
+		time.Sleep(1 * time.Second)
+
+		for _, nodeName := range s.disconnected.Expired(structs.NowMs()) {
+			jobs, err := s.store.JobsFromNodeWithStatus(nodeName, structs.JOB_STATUS_SCHEDULED)
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "%v\n", err)
+				continue
+			}
+			s.failJobsOfNode(nodeName, jobs, "Node died")
+		}
+	}
+}
@@ -0,0 +1,81 @@
+package server
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	s "taylor/lib/structs"
+	"taylor/lib/tcp"
+)
+
+func scheduledJob(identifier string, agentName string, retry s.RetryPolicy) *s.Job {
+	job := (&s.Job{Identifier: identifier, Retry: retry}).NewInstance()
+	job.Status = s.JOB_STATUS_SCHEDULED
+	job.AgentName = agentName
+	job.Attempts = []s.JobAttempt{s.JobAttempt{Attempt: 1, AgentName: agentName, StartedAt: s.NowMs()}}
+	return job
+}
+
+func TestReconcileOnHandshake(t *testing.T) {
+	retryOnNodeLost := s.RetryPolicy{MaxAttempts: 3, RetryOn: []string{s.RETRY_ON_NODE_LOST}}
+	reported := scheduledJob("reported", "agent", s.RetryPolicy{})
+	lost := scheduledJob("lost", "agent", retryOnNodeLost)
+	lostForGood := scheduledJob("lost-for-good", "agent", s.RetryPolicy{})
+	// requeued after the grace window, the agent still runs it
+	unknown := (&s.Job{Identifier: "unknown"}).NewInstance()
+	store := newFakeStore(reported, lost, lostForGood, unknown)
+
+	tcpServer, cleanup := newTestTcpServer(t, store)
+	defer cleanup()
+	tcpServer.disconnected.Add("agent", s.NowMs() + 60000)
+
+	serverEnd, agentEnd := net.Pipe()
+	defer agentEnd.Close()
+	go tcpServer.handleConn(tcp.NewConn(serverEnd))
+
+	agent := tcp.NewConn(agentEnd)
+	err := agent.WriteMessage(tcp.MsgHandshakeInitial{
+		MsgBase:	tcp.MsgBase{Command: tcp.MSG_HANDSHAKE_INITIAL, NodeName: "agent"},
+		MsgAgentInfo:	tcp.MsgAgentInfo{Capacity: 4},
+		NodeType:	"agent",
+		Jobs:		[]string{reported.Id, unknown.Id},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	message, _, err := agent.ReadMessage()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if response, ok := message.(tcp.MsgHandshakeResponse); ok == false || response.Accepted == false {
+		t.Fatal("Handshake not accepted", message)
+	}
+
+	// the lost jobs are handled before the cancel requests go out
+	select {
+	case pair := <-tcpServer.cliChan:
+		cancel, ok := pair.payload.(*tcp.MsgJobCancelRequest)
+		if ok == false || pair.node.Name != "agent" || cancel.Job.Id != unknown.Id {
+			t.Fatal("Expected cancel request for the unknown job, got", pair.payload)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Agent wasn't asked to cancel the job it shouldn't run")
+	}
+
+	if stored, _ := store.JobById(reported.Id); stored.Status != s.JOB_STATUS_SCHEDULED || stored.AgentName != "agent" {
+		t.Error("Reported job must stay scheduled, has status", stored.Status)
+	}
+	if stored, _ := store.JobById(lost.Id); stored.Status != s.JOB_STATUS_WAITING || stored.AgentName != "" {
+		t.Error("Lost job that retries on node loss must wait again, has status", stored.Status)
+	}
+	if stored, _ := store.JobById(lostForGood.Id); stored.Status != s.JOB_STATUS_ERROR {
+		t.Error("Lost job without retries must fail, has status", stored.Status)
+	}
+	if stored, _ := store.JobById(unknown.Id); stored.Status != s.JOB_STATUS_WAITING {
+		t.Error("Job the agent shouldn't run must stay as it is, has status", stored.Status)
+	}
+	if tcpServer.disconnected.Remove("agent") {
+		t.Error("Reconnected agent must not count as disconnected anymore")
+	}
+}
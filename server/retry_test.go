@@ -0,0 +1,104 @@
+package server
+
+import (
+	"testing"
+
+	s "taylor/lib/structs"
+)
+
+func assertRetryAt(t *testing.T, job *s.Job, before int64, backoffMs int64) {
+	if job.RetryAt < before + backoffMs || job.RetryAt > s.NowMs() + backoffMs {
+		t.Fatal("Job must be backed off by", backoffMs, "ms, retry_at is", job.RetryAt - before, "ms away")
+	}
+}
+
+func TestDeregisterRequeuesFailedJob(t *testing.T) {
+	retry := s.RetryPolicy{MaxAttempts: 3, BackoffMs: 1000, BackoffFactor: 3, MaxBackoffMs: 2000, RetryOn: []string{s.RETRY_ON_EXIT_ERROR}}
+	job := scheduledJob("job", "agent", retry)
+	job.GpuIndices = []int{1}
+	job.Progress = 0.5
+	store := newFakeStore(job)
+	tcpServer, cleanup := newTestTcpServer(t, store)
+	defer cleanup()
+
+	for attempt, backoffMs := range []int64{1000, 2000} {
+		before := s.NowMs()
+		if err := tcpServer.deregisterScheduledJob(job, s.JOB_STATUS_ERROR, "exit status 1", s.RETRY_ON_EXIT_ERROR); err != nil {
+			t.Fatal(err)
+		}
+		stored, _ := store.JobById(job.Id)
+		if stored.Status != s.JOB_STATUS_WAITING || stored.AgentName != "" || len(stored.GpuIndices) != 0 || stored.Progress != 0 {
+			t.Fatal("Failed job must be back in the queue without agent, gpus and progress, is", stored)
+		}
+		assertInt(t, len(stored.Attempts), attempt + 1)
+		if last := stored.Attempts[attempt]; last.Status != s.JOB_STATUS_ERROR || last.Reason != "exit status 1" || last.EndedAt == 0 {
+			t.Fatal("Failed attempt must be closed, is", last)
+		}
+		assertRetryAt(t, stored, before, backoffMs)
+
+		if err := tcpServer.registerScheduledJob(stored, "agent"); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// no attempts left
+	if err := tcpServer.deregisterScheduledJob(job, s.JOB_STATUS_ERROR, "exit status 1", s.RETRY_ON_EXIT_ERROR); err != nil {
+		t.Fatal(err)
+	}
+	stored, _ := store.JobById(job.Id)
+	if stored.Status != s.JOB_STATUS_ERROR {
+		t.Fatal("Job without attempts left must fail, is", stored.Status)
+	}
+	assertInt(t, len(stored.Attempts), 3)
+}
+
+func TestDeregisterOnlyRetriesPolicyFailures(t *testing.T) {
+	retry := s.RetryPolicy{MaxAttempts: 3, BackoffMs: 1000, BackoffFactor: 2, RetryOn: []string{s.RETRY_ON_EXIT_ERROR}}
+	lost := scheduledJob("lost", "agent", retry)
+	cancelled := scheduledJob("cancelled", "agent", retry)
+	store := newFakeStore(lost, cancelled)
+	tcpServer, cleanup := newTestTcpServer(t, store)
+	defer cleanup()
+
+	tcpServer.deregisterScheduledJob(lost, s.JOB_STATUS_ERROR, "Node died", s.RETRY_ON_NODE_LOST)
+	tcpServer.deregisterScheduledJob(cancelled, s.JOB_STATUS_CANCEL, "", s.RETRY_ON_EXIT_ERROR)
+	if stored, _ := store.JobById(lost.Id); stored.Status != s.JOB_STATUS_ERROR {
+		t.Fatal("Job must not be retried on failures outside of its policy, is", stored.Status)
+	}
+	if stored, _ := store.JobById(cancelled.Id); stored.Status != s.JOB_STATUS_CANCEL {
+		t.Fatal("Cancelled job must not be retried, is", stored.Status)
+	}
+}
+
+func TestRejectedOfferIgnoresInterrupts(t *testing.T) {
+	retry := s.RetryPolicy{MaxAttempts: 2, BackoffMs: 1000, BackoffFactor: 2, RetryOn: []string{s.RETRY_ON_REJECTED}}
+	job := (&s.Job{Identifier: "preempted", Retry: retry}).NewInstance()
+	job.Attempts = []s.JobAttempt{
+		s.JobAttempt{Attempt: 1, AgentName: "a", Status: s.JOB_STATUS_INTERRUPT},
+		s.JobAttempt{Attempt: 2, AgentName: "a", Status: s.JOB_STATUS_INTERRUPT},
+	}
+	store := newFakeStore(job)
+	tcpServer, cleanup := newTestTcpServer(t, store)
+	defer cleanup()
+
+	// the preemptions don't count, one attempt is left
+	before := s.NowMs()
+	if err := tcpServer.handleRejectedJob(job, "b", "busy"); err != nil {
+		t.Fatal(err)
+	}
+	stored, _ := store.JobById(job.Id)
+	if stored.Status != s.JOB_STATUS_WAITING {
+		t.Fatal("Preempted job must be retried after its first rejection, is", stored.Status)
+	}
+	assertInt(t, len(stored.Attempts), 3)
+	assertRetryAt(t, stored, before, 1000)
+
+	if err := tcpServer.handleRejectedJob(job, "b", "busy"); err != nil {
+		t.Fatal(err)
+	}
+	stored, _ = store.JobById(job.Id)
+	if stored.Status != s.JOB_STATUS_ERROR {
+		t.Fatal("Job must fail once its attempts are used up, is", stored.Status)
+	}
+	assertInt(t, len(stored.Attempts), 4)
+}
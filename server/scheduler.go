@@ -10,19 +10,27 @@ import (
 	"taylor/server/database"
 	"taylor/lib/structs"
 	"taylor/lib/util"
-	"taylor/lib/tcp"
 )
 
 type Scheduler struct {
-	sleepMs		time.Duration
+	interval	time.Duration
+	trigger		*Trigger
+	placement	Placement
 	tcpServer	*TcpServer
-	store		*database.Store
+	store		database.JobStore
 	config		Config
+	// why the waiting jobs didn't get scheduled in the last pass (by job id)
+	blockedMtx	*sync.Mutex
+	blocked		map[string]string
 }
 
 type NodeJobMap struct {
 	node *Node
 	job  *structs.Job
+	// gpus of node the job gets pinned to
+	gpus []int
+	// addresses of the nodes of all members if job is part of a gang
+	peers []string
 }
 
 func removeNode(slice []*Node, s int) []*Node{
@@ -40,12 +48,48 @@ func nodesWithCapabilities(restrict []string, nodes []*Node) []*Node{
 	return res
 }
 
+// the selector of a job, parsed once. an empty selector matches every node, one that doesn't
+// parse matches none (the api doesn't let such jobs in)
+type jobSelector struct {
+	selector	util.Selector
+	err		error
+}
+
+func selectorOf(job *structs.Job) jobSelector {
+	selector, err := util.ParseSelector(job.Selector)
+	return jobSelector{selector: selector, err: err}
+}
+
+func (js jobSelector) matches(node *Node) bool {
+	return js.err == nil && js.selector.Matches(node.Labels)
+}
+
+func nodesMatchingSelector(selector jobSelector, nodes []*Node) []*Node {
+	res := []*Node{}
+	for _, node := range nodes {
+		if selector.matches(node) {
+			res = append(res, node)
+		}
+	}
+	return res
+}
+
 func sortCapableNodes(nodes []*Node) {
 	sort.Slice(nodes[:], func (i int, j int) bool {
 		return len(nodes[i].Capabilities) < len(nodes[j].Capabilities)
 	})
 }
 
+func uncordonedNodes(nodes []*Node) []*Node {
+	uncordoned := make([]*Node, 0, len(nodes))
+	for _, node := range nodes {
+		if node.IsCordoned() == false {
+			uncordoned = append(uncordoned, node)
+		}
+	}
+	return uncordoned
+}
+
 func freeNodes(nodes []*Node) []*Node {
 
 	freeNodes := make([]*Node, 0)
@@ -57,6 +101,53 @@ func freeNodes(nodes []*Node) []*Node {
 	return freeNodes
 }
 
+// indices of the gpus of node that fulfill gpuReqs (in the order of gpuReqs). nil if the node can't fulfill them
+func matchGpus(node *Node, gpuReqs []structs.GpuRequirement) []int {
+	// for each gpu requirement, go through nodes info and see if we find match
+	// if we find one, we store it in LUT usedInfos.
+	matched := make([]int, 0, len(gpuReqs))
+	usedInfos := make(map[int]bool, len(node.GpuInfo))
+	// gpus that are pinned to other jobs can't be used
+	for _, k := range node.GpusReserved {
+		usedInfos[k] = true
+	}
+	for _, gpuReq := range gpuReqs {
+		foundMatch := false
+		for k, gpuInfo := range node.GpuInfo {
+			if usedInfos[k] == true {
+				continue
+			}
+			if gpuReq.Type != "" && gpuInfo.NameGPU != gpuReq.Type {
+				continue
+			}
+			if gpuReq.MemoryAvailable > -1 && gpuInfo.MemoryFreeMB < gpuReq.MemoryAvailable {
+				continue
+			}
+			foundMatch = true
+			usedInfos[k] = true
+			matched = append(matched, k)
+			break
+		}
+		// we havent found a match for our gpu
+		if foundMatch == false {
+			return nil
+		}
+	}
+	return matched
+}
+
+// pins the gpus to the job and substracts req. memory from available memory so that we can account for it in the next iteration
+func reserveGpus(node *Node, gpuReqs []structs.GpuRequirement) []int {
+	gpus := matchGpus(node, gpuReqs)
+	for idx, k := range gpus {
+		if gpuReqs[idx].MemoryAvailable > 0 {
+			node.GpuInfo[k].MemoryFreeMB -= gpuReqs[idx].MemoryAvailable
+		}
+		node.GpusReserved = append(node.GpusReserved, k)
+	}
+	return gpus
+}
+
 func nodesWhichFulfillGpuRequirements(nodes []*Node, gpuReqs []structs.GpuRequirement) []*Node {
 	outNodes := make([]*Node, 0)
 
@@ -74,44 +165,12 @@ func nodesWhichFulfillGpuRequirements(nodes []*Node, gpuReqs []structs.GpuRequir
 	}
 
 	// sort so that nodes with least gpus are first. we dont want to waste them
-	sort.Slice(proxyNodes[:], func (i int, j int) bool {
+	sort.SliceStable(proxyNodes[:], func (i int, j int) bool {
 		return len(proxyNodes[i].GpuInfo) < len(proxyNodes[j].GpuInfo)
 	})
 
 	for _, n := range proxyNodes{
-		// for each gpu requirement, go through nodes info and see if we find match
-		// if we find one, we store it in LUT usedInfos.
-		// if we found enough, we are done
-		foundN := 0
-		usedInfos := make(map[int]int, len(n.GpuInfo))
-		for _, gpuReq := range gpuReqs {
-			foundMatch := false
-			for k, gpuInfo := range n.GpuInfo {
-				if usedInfos[k] == 1 {
-					continue
-				}
-				if gpuReq.Type != "" && gpuInfo.NameGPU != gpuReq.Type {
-					continue
-				}
-				if gpuReq.MemoryAvailable > -1 && gpuInfo.MemoryFreeMB < gpuReq.MemoryAvailable {
-					continue
-				}
-				foundMatch = true
-				// substract req. memory from available memory so that we can account for it in the next iteration
-				n.GpuInfo[k].MemoryFreeMB -= gpuReq.MemoryAvailable
-				usedInfos[k] = 1
-				break
-			}
-			// we havent found a match for our gpu
-			if foundMatch {
-				foundN++
-			}
-			if foundN == len(gpuReqs) {
-				break
-			}
-		}
-		// we found enough and we can append the node to the array
-		if foundN == len(gpuReqs) {
+		if matchGpus(n, gpuReqs) != nil {
 			outNodes = append(outNodes, n)
 		}
 	}
@@ -119,133 +178,574 @@ func nodesWhichFulfillGpuRequirements(nodes []*Node, gpuReqs []structs.GpuRequir
 	return outNodes
 }
 
+func nodesWithResources(nodes []*Node, req structs.ResourceRequirement) []*Node {
+	res := make([]*Node, 0, len(nodes))
+	for _, node := range nodes {
+		if node.Resources.Fulfills(req) {
+			res = append(res, node)
+		}
+	}
+	return res
+}
+
 func printNodes(nodes []*Node) {
 	for _, n := range nodes {
 		fmt.Printf("%+v\n", *n)
 	}
 }
 
-func distribute(nodesIn []*Node, jobs []*structs.Job) []NodeJobMap{
+// deep copy of a node. we dont want to modify original data
+func copyNode(node *Node) *Node {
+	copy := &Node{
+		Name:	      node.Name,
+		Capabilities: node.Capabilities,
+		Labels:       node.Labels,
+		Capacity:     node.Capacity,
+		JobsRunning:  node.JobsRunning,
+		Resources:    node.Resources,
+		GpusReserved: append([]int{}, node.GpusReserved...),
+		Address:      node.Address,
+		Identifiers:  append([]string{}, node.Identifiers...),
+		Maintenance:  node.Maintenance,
+		GpuInfo:      make([]structs.GpuInfo, len(node.GpuInfo)),
+	}
+	for k, gpuInfo := range node.GpuInfo {
+		copy.GpuInfo[k] = structs.GpuInfo{
+			NameGPU:	gpuInfo.NameGPU,
+			Temperature:	gpuInfo.Temperature,
+			MemoryTotalMB:	gpuInfo.MemoryTotalMB,
+			MemoryFreeMB:	gpuInfo.MemoryFreeMB,
+			Utilization:	gpuInfo.Utilization,
+		}
+	}
+	return copy
+}
 
-	proxyNodes := make([]*Node, len(nodesIn ))
+// picks a node for job and takes the space the job needs from it. nil if no node fits
+func placeJob(nodes []*Node, job *structs.Job, placement Placement) *NodeJobMap {
+	// find all nodes that take new jobs and have some space left
+	freeNodes := freeNodes(uncordonedNodes(nodes))
+	if len(freeNodes) == 0 {
+		return nil
+	}
 
-	// deep copy of each node. we dont want to modify original data
-	for idx, node := range nodesIn {
-		copy := &Node{
-			Name:	      node.Name,
-			Capabilities: node.Capabilities,
-			Capacity:     node.Capacity,
-			JobsRunning:  node.JobsRunning,
-			GpuInfo:      make([]structs.GpuInfo, len(node.GpuInfo)),
+	// filter out all nodes that don't have required capability tags
+	capableNodes := nodesWithCapabilities(job.Restrict, freeNodes )
+	if len(capableNodes) == 0 {
+		return nil
+	}
+
+	// filter out all nodes whose labels don't match the selector of the job
+	selector := selectorOf(job)
+	if selector.err != nil {
+		fmt.Fprintf(os.Stderr, "Job %s: %v\n", job.Id, selector.err)
+		return nil
+	}
+	capableNodes = nodesMatchingSelector(selector, capableNodes)
+	if len(capableNodes) == 0 {
+		return nil
+	}
+
+	// filter out all nodes the job is not allowed on by its affinity
+	capableNodes = nodesFulfillingAffinity(job, capableNodes)
+	if len(capableNodes) == 0 {
+		return nil
+	}
+
+	// filter out all nodes that don't have enough cpu and memory left
+	capableNodes = nodesWithResources(capableNodes, job.Resources)
+	if len(capableNodes) == 0 {
+		return nil
+	}
+
+	// sort by capability. the ones with the least comes first
+	sortCapableNodes(capableNodes)
+
+	if len(job.GpuRequirement) > 0 {
+		// filter out all nodes that don't fulfill the gpu requirements
+		gpuNodes := nodesWhichFulfillGpuRequirements(capableNodes, job.GpuRequirement)
+		if len(gpuNodes) == 0 {
+			return nil
 		}
-		for k, gpuInfo := range node.GpuInfo {
-			copy.GpuInfo[k] = structs.GpuInfo{
-				NameGPU:	gpuInfo.NameGPU,
-				Temperature:	gpuInfo.Temperature,
-				MemoryTotalMB:	gpuInfo.MemoryTotalMB,
-				MemoryFreeMB:	gpuInfo.MemoryFreeMB,
-				Utilization:	gpuInfo.Utilization,
+
+		capableNodes = gpuNodes
+	}
+
+	// we have now multiple capable nodes. the preferred ones go first, then let the placement strategy decide
+	capableNodes = preferredNodes(job, capableNodes)
+	node := placement.strategyFor(job).Pick(job, capableNodes)
+	gpus := reserveGpus(node, job.GpuRequirement)
+	node.Resources.Allocate(job.Resources)
+	node.JobsRunning++
+	node.Identifiers = append(node.Identifiers, job.Identifier)
+
+	return &NodeJobMap{
+		node: node,
+		job: job,
+		gpus: gpus,
+	}
+}
+
+// places all members of a gang on distinct nodes. works on copies of nodes. returns the
+// copies with the members placed or nil if not all members fit
+func placeGang(nodes []*Node, members []*structs.Job, placement Placement) ([]*Node, []NodeJobMap) {
+	proxyNodes := make([]*Node, len(nodes))
+	for idx, node := range nodes {
+		proxyNodes[idx] = copyNode(node)
+	}
+
+	used := make(map[string]bool)
+	maps := make([]NodeJobMap, 0, len(members))
+	for _, member := range members {
+		unused := make([]*Node, 0, len(proxyNodes))
+		for _, node := range proxyNodes {
+			if used[node.Name] == false {
+				unused = append(unused, node)
 			}
 		}
-		proxyNodes[idx] = copy
+		njm := placeJob(unused, member, placement)
+		if njm == nil {
+			return nil, nil
+		}
+		used[njm.node.Name] = true
+		maps = append(maps, *njm)
 	}
 
-	nodeProxyJobMaps := make([]NodeJobMap, 0)
+	peers := make([]string, len(maps))
+	for idx, njm := range maps {
+		peers[idx] = njm.node.Address
+	}
+	for idx := range maps {
+		maps[idx].peers = peers
+	}
+	return proxyNodes, maps
+}
 
+// members of each gang in jobs by gang id, ordered by rank
+func gangsOf(jobs []*structs.Job) map[string][]*structs.Job {
+	gangs := make(map[string][]*structs.Job)
 	for _, job := range jobs {
-		// find all nodes that have some space left
-		freeNodes := freeNodes(proxyNodes)
-		if len(freeNodes) == 0 {
-			break
+		if job.IsGangMember() {
+			gangs[job.GangId] = append(gangs[job.GangId], job)
 		}
+	}
+	for _, members := range gangs {
+		sort.SliceStable(members[:], func (i int, j int) bool {
+			return members[i].GangRank < members[j].GangRank
+		})
+	}
+	return gangs
+}
 
-		// filter out all nodes that don't have required capability tags
-		capableNodes := nodesWithCapabilities(job.Restrict, freeNodes )
-		if len(capableNodes) == 0 {
-			continue
-		}
+// quotas may be nil. jobs that would exceed one are skipped. gangs must be complete
+// (see completeGangs). they are placed when their first member comes up
+func distribute(nodesIn []*Node, jobs []*structs.Job, placement Placement, quotas *QuotaUsage) []NodeJobMap{
+
+	proxyNodes := make([]*Node, len(nodesIn ))
+	for idx, node := range nodesIn {
+		proxyNodes[idx] = copyNode(node)
+	}
+
+	nodeProxyJobMaps := make([]NodeJobMap, 0)
+	gangs := gangsOf(jobs)
+	gangsDone := make(map[string]bool)
 
-		// sort by capability. the ones with the least comes first
-		sortCapableNodes(capableNodes)
+	for _, job := range jobs {
+		if job.IsGangMember() {
+			if gangsDone[job.GangId] {
+				continue
+			}
+			gangsDone[job.GangId] = true
+
+			// all or nothing. that goes for the quotas too
+			members := gangs[job.GangId]
+			trial := quotas.clone()
+			admitted := true
+			for _, member := range members {
+				if trial.Admit(member) == false {
+					quotas.block(members, trial.Blocked()[member.Id])
+					admitted = false
+					break
+				}
+				trial.Take(member)
+			}
+			if admitted == false {
+				continue
+			}
 
-		if len(job.GpuRequirement) > 0 {
-			// filter out all nodes that don't fulfill the gpu requirements
-			gpuNodes := nodesWhichFulfillGpuRequirements(capableNodes, job.GpuRequirement)
-			if len(gpuNodes) == 0 {
+			placedNodes, maps := placeGang(proxyNodes, members, placement)
+			if maps == nil {
 				continue
 			}
+			proxyNodes = placedNodes
+			quotas.adopt(trial)
+			nodeProxyJobMaps = append(nodeProxyJobMaps, maps...)
+			continue
+		}
 
-			capableNodes = gpuNodes
+		// jobs over quota stay in the queue no matter how much space there is
+		if quotas.Admit(job) == false {
+			continue
 		}
 
-		// we have now multiple capable nodes. take first one
-		// To-DO: interesting step would be to somehow calculate now the best one to take in order to optimize for some metric (e.g. maximize utilization)
-		nodeProxyJobMaps = append(nodeProxyJobMaps, NodeJobMap{
-			node: capableNodes[0],
-			job: job,
-		})
-		capableNodes[0].JobsRunning++
+		njm := placeJob(proxyNodes, job, placement)
+		if njm == nil {
+			continue
+		}
+		quotas.Take(job)
+		nodeProxyJobMaps = append(nodeProxyJobMaps, *njm)
 	}
 
 	return nodeProxyJobMaps
 }
 
-func sortJobsByPriority(jobs []*structs.Job) {
-	sort.Slice(jobs[:], func (i int, j int) bool {
-		return jobs[i].Priority > jobs[j].Priority
-	})
+func dueJobs(jobs []*structs.Job, nowMs int64) []*structs.Job {
+	due := make([]*structs.Job, 0, len(jobs))
+	for _, job := range jobs {
+		if job.IsDue(nowMs) {
+			due = append(due, job)
+		}
+	}
+	return due
 }
 
+// jobs that aren't offered to an agent right now
+func unofferedJobs(jobs []*structs.Job, offers *OfferTable) []*structs.Job {
+	res := make([]*structs.Job, 0, len(jobs))
+	for _, job := range jobs {
+		if offers.IsOffered(job.Id) == false {
+			res = append(res, job)
+		}
+	}
+	return res
+}
 
-func (s *Scheduler) schedule () {
-	for {
-		time.Sleep(s.sleepMs * time.Millisecond)
+// state of the nodes after the jobs of distributed have been placed
+func nodesAfter(nodes []*Node, distributed []NodeJobMap) []*Node {
+	proxies := make(map[string]*Node)
+	for _, njm := range distributed {
+		proxies[njm.node.Name] = njm.node
+	}
+	res := make([]*Node, len(nodes))
+	for idx, node := range nodes {
+		if proxy, in := proxies[node.Name]; in {
+			res[idx] = proxy
+		} else {
+			res[idx] = node
+		}
+	}
+	return res
+}
+
+func unplacedJobs(jobs []*structs.Job, distributed []NodeJobMap) []*structs.Job {
+	placed := make(map[string]bool)
+	for _, njm := range distributed {
+		placed[njm.job.Id] = true
+	}
+	res := make([]*structs.Job, 0)
+	for _, job := range jobs {
+		if placed[job.Id] == false {
+			res = append(res, job)
+		}
+	}
+	return res
+}
+
+// offers that haven't been answered yet occupy a slot and resources on the node
+func nodesWithPendingOffers(nodes []*Node, pending map[string][]*structs.Job) []*Node {
+	res := make([]*Node, 0, len(nodes))
+	for _, node := range nodes {
+		copy := *node
+		copy.GpusReserved = append([]int{}, node.GpusReserved...)
+		copy.Identifiers = append([]string{}, node.Identifiers...)
+		for _, job := range pending[node.Name] {
+			copy.JobsRunning++
+			copy.Resources.Allocate(job.Resources)
+			copy.GpusReserved = append(copy.GpusReserved, job.GpuIndices...)
+			copy.Identifiers = append(copy.Identifiers, job.Identifier)
+		}
+		res = append(res, &copy)
+	}
+	return res
+}
+
+
+// earliest time (in ms) at which one of the delayed jobs becomes due. 0 if there is none
+func nextDueAt(jobs []*structs.Job, nowMs int64) int64 {
+	var next int64 = 0
+	for _, job := range jobs {
+		if job.IsDue(nowMs) {
+			continue
+		}
+		due := job.RunAt
+		if job.RetryAt > due {
+			due = job.RetryAt
+		}
+		if next == 0 || due < next {
+			next = due
+		}
+	}
+	return next
+}
+
+// jobs of all that are not in some
+func jobsNotIn(all []*structs.Job, some []*structs.Job) []*structs.Job {
+	in := make(map[string]bool, len(some))
+	for _, job := range some {
+		in[job.Id] = true
+	}
+	res := make([]*structs.Job, 0)
+	for _, job := range all {
+		if in[job.Id] == false {
+			res = append(res, job)
+		}
+	}
+	return res
+}
+
+func delayReason(job *structs.Job) string {
+	if job.RetryAt > job.RunAt {
+		return fmt.Sprintf("Backing off until %s", time.Unix(0, job.RetryAt * int64(time.Millisecond)).Format(time.RFC3339))
+	}
+	return fmt.Sprintf("Delayed until %s", time.Unix(0, job.RunAt * int64(time.Millisecond)).Format(time.RFC3339))
+}
+
+func (s *Scheduler) setBlocked(blocked map[string]string) {
+	s.blockedMtx.Lock()
+	defer s.blockedMtx.Unlock()
+
+	s.blocked = blocked
+}
+
+// why a waiting job didn't get scheduled in the last pass. empty if we don't know (yet)
+func (s *Scheduler) BlockedReason(jobId string) string {
+	s.blockedMtx.Lock()
+	defer s.blockedMtx.Unlock()
+
+	return s.blocked[jobId]
+}
 
-		jobs, err := s.store.JobsWithStatus(structs.JOB_STATUS_WAITING, 0)
+// gangs whose members are not all in jobs have to wait (e.g. because some are still offered)
+func completeGangs(jobs []*structs.Job) []*structs.Job {
+	gangs := gangsOf(jobs)
+	res := make([]*structs.Job, 0, len(jobs))
+	for _, job := range jobs {
+		if job.IsGangMember() == false || len(gangs[job.GangId]) == job.GangSize {
+			res = append(res, job)
+		}
+	}
+	return res
+}
+
+// gangs that didn't start together (e.g. a member's offer expired while the others run) or lost a
+// member are cancelled as a whole. returns the jobs that are still waiting
+func (s *Scheduler) checkGangs(jobs []*structs.Job) []*structs.Job {
+	broken := make(map[string]bool)
+	for gangId, waiting := range gangsOf(jobs) {
+		if len(waiting) == waiting[0].GangSize {
+			continue
+		}
+		members, err := s.store.JobsInGang(gangId)
 		if err != nil {
 			fmt.Fprintf(os.Stderr, "Error %v\n", err)
-			// what shall we do?
-			panic(err)
-		}
-		if len(jobs) == 0 {
 			continue
 		}
 
+		reason := ""
+		stuck := false
+		for _, member := range members {
+			switch (member.Status) {
+			case structs.JOB_STATUS_WAITING:
+				// an agent that accepts the offer releases it after the job is registered as scheduled
+				stuck = stuck || s.tcpServer.Offers().IsOffered(member.Id) == false
+			case structs.JOB_STATUS_SCHEDULED:
+				if reason == "" {
+					reason = fmt.Sprintf("Gang member %s didn't start together with the others", member.Id)
+				}
+			default:
+				reason = fmt.Sprintf("Gang member %s didn't succeed", member.Id)
+			}
+		}
+		if stuck && reason != "" {
+			s.tcpServer.cancelGang(gangId, reason)
+			broken[gangId] = true
+		}
+	}
+
+	res := make([]*structs.Job, 0, len(jobs))
+	for _, job := range jobs {
+		if broken[job.GangId] == false {
+			res = append(res, job)
+		}
+	}
+	return res
+}
+
+// jobs that count against the quotas: the running ones and the ones that are offered
+func activeJobs(running []*structs.Job, pending map[string][]*structs.Job) []*structs.Job {
+	active := append([]*structs.Job{}, running...)
+	for _, jobs := range pending {
+		active = append(active, jobs...)
+	}
+	return active
+}
+
+// one scheduling pass. returns the time (in ms) when the next delayed job becomes due (or 0)
+func (s *Scheduler) pass() int64 {
+	jobs, err := s.store.JobsWithStatus(structs.JOB_STATUS_WAITING, 0)
+	if err != nil {
+		// the next event or the interval brings the next try. the reasons of the last pass stay
+		fmt.Fprintf(os.Stderr, "Error %v\n", err)
+		return 0
+	}
+	blocked := make(map[string]string)
+	defer s.setBlocked(blocked)
+
+	jobs = s.checkGangs(jobs)
+	if len(jobs) == 0 {
+		return 0
+	}
+
+	// hold back jobs that are backed off or whose upstream jobs aren't done yet
+	now := structs.NowMs()
+	nextDue := nextDueAt(jobs, now)
+	due := dueJobs(jobs, now)
+	for _, job := range jobsNotIn(jobs, due) {
+		blocked[job.Id] = delayReason(job)
+	}
+	jobs = s.resolveDependencies(due)
+	for _, job := range jobsNotIn(due, jobs) {
+		if job.Status == structs.JOB_STATUS_WAITING {
+			blocked[job.Id] = "Waiting for upstream jobs"
+		}
+	}
+
+	// jobs that are offered already must not go to a second agent
+	offers := s.tcpServer.Offers()
+	unoffered := unofferedJobs(jobs, offers)
+	for _, job := range jobsNotIn(jobs, unoffered) {
+		blocked[job.Id] = "Offered to an agent"
+	}
+	jobs = completeGangs(unoffered)
+	for _, job := range jobsNotIn(unoffered, jobs) {
+		blocked[job.Id] = fmt.Sprintf("Waiting for the other members of gang %s", job.GangId)
+	}
+	if len(jobs) == 0 {
+		return nextDue
+	}
+
+	running, err := s.store.JobsWithStatus(structs.JOB_STATUS_SCHEDULED, 0)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error %v\n", err)
+		return nextDue
+	}
+
+	// jobs that wait long get a higher priority so that they don't starve
+	applyAging(jobs, now, s.config.Scheduler.Aging)
+	if s.config.Scheduler.FairShare.Enabled {
+		usage := s.tcpServer.Usage().UsageWithRunning(running, now)
+		jobs = fairShareOrder(jobs, usage, s.config.Scheduler.FairShare)
+	} else {
 		sortJobsByPriority(jobs)
+	}
 
-		distributed := distribute(s.tcpServer.Nodes(), jobs)
-
-		// schedule all jobs on corresponding nodes
-		var wg sync.WaitGroup
-		for _, v := range distributed {
-			fmt.Printf("Schedule job %+v to node %+v\n", v.job, v.node) 
-			wg.Add(1)
-			go func (njm NodeJobMap) {
-				defer wg.Done()
-
-				payload := &tcp.MsgNewJobOffer{
-					MsgBase: tcp.MsgBase{
-						Command: tcp.MSG_NEW_JOB_OFFER,
-						NodeName: s.config.Name,
-					},
-					Job: *njm.job,
-				}
+	pending := offers.PendingPerNode()
+	quotas := NewQuotaUsage(s.config.Scheduler.Quotas, activeJobs(running, pending))
+	nodes := s.clusterState(running, pending)
+	distributed := distribute(nodes, jobs, s.placement, quotas)
+
+	// jobs over quota must not push others away
+	unplaced := make([]*structs.Job, 0)
+	for _, job := range unplacedJobs(jobs, distributed) {
+		if reason, in := quotas.Blocked()[job.Id]; in {
+			blocked[job.Id] = reason
+		} else {
+			unplaced = append(unplaced, job)
+		}
+	}
 
-				s.tcpServer.Unicast(njm.node, payload)
-			}(v)
+	if s.config.Scheduler.Preemption.Enabled {
+		s.preempt(nodesAfter(nodes, distributed), unplaced)
+	}
+	for _, job := range unplaced {
+		if s.tcpServer.Preemptions().HasVictims(job.Id) {
+			blocked[job.Id] = "Waiting for preempted jobs to stop"
+		} else {
+			blocked[job.Id] = "No agent can take the job right now. See explain"
 		}
+	}
+
+	// schedule all jobs on corresponding nodes
+	var wg sync.WaitGroup
+	for _, v := range distributed {
+		fmt.Printf("Schedule job %+v to node %+v\n", v.job, v.node) 
+		wg.Add(1)
+		go func (njm NodeJobMap) {
+			defer wg.Done()
+
+			offered := *njm.job
+			offered.GpuIndices = njm.gpus
+			if offered.GpuIndices == nil {
+				offered.GpuIndices = make([]int, 0)
+			}
+			offered.GangPeers = njm.peers
 
-		wg.Wait()
+			if s.tcpServer.OfferJob(njm.node, &offered) == false {
+				fmt.Printf("Job %s is already offered to an agent\n", njm.job.Id)
+			}
+		}(v)
 	}
+
+	wg.Wait()
+	return nextDue
 }
 
-func StartScheduler(config Config, store *database.Store, server *TcpServer) {
-	scheduler := Scheduler{
-		sleepMs: 10000,
+// runs a pass whenever the trigger fires (new job, job done, node changes, ...). the
+// interval is only a fallback in case we missed an event
+func (s *Scheduler) schedule () {
+	var nextDue int64 = 0
+	for {
+		wait := s.interval * time.Millisecond
+		if nextDue > 0 {
+			untilDue := time.Duration(nextDue - structs.NowMs()) * time.Millisecond
+			if untilDue < wait {
+				wait = untilDue
+			}
+		}
+
+		timer := time.NewTimer(wait)
+		select {
+		case <-s.trigger.C():
+			timer.Stop()
+		case <-timer.C:
+		}
+
+		nextDue = s.pass()
+
+		// expired offers have to be placed again
+		if expiry := s.tcpServer.Offers().NextExpiry(); expiry > 0 && (nextDue == 0 || expiry < nextDue) {
+			nextDue = expiry
+		}
+	}
+}
+
+func StartScheduler(config Config, store database.JobStore, server *TcpServer, trigger *Trigger) (*Scheduler, error) {
+	placement, err := NewPlacement(config.Scheduler)
+	if err != nil {
+		return nil, err
+	}
+
+	scheduler := &Scheduler{
+		placement: placement,
+		interval: config.Scheduler.IntervalMs,
+		trigger: trigger,
 		store: store,
 		tcpServer: server,
 		config: config,
+		blockedMtx: &sync.Mutex{},
+		blocked: make(map[string]string),
 	}
 
 	go scheduler.schedule()
+	return scheduler, nil
 }
@@ -2,7 +2,9 @@ package server
 
 import (
 	"testing"
+	"time"
 	s "taylor/lib/structs"
+	"taylor/lib/util"
 )
 
 func assertSameNodeByName(t *testing.T, n1 *Node, n2 *Node) {
@@ -59,7 +61,7 @@ func TestDistributeOnCapacity(t *testing.T) {
 		},
 	}
 
-	output := distribute(nodesIn, jobs)
+	output := distribute(nodesIn, jobs, Placement{}, nil)
 
 	assertInt(t, len(output), len(jobs)-1)
 
@@ -121,7 +123,7 @@ func TestDistributeOnCapabilities(t *testing.T) {
 		},
 	}
 
-	output := distribute(nodesIn, jobs)
+	output := distribute(nodesIn, jobs, Placement{}, nil)
 	assertInt(t, len(output), len(jobs) - 1)
 
 	assertNodeHasJobAssigned(t, output[0], nodesIn[1], jobs[0])
@@ -211,7 +213,7 @@ func TestDistribute2GpuReq(t *testing.T) {
 		},
 	}
 
-	output := distribute(nodesIn, jobs)
+	output := distribute(nodesIn, jobs, Placement{}, nil)
 
 	assertInt(t, len(output), len(jobs)-2)
 
@@ -291,7 +293,7 @@ func TestDistribute2GpuReqWithMultiGpu(t *testing.T) {
 				},
 			},
 		},
-		// should get scheduled on node c
+		// should not get scheduled because both gpus of node c are pinned to the first job
 		&s.Job{
 			Identifier: "1",
 			GpuRequirement: []s.GpuRequirement{
@@ -307,12 +309,925 @@ func TestDistribute2GpuReqWithMultiGpu(t *testing.T) {
 		},
 	}
 
-	output := distribute(nodesIn, jobs)
+	output := distribute(nodesIn, jobs, Placement{}, nil)
 
-	assertInt(t, len(output), len(jobs)-1)
+	assertInt(t, len(output), len(jobs)-2)
+
+	assertNodeHasJobAssigned(t, output[0], nodesIn[2], jobs[0])
+	assertNodeHasJobAssigned(t, output[1], nodesIn[1], jobs[1])
+	assertNodeHasJobAssigned(t, output[2], nodesIn[0], jobs[4])
+
+	assertInt(t, len(output[0].gpus), 2)
+	assertInt(t, output[0].gpus[0], 0)
+	assertInt(t, output[0].gpus[1], 1)
+	assertInt(t, len(output[2].gpus), 0)
+}
+
+func TestDistributeSkipsReservedGpus(t *testing.T) {
+	nodesIn := []*Node{
+		&Node{
+			Name: "a",
+			Capacity: 3,
+			GpuInfo: []s.GpuInfo{
+				s.GpuInfo {
+					MemoryFreeMB: 8000,
+				},
+				s.GpuInfo {
+					MemoryFreeMB: 8000,
+				},
+			},
+			GpusReserved: []int{0},
+		},
+	}
+
+	jobs := []*s.Job{
+		&s.Job{
+			Identifier: "0",
+			GpuRequirement: []s.GpuRequirement{
+				s.GpuRequirement{
+					MemoryAvailable: -1,
+				},
+			},
+		},
+		// no gpu left
+		&s.Job{
+			Identifier: "1",
+			GpuRequirement: []s.GpuRequirement{
+				s.GpuRequirement{
+					MemoryAvailable: -1,
+				},
+			},
+		},
+	}
+
+	output := distribute(nodesIn, jobs, Placement{}, nil)
+
+	assertInt(t, len(output), 1)
+	assertNodeHasJobAssigned(t, output[0], nodesIn[0], jobs[0])
+	assertInt(t, output[0].gpus[0], 1)
+}
+
+func TestDependencyState(t *testing.T) {
+	jobs := map[string]*s.Job{
+		"done":	     &s.Job{Id: "done", Status: s.JOB_STATUS_SUCCESS},
+		"waiting":   &s.Job{Id: "waiting", Status: s.JOB_STATUS_WAITING},
+		"failed":    &s.Job{Id: "failed", Status: s.JOB_STATUS_ERROR},
+		"cancelled": &s.Job{Id: "cancelled", Status: s.JOB_STATUS_CANCEL},
+	}
+	lookup := func (id string) *s.Job {
+		return jobs[id]
+	}
+
+	cases := []struct {
+		dependsOn []string
+		state	  DependencyState
+		culprit	  string
+	}{
+		{ []string{}, DEPENDENCIES_DONE, "" },
+		{ []string{"done"}, DEPENDENCIES_DONE, "" },
+		{ []string{"done", "waiting"}, DEPENDENCIES_PENDING, "" },
+		{ []string{"waiting", "failed"}, DEPENDENCIES_FAILED, "failed" },
+		{ []string{"done", "cancelled"}, DEPENDENCIES_CANCELLED, "cancelled" },
+		{ []string{"unknown"}, DEPENDENCIES_CANCELLED, "unknown" },
+	}
+
+	for _, c := range cases {
+		state, culprit := dependencyState(&s.Job{DependsOn: c.dependsOn}, lookup)
+		assertInt(t, int(state), int(c.state))
+		if culprit != c.culprit {
+			t.Log("Actual culprit", culprit, " != ", " Expected", c.culprit)
+			t.Fail()
+		}
+	}
+}
+
+func TestBuildJobGraph(t *testing.T) {
+	a := &s.Job{Id: "a"}
+	b := &s.Job{Id: "b", DependsOn: []string{"a"}}
+	c := &s.Job{Id: "c", DependsOn: []string{"a", "b"}}
+	unrelated := &s.Job{Id: "x"}
+
+	graph := buildJobGraph(b, []*s.Job{a, b, c, unrelated})
+
+	if graph.JobId != "b" {
+		t.Fatal("Graph must be the one of b, is", graph.JobId)
+	}
+	assertInt(t, len(graph.Nodes), 3)
+	nodes := make(map[string]bool)
+	for _, node := range graph.Nodes {
+		nodes[node.Id] = true
+	}
+	if nodes["a"] == false || nodes["b"] == false || nodes["c"] == false || nodes["x"] {
+		t.Fatal("Graph must contain a, b and c but not the unrelated job, has", graph.Nodes)
+	}
+
+	// from upstream to downstream
+	assertInt(t, len(graph.Edges), 3)
+	edges := make(map[GraphEdge]bool)
+	for _, edge := range graph.Edges {
+		edges[edge] = true
+	}
+	for _, expected := range []GraphEdge{{From: "a", To: "b"}, {From: "a", To: "c"}, {From: "b", To: "c"}} {
+		if edges[expected] == false {
+			t.Fatal("Missing edge", expected, "in", graph.Edges)
+		}
+	}
+
+	// deleted upstream jobs show up as such
+	graph = buildJobGraph(b, []*s.Job{b})
+	for _, node := range graph.Nodes {
+		if node.Id == "a" && node.Status != s.JOB_STATUS_DELETE {
+			t.Fatal("Missing upstream job must be shown as deleted, is", node.Status)
+		}
+	}
+}
+
+func TestResolveDependencies(t *testing.T) {
+	done := &s.Job{Id: "done", Status: s.JOB_STATUS_SUCCESS}
+	failed := &s.Job{Id: "failed", Status: s.JOB_STATUS_ERROR}
+	cancelled := &s.Job{Id: "cancelled", Status: s.JOB_STATUS_CANCEL}
+	waiting := &s.Job{Id: "waiting", Status: s.JOB_STATUS_WAITING}
+	free := &s.Job{Id: "free", Status: s.JOB_STATUS_WAITING}
+	ready := &s.Job{Id: "ready", Status: s.JOB_STATUS_WAITING, DependsOn: []string{"done"}}
+	pending := &s.Job{Id: "pending", Status: s.JOB_STATUS_WAITING, DependsOn: []string{"done", "waiting"}}
+	afterFailed := &s.Job{Id: "after-failed", Status: s.JOB_STATUS_WAITING, DependsOn: []string{"failed"}}
+	afterCancelled := &s.Job{Id: "after-cancelled", Status: s.JOB_STATUS_WAITING, DependsOn: []string{"cancelled"}}
+	// fails in the same pass as its upstream job
+	cascaded := &s.Job{Id: "cascaded", Status: s.JOB_STATUS_WAITING, DependsOn: []string{"after-failed"}}
+	store := newFakeStore(done, failed, cancelled, waiting, free, ready, pending, afterFailed, afterCancelled, cascaded)
+
+	tcpServer, cleanup := newTestTcpServer(t, store)
+	defer cleanup()
+	scheduler := newTestScheduler(tcpServer)
+
+	// upstream jobs that aren't waiting are only known to the store
+	queue, _ := store.JobsWithStatus(s.JOB_STATUS_WAITING, 0)
+	res := scheduler.resolveDependencies(queue)
+
+	ids := make([]string, len(res))
+	for idx, job := range res {
+		ids[idx] = job.Id
+	}
+	if len(ids) != 3 || ids[0] != "waiting" || ids[1] != "free" || ids[2] != "ready" {
+		t.Fatal("Expected waiting, free and ready, got", ids)
+	}
+	for id, status := range map[string]s.JobStatus{
+		"pending":		s.JOB_STATUS_WAITING,
+		"after-failed":		s.JOB_STATUS_ERROR,
+		"after-cancelled":	s.JOB_STATUS_CANCEL,
+		"cascaded":		s.JOB_STATUS_ERROR,
+	} {
+		if stored, _ := store.JobById(id); stored.Status != status {
+			t.Fatal("Job", id, "must have status", status, "has", stored.Status)
+		}
+	}
+}
+
+func TestOfferTable(t *testing.T) {
+	offers := NewOfferTable(time.Minute)
+
+	if offers.Acquire(&s.Job{Id: "job"}, "n1") == false {
+		t.Fatal("First offer must succeed")
+	}
+	if offers.Acquire(&s.Job{Id: "job"}, "n2") == true {
+		t.Fatal("Job must not be offered to a second node")
+	}
+	if offers.Release("job", "n2") == true {
+		t.Fatal("n2 doesn't hold the lease")
+	}
+	assertInt(t, len(offers.PendingPerNode()["n1"]), 1)
+
+	offers.ReleaseNode("n1")
+	if offers.IsOffered("job") == true {
+		t.Fatal("Lease of dead node must be released")
+	}
+
+	expiring := NewOfferTable(0)
+	expiring.Acquire(&s.Job{Id: "job"}, "n1")
+	if expiring.Acquire(&s.Job{Id: "job"}, "n2") == false {
+		t.Fatal("Expired offer must be released")
+	}
+}
+
+func TestDistributeWithPlacement(t *testing.T) {
+	nodesIn := []*Node{
+		&Node{
+			Name: "a",
+			Capacity: 4,
+			JobsRunning: 1,
+			GpuInfo: []s.GpuInfo{
+				s.GpuInfo {
+					MemoryFreeMB: 8000,
+				},
+			},
+		},
+		&Node{
+			Name: "b",
+			Capacity: 4,
+			JobsRunning: 3,
+			GpuInfo: []s.GpuInfo{
+				s.GpuInfo {
+					MemoryFreeMB: 5000,
+				},
+			},
+		},
+	}
+
+	cpuJob := &s.Job{Identifier: "cpu"}
+	gpuJob := &s.Job{
+		Identifier: "gpu",
+		GpuRequirement: []s.GpuRequirement{
+			s.GpuRequirement{
+				MemoryAvailable: 4000,
+			},
+		},
+	}
+
+	placement := Placement{
+		Default: spreadPlacement{},
+		Gpu: gpuBestFitPlacement{},
+	}
+
+	output := distribute(nodesIn, []*s.Job{cpuJob}, placement, nil)
+	assertInt(t, len(output), 1)
+	assertNodeHasJobAssigned(t, output[0], nodesIn[0], cpuJob)
+
+	output = distribute(nodesIn, []*s.Job{gpuJob}, placement, nil)
+	assertInt(t, len(output), 1)
+	assertNodeHasJobAssigned(t, output[0], nodesIn[1], gpuJob)
+
+	// job overrides the strategy of the server
+	binpackJob := &s.Job{Identifier: "binpack", Placement: PLACEMENT_BINPACK}
+	output = distribute(nodesIn, []*s.Job{binpackJob}, placement, nil)
+	assertInt(t, len(output), 1)
+	assertNodeHasJobAssigned(t, output[0], nodesIn[1], binpackJob)
+
+	// b is full after the first job, the second one must go to a
+	output = distribute(nodesIn, []*s.Job{binpackJob, cpuJob}, Placement{Default: binpackPlacement{}}, nil)
+	assertInt(t, len(output), 2)
+	assertNodeHasJobAssigned(t, output[0], nodesIn[1], binpackJob)
+	assertNodeHasJobAssigned(t, output[1], nodesIn[0], cpuJob)
+}
+
+func TestDistributeOnResources(t *testing.T) {
+	nodesIn := []*Node{
+		&Node{
+			Name: "small",
+			Capacity: 10,
+			Resources: s.ResourceInfo{
+				CpuAllocatable: 2,
+				MemoryAllocatableMB: 4000,
+			},
+		},
+		&Node{
+			Name: "big",
+			Capacity: 10,
+			Resources: s.ResourceInfo{
+				CpuAllocatable: 16,
+				MemoryAllocatableMB: 64000,
+			},
+		},
+	}
+
+	jobs := []*s.Job{
+		// only fits on big
+		&s.Job{
+			Identifier: "0",
+			Resources: s.ResourceRequirement{Cpu: 12, MemoryMB: 1000},
+		},
+		// should get scheduled on small
+		&s.Job{
+			Identifier: "1",
+			Resources: s.ResourceRequirement{Cpu: 2, MemoryMB: 2000},
+		},
+		// small has no cpu left
+		&s.Job{
+			Identifier: "2",
+			Resources: s.ResourceRequirement{Cpu: 1, MemoryMB: 1000},
+		},
+		// doesn't fit anywhere anymore
+		&s.Job{
+			Identifier: "3",
+			Resources: s.ResourceRequirement{MemoryMB: 64000},
+		},
+	}
+
+	output := distribute(nodesIn, jobs, Placement{}, nil)
+
+	assertInt(t, len(output), 3)
+
+	assertNodeHasJobAssigned(t, output[0], nodesIn[1], jobs[0])
+	assertNodeHasJobAssigned(t, output[1], nodesIn[0], jobs[1])
+	assertNodeHasJobAssigned(t, output[2], nodesIn[1], jobs[2])
+}
+
+func TestDistributeWithQuotas(t *testing.T) {
+	nodesIn := []*Node{
+		&Node{
+			Name: "node",
+			Capacity: 10,
+		},
+	}
+
+	cfg := QuotaConfig{
+		Tenants: map[string]int{"a": 2},
+		Identifiers: map[string]int{},
+		ConcurrencyKeys: map[string]int{"gpu-pool": 2},
+	}
+	// already running
+	active := []*s.Job{
+		&s.Job{Id: "r0", Identifier: "train", Tenant: "a"},
+		&s.Job{Id: "r1", Identifier: "reindex", Tenant: "b", ConcurrencyKey: "reindex"},
+	}
+
+	jobs := []*s.Job{
+		// tenant a can run one more
+		&s.Job{Id: "0", Identifier: "train", Tenant: "a"},
+		&s.Job{Id: "1", Identifier: "train", Tenant: "a"},
+		// reindex is a mutex and taken already
+		&s.Job{Id: "2", Identifier: "reindex", Tenant: "b", ConcurrencyKey: "reindex"},
+		&s.Job{Id: "3", Identifier: "eval", Tenant: "b", ConcurrencyKey: "gpu-pool"},
+		&s.Job{Id: "4", Identifier: "eval", Tenant: "b", ConcurrencyKey: "gpu-pool"},
+		&s.Job{Id: "5", Identifier: "eval", Tenant: "b", ConcurrencyKey: "gpu-pool"},
+	}
+
+	quotas := NewQuotaUsage(cfg, active)
+	output := distribute(nodesIn, jobs, Placement{}, quotas)
+
+	assertInt(t, len(output), 3)
+	assertNodeHasJobAssigned(t, output[0], nodesIn[0], jobs[0])
+	assertNodeHasJobAssigned(t, output[1], nodesIn[0], jobs[3])
+	assertNodeHasJobAssigned(t, output[2], nodesIn[0], jobs[4])
+
+	blocked := quotas.Blocked()
+	assertInt(t, len(blocked), 3)
+	for _, id := range []string{"1", "2", "5"} {
+		if blocked[id] == "" {
+			t.Fatal("Job", id, "should be blocked by quota")
+		}
+	}
+}
+
+func TestVictimsOnNode(t *testing.T) {
+	node := &Node{
+		Name: "a",
+		Capacity: 2,
+		JobsRunning: 2,
+		Resources: s.ResourceInfo{
+			CpuAllocatable: 1,
+		},
+	}
 
+	low := &s.Job{Id: "low", Priority: 10, Resources: s.ResourceRequirement{Cpu: 2}}
+	mid := &s.Job{Id: "mid", Priority: 50, Resources: s.ResourceRequirement{Cpu: 2}}
+	candidates := []*s.Job{mid, low}
+	sortVictimCandidates(candidates)
+
+	// one slot and enough cpu is free after low is gone
+	job := &s.Job{Priority: 100, Resources: s.ResourceRequirement{Cpu: 3}}
+	victims := victimsOnNode(copyNode(node), job, selectorOf(job), candidates, 10)
+	assertInt(t, len(victims), 1)
+	if victims[0] != low {
+		t.Fatal("Job with lowest priority must be preempted first")
+	}
+
+	// both have to go
+	job = &s.Job{Priority: 100, Resources: s.ResourceRequirement{Cpu: 5}}
+	victims = victimsOnNode(copyNode(node), job, selectorOf(job), candidates, 10)
+	assertInt(t, len(victims), 2)
+
+	// gap to mid is too small
+	job = &s.Job{Priority: 55, Resources: s.ResourceRequirement{Cpu: 5}}
+	victims = victimsOnNode(copyNode(node), job, selectorOf(job), candidates, 10)
+	if victims != nil {
+		t.Fatal("Jobs within the priority gap must not be preempted")
+	}
+
+	// job doesn't fit even if everything is preempted
+	job = &s.Job{Priority: 100, Resources: s.ResourceRequirement{Cpu: 8}}
+	victims = victimsOnNode(copyNode(node), job, selectorOf(job), candidates, 10)
+	if victims != nil {
+		t.Fatal("Nothing must be preempted for a job that can't run on the node")
+	}
+}
+
+func TestFairShareOrder(t *testing.T) {
+	jobs := []*s.Job{
+		&s.Job{Identifier: "a0", Tenant: "a", Priority: 10},
+		&s.Job{Identifier: "a1", Tenant: "a", Priority: 10},
+		&s.Job{Identifier: "a2", Tenant: "a", Priority: 10},
+		&s.Job{Identifier: "a3", Tenant: "a", Priority: 10},
+		&s.Job{Identifier: "b0", Tenant: "b", Priority: 10},
+		&s.Job{Identifier: "b1", Tenant: "b", Priority: 10},
+		&s.Job{Identifier: "c0", Tenant: "c", Priority: 50},
+	}
+	cfg := FairShareConfig{
+		Shares: map[string]float64{"a": 2},
+		DefaultShare: 1,
+	}
+	// b used less than its share, a has a bigger share
+	usage := map[string]float64{"a": 100, "b": 10}
+
+	ordered := fairShareOrder(jobs, usage, cfg)
+
+	expected := []string{"c0", "b0", "a0", "a1", "b1", "a2", "a3"}
+	assertInt(t, len(ordered), len(expected))
+	for idx, job := range ordered {
+		if job.Identifier != expected[idx] {
+			t.Fatal("Actual order", idx, job.Identifier, " != ", " Expected", expected[idx])
+		}
+	}
+}
+
+func TestUsageTrackerDecay(t *testing.T) {
+	tracker := NewUsageTracker(time.Hour)
+
+	tracker.Add("a", 100, 0)
+	// added later but happened earlier
+	tracker.Add("a", 100, -3600 * 1000)
+
+	usage := tracker.Usage(3600 * 1000)
+	assertInt(t, int(usage["a"]), 75)
+}
+
+func TestPriorityAging(t *testing.T) {
+	cfg := AgingConfig{
+		Enabled: true,
+		IntervalMs: 1000,
+		Step: 5,
+		MaxBoost: 20,
+	}
+	now := int64(100000)
+
+	fresh := &s.Job{Identifier: "fresh", Priority: 30, Timestamp: now}
+	// waited 3 intervals
+	old := &s.Job{Identifier: "old", Priority: 10, Timestamp: now - 3500}
+	// boost is capped
+	ancient := &s.Job{Identifier: "ancient", Priority: 0, Timestamp: now - 60000}
+	// backoff doesn't count as waiting
+	retried := &s.Job{Identifier: "retried", Priority: 10, Timestamp: now - 60000, RetryAt: now - 500}
+
+	assertInt(t, int(effectivePriority(fresh, now, cfg)), 30)
+	assertInt(t, int(effectivePriority(old, now, cfg)), 25)
+	assertInt(t, int(effectivePriority(ancient, now, cfg)), 20)
+	assertInt(t, int(effectivePriority(retried, now, cfg)), 10)
+
+	cfg.Enabled = false
+	assertInt(t, int(effectivePriority(old, now, cfg)), 10)
+	cfg.Enabled = true
+
+	jobs := []*s.Job{retried, ancient, old, fresh}
+	applyAging(jobs, now, cfg)
+	sortJobsByPriority(jobs)
+
+	expected := []string{"fresh", "old", "ancient", "retried"}
+	for idx, job := range jobs {
+		if job.Identifier != expected[idx] {
+			t.Fatal("Actual order", idx, job.Identifier, " != ", " Expected", expected[idx])
+		}
+	}
+}
+
+func TestDistributeGang(t *testing.T) {
+	nodesIn := []*Node{
+		&Node{Name: "a", Capacity: 2, Address: "10.0.0.1"},
+		&Node{Name: "b", Capacity: 2, Address: "10.0.0.2"},
+		&Node{Name: "c", Capacity: 1, Address: "10.0.0.3", Capabilities: []string{"ib"}},
+	}
+
+	gang := func (id string, size int, restrict []string) []*s.Job {
+		members := make([]*s.Job, size)
+		for rank := range members {
+			members[rank] = &s.Job{Id: id + string(rune('0' + rank)), Identifier: id, GangId: id, GangRank: rank, GangSize: size, Restrict: restrict}
+		}
+		return members
+	}
+
+	// needs more distinct nodes than there are. nothing of it may be placed
+	tooBig := gang("big", 4, []string{})
+	// only one node has the capability
+	restricted := gang("ib", 2, []string{"ib"})
+	fits := gang("fits", 3, []string{})
+	single := &s.Job{Id: "single", Identifier: "single"}
+
+	jobs := append(append(append(tooBig, restricted...), fits...), single)
+	output := distribute(nodesIn, jobs, Placement{}, nil)
+
+	assertInt(t, len(output), 4)
+	used := make(map[string]bool)
+	for idx, njm := range output[:3] {
+		if njm.job.GangId != "fits" || njm.job.GangRank != idx {
+			t.Fatal("Expected member", idx, "of gang fits, got", njm.job.Id)
+		}
+		if used[njm.node.Name] {
+			t.Fatal("Gang members share node", njm.node.Name)
+		}
+		used[njm.node.Name] = true
+		assertInt(t, len(njm.peers), 3)
+		if njm.peers[idx] != njm.node.Address {
+			t.Fatal("Peer", idx, njm.peers[idx], "!=", njm.node.Address)
+		}
+	}
+	// c is full now, a or b still has room
+	if output[3].job.Id != "single" || output[3].node.Name == "c" {
+		t.Fatal("Single job not placed on free node")
+	}
+
+	// members still offered somewhere make the gang incomplete
+	assertInt(t, len(completeGangs(append(fits[:2], single))), 1)
+}
+
+func TestDistributeWithNodeAffinity(t *testing.T) {
+	nodesIn := []*Node{
+		&Node{Name: "a", Capacity: 10},
+		&Node{Name: "b", Capacity: 10},
+		&Node{Name: "c", Capacity: 10},
+	}
+
+	jobs := []*s.Job{
+		&s.Job{
+			Identifier: "pinned",
+			Affinity: s.Affinity{Nodes: []string{"c"}},
+		},
+		&s.Job{
+			Identifier: "pinned-to-two",
+			Affinity: s.Affinity{Nodes: []string{"b", "c"}, AvoidNodes: []string{"c"}},
+		},
+		&s.Job{
+			Identifier: "avoids-a",
+			Affinity: s.Affinity{AvoidNodes: []string{"a", "b"}},
+		},
+		// node doesn't exist
+		&s.Job{
+			Identifier: "pinned-to-unknown",
+			Affinity: s.Affinity{Nodes: []string{"d"}},
+		},
+	}
+
+	output := distribute(nodesIn, jobs, Placement{}, nil)
+
+	assertInt(t, len(output), 3)
+	assertNodeHasJobAssigned(t, output[0], nodesIn[2], jobs[0])
+	assertNodeHasJobAssigned(t, output[1], nodesIn[1], jobs[1])
+	assertNodeHasJobAssigned(t, output[2], nodesIn[2], jobs[2])
+}
+
+func TestDistributeWithAntiAffinity(t *testing.T) {
+	nodesIn := []*Node{
+		&Node{Name: "a", Capacity: 10},
+		&Node{Name: "b", Capacity: 10},
+		&Node{Name: "c", Capacity: 10},
+	}
+	addRunningIdentifiers(nodesIn, []*s.Job{
+		&s.Job{Identifier: "reindex", AgentName: "a"},
+		&s.Job{Identifier: "db", AgentName: "b"},
+	})
+
+	noColocation := s.Affinity{AntiAffinity: []string{"reindex"}}
+	jobs := []*s.Job{
+		// a runs a reindex already
+		&s.Job{Identifier: "reindex", Affinity: noColocation},
+		// placed in this pass on the other nodes
+		&s.Job{Identifier: "reindex", Affinity: noColocation},
+		// every node has a reindex now
+		&s.Job{Identifier: "reindex", Affinity: noColocation},
+		// not on node with db
+		&s.Job{Identifier: "web", Affinity: s.Affinity{AntiAffinity: []string{"db"}}},
+	}
+
+	output := distribute(nodesIn, jobs, Placement{Default: firstPlacement{}}, nil)
+
+	assertInt(t, len(output), 3)
+	assertNodeHasJobAssigned(t, output[0], nodesIn[1], jobs[0])
+	assertNodeHasJobAssigned(t, output[1], nodesIn[2], jobs[1])
+	if output[2].job != jobs[3] || output[2].node.Name == "b" {
+		t.Fatal("Job web placed next to db on", output[2].node.Name)
+	}
+
+	// nodes of the caller are not touched
+	assertInt(t, len(nodesIn[1].Identifiers), 1)
+}
+
+func TestDistributePrefersTags(t *testing.T) {
+	nodesIn := []*Node{
+		&Node{Name: "plain", Capacity: 1, Capabilities: []string{}},
+		&Node{Name: "ssd", Capacity: 1, Capabilities: []string{"ssd"}},
+		&Node{Name: "ssd-fast", Capacity: 1, Capabilities: []string{"ssd", "fast"}},
+	}
+
+	prefer := s.Affinity{Prefer: []string{"ssd", "fast"}}
+	jobs := []*s.Job{
+		&s.Job{Identifier: "0", Affinity: prefer},
+		&s.Job{Identifier: "1", Affinity: prefer},
+		// preferred nodes are full. soft constraint, so it goes elsewhere
+		&s.Job{Identifier: "2", Affinity: prefer},
+	}
+
+	output := distribute(nodesIn, jobs, Placement{}, nil)
+
+	assertInt(t, len(output), 3)
 	assertNodeHasJobAssigned(t, output[0], nodesIn[2], jobs[0])
 	assertNodeHasJobAssigned(t, output[1], nodesIn[1], jobs[1])
-	assertNodeHasJobAssigned(t, output[2], nodesIn[2], jobs[3])
-	assertNodeHasJobAssigned(t, output[3], nodesIn[0], jobs[4])
+	assertNodeHasJobAssigned(t, output[2], nodesIn[0], jobs[2])
+}
+
+func TestSelector(t *testing.T) {
+	labels := map[string]string{
+		"zone": "a",
+		"cuda": "11.8",
+		"arch": "amd64",
+		"gpu": "",
+	}
+
+	cases := []struct{
+		expr	string
+		matches	bool
+	}{
+		{"", true},
+		{"zone = a", true},
+		{"zone == b", false},
+		{"zone != b", true},
+		{"region != b", true},
+		{"zone in (a, b)", true},
+		{"zone in (b,c)", false},
+		{"zone notin (b, c)", true},
+		{"region notin (b)", true},
+		{"gpu exists", true},
+		{"tpu exists", false},
+		{"cuda>=11", true},
+		{"cuda > 11.8", false},
+		{"cuda <= 11.8, zone in (a,b), arch=amd64", true},
+		{"cuda < 12, zone = b", false},
+		// not a number
+		{"arch > 1", false},
+		{"region < 1", false},
+	}
+	for _, c := range cases {
+		selector, err := util.ParseSelector(c.expr)
+		if err != nil {
+			t.Fatal("Couldn't parse", c.expr, err)
+		}
+		if selector.Matches(labels) != c.matches {
+			t.Fatal("Selector", c.expr, "should match:", c.matches)
+		}
+	}
+
+	for _, expr := range []string{"zone", "zone in a", "zone in ()", "cuda >= eleven", "zone in (a, b", "zone = a,, x = y"} {
+		if _, err := util.ParseSelector(expr); err == nil {
+			t.Fatal("Expected error parsing", expr)
+		}
+	}
+}
+
+func TestDistributeWithSelector(t *testing.T) {
+	nodesIn := []*Node{
+		&Node{Name: "old", Capacity: 10, Labels: map[string]string{"zone": "a", "cuda": "10"}},
+		&Node{Name: "new", Capacity: 10, Labels: map[string]string{"zone": "b", "cuda": "12"}},
+		&Node{Name: "none", Capacity: 10},
+	}
+
+	jobs := []*s.Job{
+		&s.Job{Identifier: "0", Selector: "cuda >= 11"},
+		&s.Job{Identifier: "1", Selector: "zone notin (b), cuda exists"},
+		&s.Job{Identifier: "2", Selector: "zone in (c)"},
+	}
+
+	output := distribute(nodesIn, jobs, Placement{}, nil)
+
+	assertInt(t, len(output), 2)
+	assertNodeHasJobAssigned(t, output[0], nodesIn[1], jobs[0])
+	assertNodeHasJobAssigned(t, output[1], nodesIn[0], jobs[1])
+}
+
+func TestJobSelectorConsistent(t *testing.T) {
+	labeled := &Node{Name: "labeled", Capacity: 1, Labels: map[string]string{"zone": "a"}}
+	unlabeled := &Node{Name: "unlabeled", Capacity: 1}
+
+	// empty and blank selectors match every node, broken ones none. the same in all filters
+	cases := []struct{
+		selector string
+		matches bool
+	}{
+		{"", true},
+		{"  ", true},
+		{"zone in (a", false},
+	}
+	for _, c := range cases {
+		job := &s.Job{Selector: c.selector}
+		selector := selectorOf(job)
+		for _, node := range []*Node{labeled, unlabeled} {
+			if canPlace(node, job, selector) != c.matches {
+				t.Fatal("canPlace of", node.Name, "with selector", c.selector, "should be", c.matches)
+			}
+			if explainNode(node, job, selector).Fits != c.matches {
+				t.Fatal("explainNode of", node.Name, "with selector", c.selector, "should fit:", c.matches)
+			}
+		}
+		assertInt(t, len(nodesMatchingSelector(selector, []*Node{labeled, unlabeled})), map[bool]int{true: 2, false: 0}[c.matches])
+		if (placeJob([]*Node{copyNode(unlabeled)}, job, Placement{}) != nil) != c.matches {
+			t.Fatal("placeJob with selector", c.selector, "should place:", c.matches)
+		}
+	}
+}
+
+func TestDistributeSkipsCordonedNodes(t *testing.T) {
+	nodesIn := []*Node{
+		&Node{Name: "cordoned", Capacity: 10, Maintenance: NodeMaintenance{Cordoned: true}},
+		&Node{Name: "draining", Capacity: 10, Maintenance: NodeMaintenance{Cordoned: true, Draining: true}},
+		&Node{Name: "ready", Capacity: 1},
+	}
+
+	jobs := []*s.Job{
+		&s.Job{Identifier: "0"},
+		&s.Job{Identifier: "1"},
+	}
+
+	output := distribute(nodesIn, jobs, Placement{}, nil)
+
+	assertInt(t, len(output), 1)
+	assertNodeHasJobAssigned(t, output[0], nodesIn[2], jobs[0])
+
+	if canPlace(nodesIn[0], jobs[1], selectorOf(jobs[1])) {
+		t.Fatal("Jobs must not be placed on a cordoned node by preemption")
+	}
+	if explanation := explainNode(nodesIn[1], jobs[1], selectorOf(jobs[1])); explanation.RejectedBy != FILTER_CORDONED {
+		t.Fatal("Draining node should be rejected as cordoned, is", explanation.RejectedBy)
+	}
+}
+
+func TestExplainNode(t *testing.T) {
+	gpus := []s.GpuInfo{
+		s.GpuInfo{NameGPU: "A100", MemoryFreeMB: 40000},
+		s.GpuInfo{NameGPU: "T4", MemoryFreeMB: 16000},
+	}
+	nodes := []*Node{
+		&Node{Name: "full", Capacity: 1, JobsRunning: 1},
+		&Node{Name: "no-tags", Capacity: 1},
+		&Node{Name: "wrong-zone", Capacity: 1, Capabilities: []string{"gpu"}, Labels: map[string]string{"zone": "b"}},
+		&Node{Name: "avoided", Capacity: 1, Capabilities: []string{"gpu"}},
+		&Node{Name: "small", Capacity: 1, Capabilities: []string{"gpu"}, Resources: s.ResourceInfo{CpuAllocatable: 1}},
+		&Node{Name: "one-gpu", Capacity: 1, Capabilities: []string{"gpu"}, Resources: s.ResourceInfo{CpuAllocatable: 4}, GpuInfo: gpus[:1]},
+		&Node{Name: "reserved", Capacity: 1, Capabilities: []string{"gpu"}, Resources: s.ResourceInfo{CpuAllocatable: 4}, GpuInfo: gpus, GpusReserved: []int{0}},
+		&Node{Name: "fits", Capacity: 1, Capabilities: []string{"gpu"}, Resources: s.ResourceInfo{CpuAllocatable: 4}, GpuInfo: gpus},
+	}
+	job := &s.Job{
+		Restrict: []string{"gpu"},
+		Selector: "zone != b",
+		Affinity: s.Affinity{AvoidNodes: []string{"avoided"}},
+		Resources: s.ResourceRequirement{Cpu: 2},
+		GpuRequirement: []s.GpuRequirement{
+			s.GpuRequirement{Type: "A100", MemoryAvailable: -1},
+			s.GpuRequirement{MemoryAvailable: 10000},
+		},
+	}
+
+	expected := []string{
+		FILTER_CAPACITY,
+		FILTER_CAPABILITIES,
+		FILTER_SELECTOR,
+		FILTER_AFFINITY,
+		FILTER_RESOURCES,
+		FILTER_GPU_COUNT,
+		FILTER_GPU_COUNT,
+		"",
+	}
+	for idx, node := range nodes {
+		explanation := explainNode(node, job, selectorOf(job))
+		if explanation.RejectedBy != expected[idx] || explanation.Fits != (expected[idx] == "") {
+			t.Fatal("Node", node.Name, "rejected by", explanation.RejectedBy, "expected", expected[idx])
+		}
+	}
+
+	// type and memory are told apart
+	job.GpuRequirement = []s.GpuRequirement{s.GpuRequirement{Type: "H100", MemoryAvailable: -1}}
+	if explanation := explainNode(nodes[7], job, selectorOf(job)); explanation.RejectedBy != FILTER_GPU_TYPE {
+		t.Fatal("Expected gpu type, got", explanation.RejectedBy)
+	}
+	job.GpuRequirement = []s.GpuRequirement{s.GpuRequirement{MemoryAvailable: 50000}}
+	if explanation := explainNode(nodes[7], job, selectorOf(job)); explanation.RejectedBy != FILTER_GPU_MEMORY {
+		t.Fatal("Expected gpu memory, got", explanation.RejectedBy)
+	}
+}
+
+func TestExpandArray(t *testing.T) {
+	params, err := arrayParams(2, map[string][]string{
+		"lr": []string{"0.1", "0.01"},
+		"bs": []string{"32", "64", "128"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(params) != 12 {
+		t.Fatal("Array should have 12 children, has", len(params))
+	}
+
+	template := s.NewJob("sweep", "exec", map[string]interface{}{
+		"cmd": "/usr/bin/train",
+		"args": []interface{}{"--lr={{lr}}", "--bs={{bs}}", "--seed={{index}}"},
+		"env": []interface{}{"RUN={{index}}", "KEEP={{unknown}}"},
+	}, nil, []string{}, 10, nil, nil, nil, s.RetryPolicy{}, 0)
+	children := expandArray(template, "array-1", params)
+
+	// bs is the first parameter by name, lr changes fastest
+	args := children[3].DriverConfig["args"].([]interface{})
+	if args[0] != "--lr=0.01" || args[1] != "--bs=64" || args[2] != "--seed=3" {
+		t.Fatal("Wrong args of child 3:", args)
+	}
+	env := children[11].DriverConfig["env"].([]interface{})
+	if env[0] != "RUN=11" || env[1] != "KEEP={{unknown}}" {
+		t.Fatal("Wrong env of child 11:", env)
+	}
+	if children[11].ArrayId != "array-1" || children[11].ArrayIndex != 11 || children[11].ArrayParams["lr"] != "0.01" {
+		t.Fatal("Wrong array info of child 11:", children[11].ArrayId, children[11].ArrayIndex, children[11].ArrayParams)
+	}
+	// template stays untouched
+	if template.DriverConfig["args"].([]interface{})[0] != "--lr={{lr}}" {
+		t.Fatal("Template has been modified")
+	}
+
+	if _, err := arrayParams(0, nil); err == nil {
+		t.Fatal("Empty array should be rejected")
+	}
+	if _, err := arrayParams(1, map[string][]string{"index": []string{"1"}}); err == nil {
+		t.Fatal("Parameter index should be rejected")
+	}
+	if _, err := arrayParams(ARRAY_MAX_SIZE + 1, nil); err == nil {
+		t.Fatal("Too large array should be rejected")
+	}
+}
+
+func TestAggregateArrayStatus(t *testing.T) {
+	withStatus := func (statuses ...s.JobStatus) []*s.Job {
+		jobs := make([]*s.Job, len(statuses))
+		for k, status := range statuses {
+			jobs[k] = &s.Job{Status: status}
+		}
+		return jobs
+	}
+
+	cases := []struct{
+		children	[]*s.Job
+		status		s.JobStatus
+	}{
+		{withStatus(s.JOB_STATUS_SUCCESS, s.JOB_STATUS_SCHEDULED, s.JOB_STATUS_WAITING), s.JOB_STATUS_SCHEDULED},
+		{withStatus(s.JOB_STATUS_SUCCESS, s.JOB_STATUS_WAITING), s.JOB_STATUS_WAITING},
+		{withStatus(s.JOB_STATUS_SUCCESS, s.JOB_STATUS_ERROR, s.JOB_STATUS_CANCEL), s.JOB_STATUS_ERROR},
+		{withStatus(s.JOB_STATUS_SUCCESS, s.JOB_STATUS_INTERRUPT), s.JOB_STATUS_CANCEL},
+		{withStatus(s.JOB_STATUS_SUCCESS, s.JOB_STATUS_DELETE), s.JOB_STATUS_SUCCESS},
+		{withStatus(s.JOB_STATUS_DELETE), s.JOB_STATUS_DELETE},
+	}
+	for k, c := range cases {
+		if status := aggregateStatus(c.children); status != c.status {
+			t.Fatal("Case", k, "should be", c.status, "is", status)
+		}
+	}
+
+	status := NewArrayStatus("array-1", withStatus(s.JOB_STATUS_SUCCESS, s.JOB_STATUS_SUCCESS, s.JOB_STATUS_ERROR))
+	if status.Size != 3 || status.Counts[s.JOB_STATUS_SUCCESS] != 2 || status.Counts[s.JOB_STATUS_ERROR] != 1 {
+		t.Fatal("Wrong counts:", status)
+	}
+}
+
+func TestDisconnectTable(t *testing.T) {
+	table := NewDisconnectTable()
+	table.Add("a", 100)
+	table.Add("b", 200)
+
+	if expired := table.Expired(150); len(expired) != 1 || expired[0] != "a" {
+		t.Fatal("Only a should have expired:", expired)
+	}
+	// expired nodes are handled once
+	if expired := table.Expired(150); len(expired) != 0 {
+		t.Fatal("a should have been removed:", expired)
+	}
+	// b reconnected in time
+	if table.Remove("b") == false || table.Remove("b") {
+		t.Fatal("b should be removed exactly once")
+	}
+	if expired := table.Expired(300); len(expired) != 0 {
+		t.Fatal("Reconnected node must not expire:", expired)
+	}
+}
+
+func TestNextDueAt(t *testing.T) {
+	jobs := []*s.Job{
+		&s.Job{Id: "due", RunAt: 500},
+		&s.Job{Id: "later", RunAt: 3000},
+		&s.Job{Id: "backed-off", RunAt: 500, RetryAt: 2000},
+		&s.Job{Id: "backoff-before-run-at", RunAt: 2500, RetryAt: 1500},
+	}
+	if next := nextDueAt(jobs, 1000); next != 2000 {
+		t.Fatal("Expected 2000, got", next)
+	}
+	if next := nextDueAt(jobs, 2000); next != 2500 {
+		t.Fatal("Expected 2500, got", next)
+	}
+	if next := nextDueAt(jobs, 3000); next != 0 {
+		t.Fatal("All jobs are due, got", next)
+	}
+
+	due := dueJobs(jobs, 2000)
+	if len(due) != 2 || due[0].Id != "due" || due[1].Id != "backed-off" {
+		t.Fatal("Expected due and backed-off, got", due)
+	}
 }
@@ -0,0 +1,156 @@
+package server
+
+import (
+	"fmt"
+	"os"
+	"time"
+	"errors"
+
+	"taylor/server/database"
+	"taylor/lib/structs"
+	"github.com/robfig/cron/v3"
+)
+
+type ScheduleRunner struct {
+	trigger		*Trigger
+	tcpServer	*TcpServer
+	store		database.JobStore
+	config		Config
+}
+
+// returns the next time (in ms) after after at which the schedule fires
+func nextRunAt(spec string, timezone string, after time.Time) (int64, error) {
+	sched, err := cron.ParseStandard(spec)
+	if err != nil {
+		return 0, errors.New(fmt.Sprintf("Invalid cron expression: %v", err))
+	}
+	loc, err := time.LoadLocation(timezone)
+	if err != nil {
+		return 0, errors.New(fmt.Sprintf("Invalid timezone: %v", err))
+	}
+	next := sched.Next(after.In(loc))
+	if next.IsZero() {
+		return 0, errors.New("Cron expression never fires")
+	}
+	return next.UnixNano() / 1000000, nil
+}
+
+func (r *ScheduleRunner) createJob(schedule *structs.Schedule) (*structs.Job, error) {
+	job := schedule.Job.NewInstance()
+	job.ScheduleId = schedule.Id
+
+	fmt.Printf("Schedule %s (%s) creates job %s\n", schedule.Id, schedule.Name, job.Id)
+
+	if _, err := r.store.InsertJob(job); err != nil {
+		return nil, err
+	}
+	r.trigger.Fire()
+	return job, nil
+}
+
+func (r *ScheduleRunner) tick(schedule *structs.Schedule, now time.Time) error {
+	nowMs := now.UnixNano() / 1000000
+
+	lastJobId := schedule.LastJobId
+	lastRunAt := schedule.LastRunAt
+	nextRun := schedule.NextRunAt
+	queued := schedule.Queued
+
+	var lastJob *structs.Job
+	if lastJobId != "" {
+		var err error
+		lastJob, err = r.store.JobById(lastJobId)
+		if err != nil {
+			return err
+		}
+	}
+	active := lastJob != nil && lastJob.IsFinished() == false
+
+	changed := false
+
+	// previous job finished. start the next queued run
+	if queued > 0 && active == false {
+		job, err := r.createJob(schedule)
+		if err != nil {
+			return err
+		}
+		lastJobId = job.Id
+		active = true
+		queued--
+		changed = true
+	}
+
+	if nextRun <= nowMs {
+		next, err := nextRunAt(schedule.Cron, schedule.Timezone, now)
+		if err != nil {
+			return err
+		}
+		nextRun = next
+		lastRunAt = nowMs
+		changed = true
+
+		create := true
+		if active {
+			switch (schedule.OverlapPolicy) {
+			case structs.OVERLAP_SKIP:
+				fmt.Printf("Schedule %s (%s): job %s still active. Skip run\n", schedule.Id, schedule.Name, lastJobId)
+				create = false
+			case structs.OVERLAP_QUEUE:
+				fmt.Printf("Schedule %s (%s): job %s still active. Queue run\n", schedule.Id, schedule.Name, lastJobId)
+				queued++
+				create = false
+			case structs.OVERLAP_CANCEL:
+				fmt.Printf("Schedule %s (%s): cancel job %s\n", schedule.Id, schedule.Name, lastJobId)
+				if err := r.tcpServer.CancelJob(lastJob); err != nil {
+					fmt.Fprintf(os.Stderr, "%v\n", err)
+				}
+			}
+		}
+
+		if create {
+			job, err := r.createJob(schedule)
+			if err != nil {
+				return err
+			}
+			lastJobId = job.Id
+		}
+	}
+
+	if changed == false {
+		return nil
+	}
+	return r.store.UpdateScheduleRunState(schedule.Id, nextRun, lastRunAt, lastJobId, queued)
+}
+
+func (r *ScheduleRunner) run() {
+	for {
+		time.Sleep(1 * time.Second)
+
+		schedules, err := r.store.AllSchedules()
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Error %v\n", err)
+			continue
+		}
+
+		now := time.Now()
+		for _, schedule := range schedules {
+			if schedule.Enabled == false {
+				continue
+			}
+			if err := r.tick(schedule, now); err != nil {
+				fmt.Fprintf(os.Stderr, "Error in schedule %s (%s): %v\n", schedule.Id, schedule.Name, err)
+			}
+		}
+	}
+}
+
+func StartScheduleRunner(config Config, store database.JobStore, server *TcpServer, trigger *Trigger) {
+	runner := ScheduleRunner{
+		trigger: trigger,
+		store: store,
+		tcpServer: server,
+		config: config,
+	}
+
+	go runner.run()
+}
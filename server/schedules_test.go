@@ -0,0 +1,179 @@
+package server
+
+import (
+	"testing"
+	"time"
+
+	s "taylor/lib/structs"
+)
+
+func mustParseTime(t *testing.T, value string) time.Time {
+	parsed, err := time.Parse(time.RFC3339, value)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return parsed
+}
+
+func TestNextRunAt(t *testing.T) {
+	cases := []struct{
+		name		string
+		spec		string
+		timezone	string
+		after		string
+		expected	string
+	}{
+		{"utc", "0 9 * * *", "UTC", "2024-01-15T10:00:00Z", "2024-01-16T09:00:00Z"},
+		{"ahead of utc", "0 9 * * *", "Europe/Berlin", "2024-01-15T10:00:00Z", "2024-01-16T08:00:00Z"},
+		{"half hour offset", "0 0 * * *", "Asia/Kolkata", "2024-01-15T10:00:00Z", "2024-01-15T18:30:00Z"},
+		{"behind utc in winter", "0 9 * * *", "America/New_York", "2024-01-15T12:00:00Z", "2024-01-15T14:00:00Z"},
+		{"behind utc in summer", "0 9 * * *", "America/New_York", "2024-07-01T12:00:00Z", "2024-07-01T13:00:00Z"},
+		// 02:30 doesn't exist on the night the clocks go forward. that day is left out
+		{"dst gap", "30 2 * * *", "Europe/Berlin", "2024-03-30T12:00:00Z", "2024-04-01T00:30:00Z"},
+		{"hourly across dst gap", "0 * * * *", "Europe/Berlin", "2024-03-31T00:30:00Z", "2024-03-31T01:00:00Z"},
+		// 02:30 exists twice on the night the clocks go back. it fires both times
+		{"dst overlap first", "30 2 * * *", "Europe/Berlin", "2024-10-26T12:00:00Z", "2024-10-27T00:30:00Z"},
+		{"dst overlap second", "30 2 * * *", "Europe/Berlin", "2024-10-27T00:45:00Z", "2024-10-27T01:30:00Z"},
+	}
+	for _, c := range cases {
+		next, err := nextRunAt(c.spec, c.timezone, mustParseTime(t, c.after))
+		if err != nil {
+			t.Fatal(c.name, err)
+		}
+		expected := mustParseTime(t, c.expected).UnixNano() / 1000000
+		if next != expected {
+			t.Error(c.name, "next run at", time.Unix(0, next * 1000000).UTC(), "expected", c.expected)
+		}
+	}
+
+	if _, err := nextRunAt("61 * * * *", "UTC", time.Now()); err == nil {
+		t.Error("Expected error for invalid cron expression")
+	}
+	if _, err := nextRunAt("0 * * * *", "Mars/Olympus_Mons", time.Now()); err == nil {
+		t.Error("Expected error for invalid timezone")
+	}
+}
+
+// a schedule that is due at now and whose last job is still waiting
+func overlappingSchedule(t *testing.T, policy string, now time.Time) (*ScheduleRunner, *fakeStore, *s.Schedule, func()) {
+	lastJob := (&s.Job{Identifier: "nightly"}).NewInstance()
+	store := newFakeStore(lastJob)
+	tcpServer, cleanup := newTestTcpServer(t, store)
+
+	schedule := &s.Schedule{
+		Id:		"schedule",
+		Cron:		"0 * * * *",
+		Timezone:	"UTC",
+		OverlapPolicy:	policy,
+		Enabled:	true,
+		Job:		s.Job{Identifier: "nightly"},
+		NextRunAt:	now.UnixNano() / 1000000,
+		LastJobId:	lastJob.Id,
+	}
+	store.InsertSchedule(schedule)
+
+	runner := &ScheduleRunner{
+		trigger:	tcpServer.trigger,
+		tcpServer:	tcpServer,
+		store:		store,
+	}
+	return runner, store, schedule, cleanup
+}
+
+func mustTick(t *testing.T, runner *ScheduleRunner, store *fakeStore, id string, now time.Time) *s.Schedule {
+	schedule, _ := store.ScheduleById(id)
+	if err := runner.tick(schedule, now); err != nil {
+		t.Fatal(err)
+	}
+	schedule, _ = store.ScheduleById(id)
+	return schedule
+}
+
+func TestScheduleTick(t *testing.T) {
+	now := mustParseTime(t, "2024-01-15T10:00:00Z")
+	nextHour := mustParseTime(t, "2024-01-15T11:00:00Z").UnixNano() / 1000000
+
+	runner, store, schedule, cleanup := overlappingSchedule(t, s.OVERLAP_SKIP, now)
+	defer cleanup()
+	store.UpdateJobStatus(schedule.LastJobId, s.JOB_STATUS_SUCCESS)
+
+	// not due yet
+	updated := mustTick(t, runner, store, schedule.Id, now.Add(-time.Minute))
+	if updated.LastJobId != schedule.LastJobId || updated.NextRunAt != schedule.NextRunAt {
+		t.Fatal("Schedule must not change before it is due")
+	}
+
+	// last job finished, so the policy doesn't matter
+	updated = mustTick(t, runner, store, schedule.Id, now)
+	if updated.LastJobId == schedule.LastJobId {
+		t.Fatal("Due schedule must create a job")
+	}
+	if updated.NextRunAt != nextHour || updated.LastRunAt != now.UnixNano() / 1000000 {
+		t.Fatal("Next run at", updated.NextRunAt, "expected", nextHour)
+	}
+	job, _ := store.JobById(updated.LastJobId)
+	if job == nil || job.ScheduleId != schedule.Id || job.Status != s.JOB_STATUS_WAITING {
+		t.Fatal("Created job must wait and point back to its schedule")
+	}
+}
+
+func TestScheduleTickOverlapSkip(t *testing.T) {
+	now := mustParseTime(t, "2024-01-15T10:00:00Z")
+	runner, store, schedule, cleanup := overlappingSchedule(t, s.OVERLAP_SKIP, now)
+	defer cleanup()
+
+	updated := mustTick(t, runner, store, schedule.Id, now)
+	if updated.LastJobId != schedule.LastJobId {
+		t.Fatal("Skip must not create a job while the last one is active")
+	}
+	if updated.NextRunAt <= schedule.NextRunAt {
+		t.Fatal("Skipped run must move the next run")
+	}
+	jobs, _ := store.AllJobs(0)
+	assertInt(t, len(jobs), 1)
+	assertInt(t, updated.Queued, 0)
+}
+
+func TestScheduleTickOverlapQueue(t *testing.T) {
+	now := mustParseTime(t, "2024-01-15T10:00:00Z")
+	runner, store, schedule, cleanup := overlappingSchedule(t, s.OVERLAP_QUEUE, now)
+	defer cleanup()
+
+	updated := mustTick(t, runner, store, schedule.Id, now)
+	if updated.LastJobId != schedule.LastJobId {
+		t.Fatal("Queue must not create a job while the last one is active")
+	}
+	assertInt(t, updated.Queued, 1)
+
+	// still active. the queued run waits
+	updated = mustTick(t, runner, store, schedule.Id, now.Add(time.Minute))
+	assertInt(t, updated.Queued, 1)
+
+	// the queued run starts once the last job finished, before the next run is due
+	store.UpdateJobStatus(schedule.LastJobId, s.JOB_STATUS_SUCCESS)
+	updated = mustTick(t, runner, store, schedule.Id, now.Add(2 * time.Minute))
+	assertInt(t, updated.Queued, 0)
+	if updated.LastJobId == schedule.LastJobId {
+		t.Fatal("Queued run must create a job once the last one finished")
+	}
+	jobs, _ := store.JobsWithStatus(s.JOB_STATUS_WAITING, 0)
+	assertInt(t, len(jobs), 1)
+}
+
+func TestScheduleTickOverlapCancel(t *testing.T) {
+	now := mustParseTime(t, "2024-01-15T10:00:00Z")
+	runner, store, schedule, cleanup := overlappingSchedule(t, s.OVERLAP_CANCEL, now)
+	defer cleanup()
+
+	updated := mustTick(t, runner, store, schedule.Id, now)
+	lastJob, _ := store.JobById(schedule.LastJobId)
+	if lastJob.Status != s.JOB_STATUS_CANCEL {
+		t.Fatal("Cancel must cancel the active job, status is", lastJob.Status)
+	}
+	if updated.LastJobId == schedule.LastJobId {
+		t.Fatal("Cancel must create a new job")
+	}
+	jobs, _ := store.JobsWithStatus(s.JOB_STATUS_WAITING, 0)
+	assertInt(t, len(jobs), 1)
+	assertInt(t, updated.Queued, 0)
+}
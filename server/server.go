@@ -2,8 +2,10 @@ package server
 
 import (
 	"os"
+	"os/signal"
 	"fmt"
 	"path"
+	"syscall"
 
 	"taylor/server/database"
 )
@@ -49,27 +51,80 @@ func Run(args []string, devMode bool) int {
 		}
 	}
 
-	dataBaseDir := path.Join(config.DataDir, "taylor.db")
-	store, err := database.Open(dataBaseDir)
+	dsn := config.Database.Dsn
+	if dsn == "" {
+		switch (config.Database.Backend) {
+		case database.BACKEND_SQLITE:
+			dsn = path.Join(config.DataDir, "taylor.sqlite")
+		default:
+			dsn = path.Join(config.DataDir, "taylor.db")
+		}
+	}
+	store, err := database.Open(config.Database.Backend, dsn)
 	if err != nil {
 		fmt.Fprintf(os.Stderr, "Db Error: %v\n", err)
 		return 1
 	}
 
+	// followers only replicate the store and redirect the api until they become the leader
+	var ha *HaNode
+	if config.Ha.Enabled {
+		ha, err = StartHa(config, store)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Error Starting Ha: %v\n", err)
+			return 1
+		}
+		stopFollowerApi := ha.StartFollowerApi()
+		if err := ha.WaitForLeadership(); err != nil {
+			fmt.Fprintf(os.Stderr, "Error Taking Over Leadership: %v\n", err)
+			return 1
+		}
+		stopFollowerApi()
+	}
+
 	diskLog := NewDiskLog(loggingDir)
+	trigger := NewTrigger()
 
-	tcpS, err := StartTcp(config, TcpDependencies{Store: store, DiskLog: diskLog})
+	tcpS, err := StartTcp(config, TcpDependencies{Store: store, DiskLog: diskLog, Trigger: trigger})
 	if err != nil {
 		fmt.Fprintf(os.Stderr, "Error Starting Tcp: %v\n", err)
 		return 1
 	}
 
-	StartScheduler(config, store, tcpS)
+	scheduler, err := StartScheduler(config, store, tcpS, trigger)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error Starting Scheduler: %v\n", err)
+		return 1
+	}
+	StartScheduleRunner(config, store, tcpS, trigger)
+
+	// running jobs survive a restart, see TcpServer.Shutdown
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, os.Interrupt, syscall.SIGTERM)
+	go func() {
+		sig := <-signals
+		fmt.Printf("Received %v. Shutting down\n", sig)
+		// the read loops of the agents write logs and jobs. they are done once Shutdown returns
+		tcpS.Shutdown()
+		diskLog.CloseAll()
+		if ha != nil {
+			if err := ha.Shutdown(); err != nil {
+				fmt.Fprintf(os.Stderr, "Error leaving cluster: %v\n", err)
+			}
+		}
+		if err := store.Close(); err != nil {
+			fmt.Fprintf(os.Stderr, "Error closing store: %v\n", err)
+		}
+		os.Exit(0)
+	}()
 
 	deps := ApiDependencies{
 		Store:		store,
 		TcpServer:	tcpS,
+		Scheduler:	scheduler,
 		DiskLog:	diskLog,
+		Trigger:	trigger,
+		Ha:		ha,
 	}
 
 	// from here on, we will block forever
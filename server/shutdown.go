@@ -0,0 +1,84 @@
+package server
+
+import (
+	"fmt"
+	"os"
+	"time"
+
+	"taylor/lib/structs"
+	"taylor/lib/tcp"
+)
+
+func (s *TcpServer) isShuttingDown() bool {
+	s.shutdownMtx.Lock()
+	defer s.shutdownMtx.Unlock()
+
+	return s.shuttingDown
+}
+
+// how long Shutdown waits for the read loops to finish the message they are handling
+const SHUTDOWN_READ_LOOP_TIMEOUT = 5 * time.Second
+
+// stops handing out jobs and tells the agents that we go away. scheduled jobs stay as they are,
+// the agents keep running them and report back after the restart (see recoverScheduledJobs).
+// returns once the connections are closed and nothing reads from them anymore, so the logs and
+// the store can be closed afterwards
+func (s *TcpServer) Shutdown() {
+	s.shutdownMtx.Lock()
+	s.shuttingDown = true
+	s.shutdownMtx.Unlock()
+
+	s.listener.Close()
+
+	for _, node := range s.Nodes() {
+		fmt.Printf("Notify agent %s\n", node.Name)
+		err := node.conn.WriteMessage(&tcp.MsgServerShutdown{
+			MsgBase: tcp.MsgBase{
+				Command: tcp.MSG_SERVER_SHUTDOWN,
+				NodeName: s.config.Name,
+			},
+		})
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Error notifying %s: %v\n", node.Name, err)
+		}
+		node.conn.Close()
+	}
+
+	done := make(chan struct{})
+	go func() {
+		s.readLoops.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(SHUTDOWN_READ_LOOP_TIMEOUT):
+		fmt.Fprintf(os.Stderr, "Agent connections still busy after %v\n", SHUTDOWN_READ_LOOP_TIMEOUT)
+	}
+}
+
+// after a restart nobody owns the scheduled jobs. their logs are opened again and their agents
+// get the usual grace window to reconnect and report them (see reconcileNode)
+func (s *TcpServer) recoverScheduledJobs() error {
+	jobs, err := s.store.JobsWithStatus(structs.JOB_STATUS_SCHEDULED, 0)
+	if err != nil {
+		return err
+	}
+
+	nodeNames := make(map[string]bool)
+	for _, job := range jobs {
+		if err := s.diskLog.Open(job); err != nil {
+			fmt.Fprintf(os.Stderr, "%v\n", err)
+		}
+		nodeNames[job.AgentName] = true
+	}
+
+	grace := s.config.NodeLostGraceMs * time.Millisecond
+	deadline := structs.NowMs() + int64(grace / time.Millisecond)
+	for nodeName := range nodeNames {
+		s.disconnected.Add(nodeName, deadline)
+	}
+	if len(jobs) > 0 {
+		fmt.Printf("Recovered %d scheduled jobs of %d agents. Wait %v for them to reconnect\n", len(jobs), len(nodeNames), grace)
+	}
+	return nil
+}
@@ -0,0 +1,152 @@
+package server
+
+import (
+	"io/ioutil"
+	"net"
+	"os"
+	"path"
+	"testing"
+	"time"
+
+	s "taylor/lib/structs"
+	"taylor/lib/tcp"
+)
+
+func readLog(t *testing.T, diskLog *DiskLog, job *s.Job) string {
+	data, err := ioutil.ReadFile(diskLog.makeLogfilePath(job))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(data)
+}
+
+func TestDiskLogCloseAll(t *testing.T) {
+	dir, err := ioutil.TempDir("", "taylor")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	diskLog := NewDiskLog(dir)
+	jobs := []*s.Job{&s.Job{Id: "a"}, &s.Job{Id: "b"}}
+	for _, job := range jobs {
+		if err := diskLog.Open(job); err != nil {
+			t.Fatal(err)
+		}
+		diskLog.WriteString(job, "before shutdown\n")
+	}
+
+	diskLog.CloseAll()
+	for _, job := range jobs {
+		if _, err := diskLog.WriteString(job, "after shutdown\n"); err == nil {
+			t.Fatal("Log of job", job.Id, "must be closed")
+		}
+		if content := readLog(t, diskLog, job); content != "before shutdown\n" {
+			t.Fatal("Log of job", job.Id, "is", content)
+		}
+	}
+
+	// closed logs can be opened again and are appended to
+	if err := diskLog.Open(jobs[0]); err != nil {
+		t.Fatal(err)
+	}
+	diskLog.WriteString(jobs[0], "after restart\n")
+	diskLog.CloseAll()
+	if content := readLog(t, diskLog, jobs[0]); content != "before shutdown\nafter restart\n" {
+		t.Fatal("Log must be appended to after a restart, is", content)
+	}
+}
+
+func TestRecoverScheduledJobs(t *testing.T) {
+	onA := scheduledJob("on-a", "a", s.RetryPolicy{})
+	onB := scheduledJob("on-b", "b", s.RetryPolicy{})
+	waiting := (&s.Job{Identifier: "waiting"}).NewInstance()
+	store := newFakeStore(onA, onB, waiting)
+
+	tcpServer, cleanup := newTestTcpServer(t, store)
+	defer cleanup()
+	tcpServer.config.NodeLostGraceMs = 30000
+
+	// log of the first run
+	if err := ioutil.WriteFile(path.Join(tcpServer.diskLog.dir, onA.Id + ".log"), []byte("before restart\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	before := s.NowMs()
+	if err := tcpServer.recoverScheduledJobs(); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, job := range []*s.Job{onA, onB} {
+		if _, err := tcpServer.diskLog.WriteString(job, "after restart\n"); err != nil {
+			t.Fatal("Log of scheduled job", job.Identifier, "must be open:", err)
+		}
+	}
+	if _, err := tcpServer.diskLog.WriteString(waiting, "after restart\n"); err == nil {
+		t.Fatal("Log of waiting job must not be open")
+	}
+	tcpServer.diskLog.CloseAll()
+	if content := readLog(t, tcpServer.diskLog, onA); content != "before restart\nafter restart\n" {
+		t.Fatal("Log must be appended to, is", content)
+	}
+
+	// the agents get the grace window to come back
+	if expired := tcpServer.disconnected.Expired(before + 29000); len(expired) != 0 {
+		t.Fatal("Agents must not be lost before the grace window ends, lost", expired)
+	}
+	expired := tcpServer.disconnected.Expired(s.NowMs() + 30000)
+	assertInt(t, len(expired), 2)
+	for _, job := range []*s.Job{onA, onB} {
+		if stored, _ := store.JobById(job.Id); stored.Status != s.JOB_STATUS_SCHEDULED {
+			t.Fatal("Recovered job", job.Identifier, "must stay scheduled")
+		}
+	}
+}
+
+func TestShutdownClosesAgentConnections(t *testing.T) {
+	onAgent := scheduledJob("on-agent", "agent", s.RetryPolicy{})
+	store := newFakeStore(onAgent)
+	tcpServer, cleanup := newTestTcpServer(t, store)
+	defer cleanup()
+	tcpServer.config.NodeLostGraceMs = 30000
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	tcpServer.listener = ln
+	go tcpServer.listen()
+
+	c, err := net.Dial("tcp", ln.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	agent := tcp.NewConn(c)
+	defer agent.Close()
+	agent.SetTimeouts(5 * time.Second, 5 * time.Second)
+	err = agent.WriteMessage(tcp.MsgHandshakeInitial{
+		MsgBase:	tcp.MsgBase{Command: tcp.MSG_HANDSHAKE_INITIAL, NodeName: "agent"},
+		NodeType:	"agent",
+		Jobs:		[]string{onAgent.Id},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := agent.ReadMessage(); err != nil {
+		t.Fatal(err)
+	}
+
+	tcpServer.Shutdown()
+
+	// the read loop is done once Shutdown returns
+	assertInt(t, len(tcpServer.Nodes()), 0)
+	if _, cmd, err := agent.ReadMessage(); err != nil || cmd != tcp.MSG_SERVER_SHUTDOWN {
+		t.Fatal("Agent must be told about the shutdown, got", cmd, err)
+	}
+	if _, _, err := agent.ReadMessage(); err == nil {
+		t.Fatal("Connection must be closed")
+	}
+	if stored, _ := store.JobById(onAgent.Id); stored.Status != s.JOB_STATUS_SCHEDULED {
+		t.Fatal("Jobs of the agents must stay scheduled over a restart")
+	}
+}
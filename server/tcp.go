@@ -5,6 +5,7 @@ import (
 	"net"
 	"os"
 	"errors"
+	"sync"
 	"time"
 
 	"taylor/server/database"
@@ -14,17 +15,26 @@ import (
 )
 
 type TcpDependencies struct {
-	Store	*database.Store
+	Store	database.JobStore
 	DiskLog *DiskLog
+	Trigger *Trigger
 }
 
 type Node struct {
 	conn		*tcp.Conn
 	Name		string
 	Capabilities	[]string
+	Labels		map[string]string
 	Capacity	uint
 	JobsRunning	uint
 	GpuInfo		[]structs.GpuInfo
+	Resources	structs.ResourceInfo
+	GpusReserved	[]int
+	// host the agent connects from. gang members use it to find each other
+	Address		string
+	// identifiers of the jobs that run on (or are offered to) the node. only known to the scheduler
+	Identifiers	[]string
+	Maintenance	NodeMaintenance
 }
 
 func NodeFromMessage(c *tcp.Conn, msg tcp.MsgHandshakeInitial) *Node {
@@ -32,13 +42,22 @@ func NodeFromMessage(c *tcp.Conn, msg tcp.MsgHandshakeInitial) *Node {
 		Name: msg.NodeName,
 		Capacity: msg.Capacity,		// for now
 		Capabilities: msg.Capabilities,
+		Labels: msg.Labels,
 		JobsRunning: msg.JobsRunning,
 		GpuInfo: msg.GpuInfo,
+		Resources: msg.Resources,
+		GpusReserved: msg.GpusReserved,
 		conn: c,
 	}
+	if host, _, err := net.SplitHostPort(c.Raddr()); err == nil {
+		n.Address = host
+	}
 	if n.Capabilities == nil {
 		n.Capabilities = make([]string, 0)
 	}
+	if n.Labels == nil {
+		n.Labels = make(map[string]string)
+	}
 	return n
 }
 
@@ -48,65 +67,101 @@ type NodeMsgPair struct {
 }
 
 type TcpServer struct {
-	store		  *database.Store
+	store		  database.JobStore
 	diskLog		  *DiskLog
 	nodes		  map[string]*Node
+	// guards nodes and the fields of the registered nodes that change while they are connected
+	nodesMtx	  *sync.RWMutex
 	dependencies	  TcpDependencies
 	cliChan		  chan NodeMsgPair
 	config		  Config
+	trigger		  *Trigger
+	offers		  *OfferTable
+	preemptions	  *PreemptionTable
+	usage		  *UsageTracker
+	maintenance	  *MaintenanceTable
+	disconnected	  *DisconnectTable
+	timeouts	  *TimeoutTable
+	listener	  net.Listener
+	shutdownMtx	  *sync.Mutex
+	shuttingDown	  bool
+	// the read loops of the agent connections (see handleConn)
+	readLoops	  *sync.WaitGroup
 }
 
 func (s *TcpServer) registerNode(n *Node) bool {
+	s.nodesMtx.Lock()
 	_, in := s.nodes[n.Name]
+	if in == false {
+		n.Maintenance = s.maintenance.Get(n.Name)
+		s.nodes[n.Name] = n
+	}
+	s.nodesMtx.Unlock()
 	if in {
 		return false
 	}
 	fmt.Printf("Register agent %s\n", n.Name)
-	s.nodes[n.Name] = n
+	s.trigger.Fire()
 	return true
 }
 
 func (s *TcpServer) deregisterNode(n *Node) {
+	s.nodesMtx.Lock()
 	_, in := s.nodes[n.Name]
+	delete(s.nodes, n.Name)
+	s.nodesMtx.Unlock()
+
 	if in {
 		fmt.Printf("Deregister agent %s\n", n.Name)
-		jobs, err := s.store.JobsFromNodeWithStatus(n.Name, structs.JOB_STATUS_SCHEDULED)
-		if err == nil {
-			// put jobs back on queue
-			for _, job := range jobs {
-				fmt.Printf("Set job %s (%s) as failed\n", job.Id, job.Identifier)
-				s.deregisterScheduledJob(job, structs.JOB_STATUS_ERROR, "Node died")
-			}
-		}
+		// the agent might come back with its jobs still running
+		s.disconnectNode(n.Name)
+
+		// offers the node hasn't answered yet go back to the queue
+		s.offers.ReleaseNode(n.Name)
 
-		delete(s.nodes, n.Name)
 		n.conn.Close()
+		s.trigger.Fire()
+	}
+}
+
+// copy of a registered node. the copy shares the connection and the lists of the node, those
+// are replaced but never modified in place
+func (s *TcpServer) registeredNode(nodeName string) (*Node, bool) {
+	s.nodesMtx.RLock()
+	defer s.nodesMtx.RUnlock()
+
+	node, in := s.nodes[nodeName]
+	if in == false {
+		return nil, false
 	}
+	copy := *node
+	return &copy, true
 }
 
 
-func (s *TcpServer) handshakeStart(c *tcp.Conn) (*Node, string, error) {
+// returns the node and the jobs it reports
+func (s *TcpServer) handshakeStart(c *tcp.Conn) (*Node, []string, string, error) {
 	// establish handshake
 	fmt.Println("Wait for handshake message")
 	data, _, err := c.ReadMessage()
 	if err != nil {
-		return nil, "", err
+		return nil, nil, "", err
 	}
 
 	msg, ok := data.(tcp.MsgHandshakeInitial)
 	if ok == false {
-		return nil, "Invalid data", nil
+		return nil, nil, "Invalid data", nil
 	}
 
 	if msg.NodeType != "agent" {
-		return nil, "Only agents can join (for now)", nil
+		return nil, nil, "Only agents can join (for now)", nil
 	}
 
 	node := NodeFromMessage(c, msg)
 
 	fmt.Printf("New node: %+v\n", node)
 
-	return node, "", nil
+	return node, msg.Jobs, "", nil
 }
 
 func (s *TcpServer) handshakeEnd(node *Node, refuseReason string) error {
@@ -155,6 +210,11 @@ func (s *TcpServer) handleUpdateHandlers(job *structs.Job, eventName string, pro
 func (s *TcpServer) registerScheduledJob(job *structs.Job, nodeName string) error {
 	fmt.Printf("Register job: %s at agent: %s\n", job.Id, nodeName)
 
+	stored, err := s.storedJob(job)
+	if err != nil {
+		return err
+	}
+
 	if err := s.diskLog.Open(job); err != nil {
 		return err 
 	}
@@ -164,23 +224,102 @@ func (s *TcpServer) registerScheduledJob(job *structs.Job, nodeName string) erro
 	if err := s.store.UpdateJobAgentName(job.Id, nodeName) ; err != nil {
 		return err
 	}
+	if err := s.store.UpdateJobGpuIndices(job.Id, job.GpuIndices) ; err != nil {
+		return err
+	}
+
+	attempts := append(stored.Attempts, structs.JobAttempt{
+		Attempt:	len(stored.Attempts) + 1,
+		AgentName:	nodeName,
+		StartedAt:	structs.NowMs(),
+		Status:		structs.JOB_STATUS_SCHEDULED,
+		GpuIndices:	job.GpuIndices,
+	})
+	if err := s.store.UpdateJobAttempts(job.Id, attempts) ; err != nil {
+		return err
+	}
+	if len(attempts) > 1 {
+		s.diskLog.WriteString(job, fmt.Sprintf("RETRY >> attempt %d at %s\n", len(attempts), nodeName))
+	}
+
 	s.handleUpdateHandlers(job, "create", 0, "")
 	return nil
 }
 
-func (s *TcpServer) deregisterScheduledJob(job *structs.Job, status structs.JobStatus, jobErr string) error {
+// the job we get from agents is the one we offered. attempts etc. might be outdated
+func (s *TcpServer) storedJob(job *structs.Job) (*structs.Job, error) {
+	stored, err := s.store.JobById(job.Id)
+	if err != nil {
+		return nil, err
+	}
+	if stored == nil {
+		return nil, errors.New(fmt.Sprintf("Job %s doesn't exist", job.Id))
+	}
+	return stored, nil
+}
+
+// closes the running attempt of a job
+func finishAttempt(attempts []structs.JobAttempt, status structs.JobStatus, reason string) []structs.JobAttempt {
+	if len(attempts) == 0 {
+		return attempts
+	}
+	last := &attempts[len(attempts)-1]
+	if last.EndedAt == 0 {
+		last.EndedAt = structs.NowMs()
+		last.Status = status
+		last.Reason = reason
+	}
+	return attempts
+}
+
+// puts a failed job back to the queue. the next attempt won't be scheduled before the backoff expired
+func (s *TcpServer) requeueJob(job *structs.Job, attempts []structs.JobAttempt, jobErr string) error {
+	job.Attempts = attempts
+	backoff := job.Retry.Backoff(job.RetryAttempts())
+	fmt.Printf("Retry job %s (%s) in %v. Attempt %d/%d\n", job.Id, job.Identifier, backoff, job.RetryAttempts() + 1, job.Retry.MaxAttempts)
+
+	return s.requeueJobAt(job, attempts, structs.NowMs() + int64(backoff / time.Millisecond), "retry", jobErr)
+}
+
+// puts a preempted job back to the queue. it can be scheduled again right away
+func (s *TcpServer) requeuePreemptedJob(job *structs.Job, preemptorId string) error {
+	reason := fmt.Sprintf("Preempted by job %s", preemptorId)
+	fmt.Printf("Requeue job %s (%s). %s\n", job.Id, job.Identifier, reason)
+
+	s.diskLog.WriteString(job, "PREEMPT >> " + reason + "\n")
+	if err := s.diskLog.Close(job); err != nil {
+		fmt.Fprintf(os.Stderr, "%v\n", err)
+	}
+
+	attempts := finishAttempt(job.Attempts, structs.JOB_STATUS_INTERRUPT, reason)
+	s.usage.AddAttempt(job, attempts)
+	return s.requeueJobAt(job, attempts, 0, "preempt", reason)
+}
+
+func (s *TcpServer) requeueJobAt(job *structs.Job, attempts []structs.JobAttempt, retryAt int64, event string, message string) error {
+	// the next attempt might get another agent and other gpus
+	if err := s.store.RequeueJob(job.Id, attempts, retryAt); err != nil {
+		return err
+	}
+	s.handleUpdateHandlers(job, event, 0, message)
+	// scheduler needs to know when the backoff ends
+	s.trigger.Fire()
+	return nil
+}
+
+// removes a job from its node. if it failed and its retry policy allows it, the job is put
+// back to the queue. otherwise status will be its final status.
+func (s *TcpServer) deregisterScheduledJob(job *structs.Job, status structs.JobStatus, jobErr string, failure string) error {
 	fmt.Printf("Deregister job: %s\n", job.Id)
 
-	switch (status) {
-	case structs.JOB_STATUS_CANCEL:
-		s.handleUpdateHandlers(job, "cancel", 1.0, jobErr)
-	case structs.JOB_STATUS_ERROR:
-		s.handleUpdateHandlers(job, "error", 1.0, jobErr)
-	case structs.JOB_STATUS_SUCCESS:
-		s.handleUpdateHandlers(job, "done", 1.0, "")
+	stored, err := s.storedJob(job)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%v\n", err)
+		stored = job
 	}
+	attempts := finishAttempt(stored.Attempts, status, jobErr)
+	s.usage.AddAttempt(stored, attempts)
 
-	var err error
 	if jobErr != "" {
 		_, err := s.diskLog.WriteString(job, "ERROR >> " + jobErr + "\n")
 		if err != nil {
@@ -190,9 +329,61 @@ func (s *TcpServer) deregisterScheduledJob(job *structs.Job, status structs.JobS
 	if err = s.diskLog.Close(job); err != nil {
 		fmt.Fprintf(os.Stderr, "%v\n", err)
 	}
+
+	failed := status == structs.JOB_STATUS_ERROR || status == structs.JOB_STATUS_TIMEOUT
+	if failed && failure != "" && stored.ShouldRetry(failure) {
+		if err = s.requeueJob(stored, attempts, jobErr); err != nil {
+			fmt.Fprintf(os.Stderr, "%v\n", err)
+		}
+		return err
+	}
+
+	switch (status) {
+	case structs.JOB_STATUS_CANCEL:
+		s.handleUpdateHandlers(job, "cancel", 1.0, jobErr)
+	case structs.JOB_STATUS_ERROR, structs.JOB_STATUS_TIMEOUT:
+		s.handleUpdateHandlers(job, "error", 1.0, jobErr)
+	case structs.JOB_STATUS_SUCCESS:
+		s.handleUpdateHandlers(job, "done", 1.0, "")
+	}
+
+	if err = s.store.UpdateJobAttempts(job.Id, attempts); err != nil {
+		fmt.Fprintf(os.Stderr, "%v\n", err)
+	}
 	if err = s.store.UpdateJobStatus(job.Id, status); err != nil {
 		fmt.Fprintf(os.Stderr, "%v\n", err)
 	}
+	// a gang only makes sense as a whole
+	if stored.IsGangMember() && status != structs.JOB_STATUS_SUCCESS {
+		s.cancelGang(stored.GangId, fmt.Sprintf("Gang member %s didn't succeed", stored.Id))
+	}
+	// node has capacity again and downstream jobs might be ready now
+	s.trigger.Fire()
+	return err
+}
+
+// finishes a job that has never been scheduled at a node (e.g. because an upstream job failed)
+func (s *TcpServer) finishWaitingJob(job *structs.Job, status structs.JobStatus, jobErr string) error {
+	fmt.Printf("Finish waiting job: %s (%s) - %s\n", job.Id, job.Identifier, jobErr)
+
+	if err := s.diskLog.Open(job); err != nil {
+		fmt.Fprintf(os.Stderr, "%v\n", err)
+	} else {
+		s.diskLog.WriteString(job, "ERROR >> " + jobErr + "\n")
+		s.diskLog.Close(job)
+	}
+
+	switch (status) {
+	case structs.JOB_STATUS_CANCEL:
+		s.handleUpdateHandlers(job, "cancel", 1.0, jobErr)
+	case structs.JOB_STATUS_ERROR:
+		s.handleUpdateHandlers(job, "error", 1.0, jobErr)
+	}
+
+	err := s.store.UpdateJobStatus(job.Id, status)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%v\n", err)
+	}
 	return err
 }
 
@@ -211,37 +402,136 @@ func (s *TcpServer) handleMsgJobUpdate(response *tcp.MsgJobUpdate) error {
 func (s *TcpServer) handleMsgJobDone(response *tcp.MsgJobDone) error {
 	fmt.Printf("Job %s (%s) success status: %v - '%s'\n", response.Job.Id, response.Job.Identifier, response.Success, response.ErrorMessage)
 
+	// the job might have been timed out by us or been rescheduled at another node in the meantime
+	stored, err := s.storedJob(&response.Job)
+	if err != nil {
+		return err
+	}
+	if stored.Status != structs.JOB_STATUS_SCHEDULED || stored.AgentName != response.NodeName {
+		return errors.New(fmt.Sprintf("Ignore outdated result of job %s from %s", response.Job.Id, response.NodeName))
+	}
+
 	if err := s.store.UpdateJobProgress(response.Job.Id, 1.0); err != nil {
 		return err
 	}
-	return s.deregisterScheduledJob(&response.Job, response.Job.Status, response.ErrorMessage)
+
+	// we cancelled the job because its agent didn't report the timeout
+	if s.timeouts.Take(stored.Id) && response.Job.Status != structs.JOB_STATUS_SUCCESS {
+		s.preemptions.Take(stored.Id)
+		s.maintenance.TakeEvicted(stored.Id)
+		return s.deregisterScheduledJob(&response.Job, structs.JOB_STATUS_TIMEOUT, TIMEOUT_BACKSTOP_MESSAGE, structs.RETRY_ON_TIMEOUT)
+	}
+	// job stopped because we preempted it. unless it managed to finish, it goes back to the queue
+	if preemptorId, in := s.preemptions.Take(stored.Id); in && response.Job.Status != structs.JOB_STATUS_SUCCESS {
+		return s.requeuePreemptedJob(stored, preemptorId)
+	}
+	// same for jobs evicted from a draining node. gangs can't be requeued partially, so they stay cancelled
+	if s.maintenance.TakeEvicted(stored.Id) && response.Job.Status != structs.JOB_STATUS_SUCCESS && stored.IsGangMember() == false {
+		return s.requeueEvictedJob(stored)
+	}
+
+	failure := structs.RETRY_ON_EXIT_ERROR
+	if response.Job.Status == structs.JOB_STATUS_TIMEOUT {
+		failure = structs.RETRY_ON_TIMEOUT
+	}
+	return s.deregisterScheduledJob(&response.Job, response.Job.Status, response.ErrorMessage, failure)
+}
+
+// rejected offers leave the job in the queue. if the job wants to retry on rejections, the
+// rejection counts as attempt and the job gets backed off
+func (s *TcpServer) handleRejectedJob(job *structs.Job, nodeName string, reason string) error {
+	stored, err := s.storedJob(job)
+	if err != nil {
+		return err
+	}
+	if stored.Status != structs.JOB_STATUS_WAITING || stored.Retry.RetriesOn(structs.RETRY_ON_REJECTED) == false {
+		return nil
+	}
+
+	now := structs.NowMs()
+	attempts := append(stored.Attempts, structs.JobAttempt{
+		Attempt:	len(stored.Attempts) + 1,
+		AgentName:	nodeName,
+		StartedAt:	now,
+		EndedAt:	now,
+		Status:		structs.JOB_STATUS_ERROR,
+		Reason:		reason,
+	})
+	// interrupted attempts don't count, same as for jobs that failed at their agent
+	stored.Attempts = attempts
+	if stored.ShouldRetry(structs.RETRY_ON_REJECTED) == false {
+		if err := s.store.UpdateJobAttempts(job.Id, attempts); err != nil {
+			return err
+		}
+		return s.finishWaitingJob(stored, structs.JOB_STATUS_ERROR, fmt.Sprintf("Rejected by %s: %s", nodeName, reason))
+	}
+	return s.requeueJob(stored, attempts, reason)
 }
 
 func (s *TcpServer) handleMsgJobAccepted(response *tcp.MsgJobAccepted) error {
 	if response.Accepted == false {
+		held := s.offers.Release(response.Job.Id, response.NodeName)
+		if held == false {
+			// offer expired in the meantime. the job is someone elses problem now
+			return errors.New(fmt.Sprintf("Node %s rejected expired offer for job %s", response.NodeName, response.Job.Id))
+		}
+		if err := s.handleRejectedJob(&response.Job, response.NodeName, response.RefuseReason); err != nil {
+			fmt.Fprintf(os.Stderr, "%v\n", err)
+		}
+		// try to place it somewhere else
+		s.trigger.Fire()
 		return errors.New(fmt.Sprintf("Node %s rejected work. Reason %s", response.NodeName, response.RefuseReason))
 	}
 
 	fmt.Printf("Node %s accepted work\n", response.NodeName);
 
+	// the lease goes away once the job is registered. the scheduler must never see the job
+	// waiting without an offer in between
+	held := s.offers.Holds(response.Job.Id, response.NodeName)
+	defer s.offers.Release(response.Job.Id, response.NodeName)
+
+	// if the offer expired and the job went to another agent in the meantime or if the job
+	// got cancelled (e.g. together with its gang), this one must not run it
+	stored, err := s.storedJob(&response.Job)
+	if err != nil || stored.Status != structs.JOB_STATUS_WAITING || (held == false && s.offers.IsOffered(stored.Id)) {
+		if node, in := s.registeredNode(response.NodeName); in {
+			s.sendCancelRequest(node, &response.Job, 0)
+		}
+		return errors.New(fmt.Sprintf("Node %s accepted outdated offer for job %s. Cancel it", response.NodeName, response.Job.Id))
+	}
+
 	return s.registerScheduledJob(&response.Job, response.NodeName)
 }
 
 func (s *TcpServer) updateNodeFromMessage(msgBase tcp.MsgBase, agentInfo tcp.MsgAgentInfo) error {
+	s.nodesMtx.Lock()
 	node, in := s.nodes[msgBase.NodeName]
 	if in == false {
+		s.nodesMtx.Unlock()
 		return errors.New(fmt.Sprintf("Node %s not available anymore.", msgBase.NodeName))
 	}
 
+	capacityChanged := node.JobsRunning != agentInfo.JobsRunning || node.Capacity != agentInfo.Capacity || node.Resources != agentInfo.Resources
+
 	node.JobsRunning = agentInfo.JobsRunning
 	node.Capacity = agentInfo.Capacity
 	node.GpuInfo = agentInfo.GpuInfo
+	node.Resources = agentInfo.Resources
+	node.GpusReserved = agentInfo.GpusReserved
+	if agentInfo.Labels != nil {
+		node.Labels = agentInfo.Labels
+	}
+	s.nodesMtx.Unlock()
+
+	if capacityChanged {
+		s.trigger.Fire()
+	}
 	return nil
 }
 
 func (s *TcpServer) handleConn(c *tcp.Conn) {
 
-	node, refuseReason, err := s.handshakeStart(c)
+	node, reportedJobs, refuseReason, err := s.handshakeStart(c)
 	if err != nil {
 		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
 		c.Close()
@@ -267,12 +557,12 @@ func (s *TcpServer) handleConn(c *tcp.Conn) {
 
 	// everything ok
 	s.handshakeEnd(node, "")
+	s.reconcileNode(node, reportedJobs)
 
 	fmt.Println("Handshake done for", node.Name)
 	for {
 		message, cmd, err := node.conn.ReadMessage()
 		if err != nil {
-			// To-Do: go through all jobs at that agent that are SCHEDULED and put them back into queue
 			fmt.Fprintf(os.Stderr, "Client Error: %v\n", err)
 			return
 		}
@@ -324,19 +614,23 @@ func (s *TcpServer) handleConn(c *tcp.Conn) {
 	}
 }
 
+// copies of the registered nodes (see registeredNode)
 func (s *TcpServer) Nodes() []*Node {
-	nodes := make([]*Node, len(s.nodes))
-
+	s.nodesMtx.RLock()
+	defer s.nodesMtx.RUnlock()
 
+	nodes := make([]*Node, len(s.nodes))
 	i := 0
 	for _, v := range s.nodes {
-		nodes[i] = v
+		copy := *v
+		nodes[i] = &copy
 		i++
 	}
 	return nodes
 }
 
-func (s *TcpServer) listen(ln net.Listener) {
+func (s *TcpServer) listen() {
+	ln := s.listener
 	defer ln.Close()
 
 	go func() {
@@ -346,14 +640,15 @@ func (s *TcpServer) listen(ln net.Listener) {
 			node := nodeMsgPair.node
 			payload := nodeMsgPair.payload
 
-			// check again if node is still connected
-			_, in := s.nodes[node.Name]
+			// check again if node is still connected. the scheduler works on copies
+			// of the nodes, so always send via the registered one
+			registered, in := s.registeredNode(node.Name)
 			if !in {
 				// discard message
 				continue
 			}
 
-			err := node.conn.WriteMessage(payload)
+			err := registered.conn.WriteMessage(payload)
 			if err != nil {
 				fmt.Fprintf(os.Stderr, "Error sending to %s\n", node.Name)
 				// notify node
@@ -364,13 +659,24 @@ func (s *TcpServer) listen(ln net.Listener) {
 	for {
 		c, err := ln.Accept()
 		if err != nil {
+			if s.isShuttingDown() {
+				return
+			}
 			fmt.Fprintf(os.Stderr, "Accept Error: %v\n", err)
 			continue
 		}
 
 		tcpConn := tcp.NewConn(c)
+		// agents answer the agent info requests. if they stop doing so, reading fails and the
+		// agent gets deregistered
+		timeout := s.config.Heartbeat.TimeoutMs * time.Millisecond
+		tcpConn.SetTimeouts(timeout, timeout)
 
-		go s.handleConn(tcpConn)
+		s.readLoops.Add(1)
+		go func() {
+			defer s.readLoops.Done()
+			s.handleConn(tcpConn)
+		}()
 	}
 }
 
@@ -383,30 +689,109 @@ func (s *TcpServer) CancelJob(job *structs.Job) error {
 	switch (job.Status) {
 	case structs.JOB_STATUS_SCHEDULED:
 		fmt.Println("Try to cancel scheduled job")
-		node, in := s.nodes[job.AgentName]
+		node, in := s.registeredNode(job.AgentName)
 		if in == false {
 			return errors.New("Couldn't find registered agent for job")
 		}
 		fmt.Println("Found agent... tell to delete")
-		s.sendCancelRequest(node, job)
+		// the user wants it gone. it must not be requeued if it is being preempted
+		s.preemptions.Take(job.Id)
+		s.maintenance.TakeEvicted(job.Id)
+		s.timeouts.Take(job.Id)
+		s.sendCancelRequest(node, job, 0)
 		return nil
 	case structs.JOB_STATUS_WAITING:
-		return s.store.UpdateJobStatus(job.Id, structs.JOB_STATUS_CANCEL)
+		err := s.store.UpdateJobStatus(job.Id, structs.JOB_STATUS_CANCEL)
+		if job.IsGangMember() {
+			s.cancelGang(job.GangId, fmt.Sprintf("Gang member %s cancelled", job.Id))
+		}
+		// downstream jobs need to be cancelled
+		s.trigger.Fire()
+		return err
 	default:
 		return errors.New("Error. Tried to cancel job that hasn't status SCHEDULED or WAITING")
 	}
 }
 
-func (s *TcpServer) sendCancelRequest(node *Node, job *structs.Job) {
+// cancels all members of a gang that are still waiting or running
+func (s *TcpServer) cancelGang(gangId string, reason string) {
+	members, err := s.store.JobsInGang(gangId)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%v\n", err)
+		return
+	}
+	for _, member := range members {
+		switch (member.Status) {
+		case structs.JOB_STATUS_WAITING:
+			s.finishWaitingJob(member, structs.JOB_STATUS_CANCEL, reason)
+		case structs.JOB_STATUS_SCHEDULED:
+			fmt.Printf("Cancel gang member %s (%s) at %s. %s\n", member.Id, member.Identifier, member.AgentName, reason)
+			if node, in := s.registeredNode(member.AgentName); in {
+				s.sendCancelRequest(node, member, 0)
+			}
+		}
+	}
+}
+
+// the agent kills the job if it doesn't stop within grace (0 means never)
+func (s *TcpServer) sendCancelRequest(node *Node, job *structs.Job, grace time.Duration) {
 	payload := &tcp.MsgJobCancelRequest{
 		MsgBase: tcp.MsgBase{
 			Command: tcp.MSG_JOB_CANCEL_REQUEST,
 			NodeName: s.config.Name,
 		},
 		Job: *job,
+		GraceMs: int64(grace / time.Millisecond),
+	}
+
+	s.Unicast(node, payload)
+}
+
+// offers job to node. returns false if the job is already offered to some agent
+func (s *TcpServer) OfferJob(node *Node, job *structs.Job) bool {
+	if s.isShuttingDown() {
+		return false
+	}
+	if s.offers.Acquire(job, node.Name) == false {
+		return false
+	}
+
+	payload := &tcp.MsgNewJobOffer{
+		MsgBase: tcp.MsgBase{
+			Command: tcp.MSG_NEW_JOB_OFFER,
+			NodeName: s.config.Name,
+		},
+		Job: *job,
 	}
 
 	s.Unicast(node, payload)
+	return true
+}
+
+// asks victim to stop so that preemptor can take its place
+func (s *TcpServer) PreemptJob(victim *structs.Job, preemptor *structs.Job) {
+	node, in := s.registeredNode(victim.AgentName)
+	if in == false || s.isShuttingDown() {
+		return
+	}
+
+	s.preemptions.Add(victim.Id, preemptor.Id)
+	s.sendCancelRequest(node, victim, s.config.Scheduler.Preemption.GraceMs * time.Millisecond)
+}
+
+// jobs that are being preempted
+func (s *TcpServer) Preemptions() *PreemptionTable {
+	return s.preemptions
+}
+
+// recent usage of the tenants
+func (s *TcpServer) Usage() *UsageTracker {
+	return s.usage
+}
+
+// jobs that are offered but not accepted yet
+func (s *TcpServer) Offers() *OfferTable {
+	return s.offers
 }
 
 func (s *TcpServer) Unicast(node *Node, payload interface{}) {
@@ -415,7 +800,7 @@ func (s *TcpServer) Unicast(node *Node, payload interface{}) {
 
 func (s *TcpServer) agentInfoLoop() {
 	for {
-		for _, v := range s.nodes {
+		for _, v := range s.Nodes() {
 			s.Unicast(v, &tcp.MsgAgentInfoRequest{
 				MsgBase: tcp.MsgBase{
 					Command: tcp.MSG_AGENT_INFO_REQUEST,
@@ -423,7 +808,7 @@ func (s *TcpServer) agentInfoLoop() {
 				},
 			})
 		}
-		time.Sleep(1 * time.Second)
+		time.Sleep(s.config.Heartbeat.IntervalMs * time.Millisecond)
 	}
 }
 
@@ -435,13 +820,35 @@ func StartTcp(config Config, deps TcpDependencies) (*TcpServer, error) {
 
 	s := &TcpServer{
 		nodes:		   make(map[string]*Node),
+		nodesMtx:	   &sync.RWMutex{},
 		store:		   deps.Store,
 		cliChan:	   make(chan NodeMsgPair, 50),
 		config:		   config,
 		diskLog:	   deps.DiskLog,
+		trigger:	   deps.Trigger,
+		offers:		   NewOfferTable(config.Scheduler.OfferTimeoutMs * time.Millisecond),
+		// if a victim doesn't report back after it should have been killed, we forget about it
+		preemptions:	   NewPreemptionTable((config.Scheduler.Preemption.GraceMs + config.TimeoutGraceMs) * time.Millisecond),
+		usage:		   NewUsageTracker(config.Scheduler.FairShare.HalfLifeMs * time.Millisecond),
+		maintenance:	   NewMaintenanceTable(),
+		disconnected:	   NewDisconnectTable(),
+		timeouts:	   NewTimeoutTable(),
+		listener:	   ln,
+		shutdownMtx:	   &sync.Mutex{},
+		readLoops:	   &sync.WaitGroup{},
+	}
+
+	if err := s.usage.Rebuild(deps.Store); err != nil {
+		return nil, err
+	}
+	if err := s.recoverScheduledJobs(); err != nil {
+		return nil, err
 	}
 
 	go s.agentInfoLoop()
-	go s.listen(ln)
+	go s.timeoutLoop()
+	go s.drainLoop()
+	go s.lostNodeLoop()
+	go s.listen()
 	return s, nil
 }
@@ -0,0 +1,104 @@
+package server
+
+import (
+	"fmt"
+	"os"
+	"sync"
+	"time"
+
+	"taylor/lib/structs"
+)
+
+const TIMEOUT_BACKSTOP_MESSAGE = "Timeout. Agent didn't report completion in time"
+
+// jobs we cancelled because their agent didn't report that they timed out. they count as timed
+// out once the agent confirms that they stopped (or once the agent is lost)
+type TimeoutTable struct {
+	mtx		*sync.Mutex
+	jobs		map[string]bool
+}
+
+func NewTimeoutTable() *TimeoutTable {
+	return &TimeoutTable{
+		mtx:		&sync.Mutex{},
+		jobs:		make(map[string]bool),
+	}
+}
+
+// returns false if the job has already been timed out
+func (t *TimeoutTable) Add(jobId string) bool {
+	t.mtx.Lock()
+	defer t.mtx.Unlock()
+
+	if t.jobs[jobId] {
+		return false
+	}
+	t.jobs[jobId] = true
+	return true
+}
+
+// removes job from the table. returns whether it was timed out
+func (t *TimeoutTable) Take(jobId string) bool {
+	t.mtx.Lock()
+	defer t.mtx.Unlock()
+
+	in := t.jobs[jobId]
+	delete(t.jobs, jobId)
+	return in
+}
+
+// the loop checks often enough to not exceed the grace by much, but doesn't poll the store
+// more than once a second
+func timeoutCheckInterval(grace time.Duration) time.Duration {
+	interval := grace / 6
+	if interval < time.Second {
+		interval = time.Second
+	}
+	return interval
+}
+
+// backstop for agents that don't report timed out jobs. jobs that run longer than their timeout
+// plus grace period are cancelled. they are marked as timed out (and maybe retried) once the
+// agent reports that they stopped, so a retry never runs next to the old process
+func (s *TcpServer) checkTimeouts(nowMs int64) {
+	jobs, err := s.store.JobsWithStatus(structs.JOB_STATUS_SCHEDULED, 0)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%v\n", err)
+		return
+	}
+
+	grace := s.config.TimeoutGraceMs * time.Millisecond
+	for _, job := range jobs {
+		if job.Timeout <= 0 || len(job.Attempts) == 0 {
+			continue
+		}
+		startedAt := job.Attempts[len(job.Attempts)-1].StartedAt
+		deadline := startedAt + job.Timeout * 1000 + int64(grace / time.Millisecond)
+		if nowMs < deadline {
+			continue
+		}
+
+		// without the agent nobody can stop the job. the lost node path takes care of it
+		node, in := s.registeredNode(job.AgentName)
+		if in == false || s.disconnected.Has(job.AgentName) {
+			continue
+		}
+		if s.timeouts.Add(job.Id) == false {
+			// already cancelled, waiting for the agent
+			continue
+		}
+
+		fmt.Printf("Job %s (%s) at %s didn't finish in time. Cancel it\n", job.Id, job.Identifier, job.AgentName)
+		s.diskLog.WriteString(job, "TIMEOUT >> " + TIMEOUT_BACKSTOP_MESSAGE + "\n")
+		// the agent kills the job if it ignores the cancel
+		s.sendCancelRequest(node, job, grace)
+	}
+}
+
+func (s *TcpServer) timeoutLoop() {
+	interval := timeoutCheckInterval(s.config.TimeoutGraceMs * time.Millisecond)
+	for {
+		time.Sleep(interval)
+		s.checkTimeouts(structs.NowMs())
+	}
+}
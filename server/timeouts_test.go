@@ -0,0 +1,131 @@
+package server
+
+import (
+	"testing"
+	"time"
+
+	s "taylor/lib/structs"
+	"taylor/lib/tcp"
+)
+
+// a job with a timeout of 1s that started startedAgo ms ago
+func jobWithTimeout(identifier string, agentName string, retry s.RetryPolicy, startedAgo int64) *s.Job {
+	job := scheduledJob(identifier, agentName, retry)
+	job.Timeout = 1
+	job.Attempts[0].StartedAt = s.NowMs() - startedAgo
+	return job
+}
+
+func cancelRequests(tcpServer *TcpServer) []string {
+	jobIds := make([]string, 0)
+	for {
+		select {
+		case pair := <-tcpServer.cliChan:
+			if req, ok := pair.payload.(*tcp.MsgJobCancelRequest); ok {
+				jobIds = append(jobIds, req.Job.Id)
+			}
+		default:
+			return jobIds
+		}
+	}
+}
+
+func jobDone(job *s.Job, status s.JobStatus) *tcp.MsgJobDone {
+	done := &tcp.MsgJobDone{
+		MsgBase:	tcp.MsgBase{Command: tcp.MSG_JOB_DONE, NodeName: job.AgentName},
+		Job:		*job,
+		ErrorMessage:	"interrupted",
+	}
+	done.Job.Status = status
+	return done
+}
+
+func TestTimeoutCheckInterval(t *testing.T) {
+	if interval := timeoutCheckInterval(30 * time.Second); interval != 5 * time.Second {
+		t.Fatal("Expected 5s, got", interval)
+	}
+	if interval := timeoutCheckInterval(100 * time.Millisecond); interval != time.Second {
+		t.Fatal("Expected 1s, got", interval)
+	}
+}
+
+func TestTimeoutBackstopWaitsForAgent(t *testing.T) {
+	retryOnTimeout := s.RetryPolicy{MaxAttempts: 3, RetryOn: []string{s.RETRY_ON_TIMEOUT}}
+	retried := jobWithTimeout("retried", "agent", retryOnTimeout, 10000)
+	failed := jobWithTimeout("failed", "agent", s.RetryPolicy{}, 10000)
+	inTime := jobWithTimeout("in-time", "agent", s.RetryPolicy{}, 500)
+	store := newFakeStore(retried, failed, inTime)
+
+	tcpServer, cleanup := newTestTcpServer(t, store)
+	defer cleanup()
+	tcpServer.config.TimeoutGraceMs = 2000
+	tcpServer.registerNode(testNode("agent"))
+
+	tcpServer.checkTimeouts(s.NowMs())
+	cancelled := cancelRequests(tcpServer)
+	if len(cancelled) != 2 || cancelled[0] != retried.Id || cancelled[1] != failed.Id {
+		t.Fatal("Jobs beyond timeout and grace must be cancelled, got", cancelled)
+	}
+	// nothing changes before the agent confirms, and it is asked only once
+	tcpServer.checkTimeouts(s.NowMs())
+	assertInt(t, len(cancelRequests(tcpServer)), 0)
+	for _, job := range []*s.Job{retried, failed, inTime} {
+		if stored, _ := store.JobById(job.Id); stored.Status != s.JOB_STATUS_SCHEDULED {
+			t.Fatal("Job", job.Identifier, "must stay scheduled until the agent stopped it")
+		}
+	}
+
+	// the agent reports the cancelled jobs
+	for _, job := range []*s.Job{retried, failed} {
+		if err := tcpServer.handleMsgJobDone(jobDone(job, s.JOB_STATUS_CANCEL)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	stored, _ := store.JobById(retried.Id)
+	if stored.Status != s.JOB_STATUS_WAITING || stored.AgentName != "" {
+		t.Fatal("Job with retry on timeout must be requeued, is", stored.Status)
+	}
+	if stored.Attempts[0].Status != s.JOB_STATUS_TIMEOUT {
+		t.Fatal("Attempt must have timed out, is", stored.Attempts[0].Status)
+	}
+	if stored, _ := store.JobById(failed.Id); stored.Status != s.JOB_STATUS_TIMEOUT {
+		t.Fatal("Job without retry must time out, is", stored.Status)
+	}
+}
+
+func TestTimeoutBackstopLeavesDisconnectedAgents(t *testing.T) {
+	retryOnTimeout := s.RetryPolicy{MaxAttempts: 3, RetryOn: []string{s.RETRY_ON_TIMEOUT}}
+	onGone := jobWithTimeout("on-gone", "gone", retryOnTimeout, 10000)
+	onHung := jobWithTimeout("on-hung", "hung", s.RetryPolicy{}, 10000)
+	store := newFakeStore(onGone, onHung)
+
+	tcpServer, cleanup := newTestTcpServer(t, store)
+	defer cleanup()
+	tcpServer.config.TimeoutGraceMs = 2000
+	tcpServer.disconnected.Add("gone", s.NowMs() + 30000)
+	hung := testNode("hung")
+	tcpServer.registerNode(hung)
+
+	// the agent in its grace window might still run the job. it must not be retried yet
+	tcpServer.checkTimeouts(s.NowMs())
+	cancelled := cancelRequests(tcpServer)
+	if len(cancelled) != 1 || cancelled[0] != onHung.Id {
+		t.Fatal("Only the job of the connected agent must be cancelled, got", cancelled)
+	}
+	if stored, _ := store.JobById(onGone.Id); stored.Status != s.JOB_STATUS_SCHEDULED {
+		t.Fatal("Job of disconnected agent must stay scheduled, is", stored.Status)
+	}
+
+	// the hung agent never answers and gets lost as well
+	tcpServer.deregisterNode(hung)
+	for _, nodeName := range tcpServer.disconnected.Expired(s.NowMs() + 60000) {
+		jobs, _ := store.JobsFromNodeWithStatus(nodeName, s.JOB_STATUS_SCHEDULED)
+		tcpServer.failJobsOfNode(nodeName, jobs, "Node died")
+	}
+	if stored, _ := store.JobById(onGone.Id); stored.Status != s.JOB_STATUS_ERROR {
+		t.Fatal("Job of lost agent must fail as lost, is", stored.Status)
+	}
+	if stored, _ := store.JobById(onHung.Id); stored.Status != s.JOB_STATUS_TIMEOUT {
+		t.Fatal("Cancelled job of lost agent must time out, is", stored.Status)
+	}
+}
@@ -0,0 +1,25 @@
+package server
+
+// wakes up the scheduler. fires that happen while the scheduler is busy are
+// coalesced into a single scheduling pass
+type Trigger struct {
+	ch	chan struct{}
+}
+
+func NewTrigger() *Trigger {
+	return &Trigger{
+		ch: make(chan struct{}, 1),
+	}
+}
+
+func (t *Trigger) Fire() {
+	select {
+	case t.ch <- struct{}{}:
+	default:
+		// pass already pending
+	}
+}
+
+func (t *Trigger) C() <-chan struct{} {
+	return t.ch
+}
@@ -0,0 +1,115 @@
+package server
+
+import (
+	"net/http"
+	"testing"
+	"time"
+
+	s "taylor/lib/structs"
+	"taylor/lib/tcp"
+)
+
+func fired(trigger *Trigger) bool {
+	select {
+	case <-trigger.C():
+		return true
+	default:
+		return false
+	}
+}
+
+func TestTriggerCoalesces(t *testing.T) {
+	trigger := NewTrigger()
+	if fired(trigger) {
+		t.Fatal("Trigger must not fire by itself")
+	}
+	trigger.Fire()
+	trigger.Fire()
+	trigger.Fire()
+	if fired(trigger) == false {
+		t.Fatal("Trigger must fire")
+	}
+	if fired(trigger) {
+		t.Fatal("Fires while nobody listens must result in a single pass")
+	}
+}
+
+func TestEventsTriggerPass(t *testing.T) {
+	onAgent := scheduledJob("on-agent", "agent", s.RetryPolicy{})
+	store := newFakeStore(onAgent)
+	tcpServer, cleanup := newTestTcpServer(t, store)
+	defer cleanup()
+	trigger := tcpServer.trigger
+	deps := ApiDependencies{Store: store, TcpServer: tcpServer, DiskLog: tcpServer.diskLog, Trigger: trigger}
+
+	tcpServer.registerNode(testNode("agent"))
+	if fired(trigger) == false {
+		t.Fatal("Registered agent must start a pass")
+	}
+
+	c, recorder := testRequest("POST", `{"identifier": "new", "driver": "exec", "driver_config": {"cmd": "true"}}`)
+	postJob(deps, c)
+	assertInt(t, recorder.Code, http.StatusCreated)
+	if fired(trigger) == false {
+		t.Fatal("New job must start a pass")
+	}
+
+	info := tcp.MsgAgentInfo{Capacity: 2}
+	tcpServer.updateNodeFromMessage(tcp.MsgBase{NodeName: "agent"}, info)
+	if fired(trigger) {
+		t.Fatal("Agent info without changes must not start a pass")
+	}
+	info.Capacity = 4
+	tcpServer.updateNodeFromMessage(tcp.MsgBase{NodeName: "agent"}, info)
+	if fired(trigger) == false {
+		t.Fatal("Changed capacity must start a pass")
+	}
+
+	if err := tcpServer.handleMsgJobDone(jobDone(onAgent, s.JOB_STATUS_SUCCESS)); err != nil {
+		t.Fatal(err)
+	}
+	if fired(trigger) == false {
+		t.Fatal("Finished job must start a pass")
+	}
+}
+
+func TestPassSurvivesStoreErrors(t *testing.T) {
+	store := newFakeStore(haJob("job"))
+	tcpServer, cleanup := newTestTcpServer(t, store)
+	defer cleanup()
+	scheduler := newTestScheduler(tcpServer)
+	scheduler.setBlocked(map[string]string{"job": "No agent can take the job right now. See explain"})
+
+	store.failQueries = true
+	if nextDue := scheduler.pass(); nextDue != 0 {
+		t.Fatal("Failed pass must not wait for anything, got", nextDue)
+	}
+	if reason := scheduler.BlockedReason("job"); reason == "" {
+		t.Fatal("Failed pass must keep the reasons of the last one")
+	}
+}
+
+func TestScheduleRunsOnTrigger(t *testing.T) {
+	job := haJob("job")
+	store := newFakeStore()
+	tcpServer, cleanup := newTestTcpServer(t, store)
+	defer cleanup()
+	scheduler := newTestScheduler(tcpServer)
+	// only the trigger may start the pass
+	scheduler.interval = 3600 * 1000
+	tcpServer.registerNode(testNode("agent"))
+	go scheduler.schedule()
+
+	store.InsertJob(job)
+	tcpServer.trigger.Fire()
+
+	select {
+	case pair := <-tcpServer.cliChan:
+		offer, ok := pair.payload.(*tcp.MsgNewJobOffer)
+		if ok == false || offer.Job.Id != job.Id || pair.node.Name != "agent" {
+			t.Fatal("Expected offer of the job to agent, got", pair.payload)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Pass must run when the trigger fires")
+	}
+}